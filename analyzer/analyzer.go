@@ -1,8 +1,10 @@
 package analyzer
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -12,20 +14,39 @@ import (
 	"github.com/bugfan/logrus"
 )
 
-type ParseResponse func(httpResp *http.Response, respDepth uint32) ([]base.Data, []error)
+var analyzerIdGenertor mdw.IdGenertor = mdw.NewIdGenertor()
+
+func genAnalyzerId() uint32 {
+	return analyzerIdGenertor.GetUint32()
+}
+
+// 每个解析函数得到的httpResp.Body都是从头读取的新reader, 不需要关闭; 开启转换时是utf-8文本
+// 缓冲的响应体 解码后的文本和原始的字符集可以通过ResponseFrom(ctx)获取
+type ParseResponse func(ctx context.Context, httpResp *http.Response, respDepth uint32) ([]base.Data, []error)
+
+type responseKey struct{}
+
+// 返回正在解析的响应, 只能在解析函数中使用
+func ResponseFrom(ctx context.Context) (*base.Response, bool) {
+	resp, ok := ctx.Value(responseKey{}).(*base.Response)
+	return resp, ok
+}
 
 type Analyzer interface {
 	Id() uint32
-	Analyze(respParses []ParseResponse, resp base.Response) ([]base.Data, []error)
+	// ctx结束时不再调用后续的解析函数
+	// 响应体先被缓冲, 解析结束后释放; 超过缓冲上限时不解析
+	Analyze(ctx context.Context, respParses []ParseResponse, resp base.Response) ([]base.Data, []error)
 }
 type myAnalyzer struct {
-	id uint32
+	id     uint32
+	buffer base.BufferOptions
 }
 
 func (s *myAnalyzer) Id() uint32 {
-	return 0
+	return s.id
 }
-func (s *myAnalyzer) Analyze(respParses []ParseResponse, resp base.Response) ([]base.Data, []error) {
+func (s *myAnalyzer) Analyze(ctx context.Context, respParses []ParseResponse, resp base.Response) ([]base.Data, []error) {
 	if respParses == nil {
 		return nil, []error{errors.New("The response paeser list is invalid!")}
 	}
@@ -33,20 +54,46 @@ func (s *myAnalyzer) Analyze(respParses []ParseResponse, resp base.Response) ([]
 	if httpResp == nil {
 		return nil, []error{errors.New("The http resp is invalid!")}
 	}
+	if httpResp.Request == nil || httpResp.Request.URL == nil {
+		return nil, []error{errors.New("The http request of the response is invalid!")}
+	}
 	var reqUrl *url.URL = httpResp.Request.URL
 	logrus.Infof("Parse the response (reqUrl=%s) \n", reqUrl)
+	body, err := resp.BufferBody(s.buffer)
+	if err != nil {
+		return nil, []error{errors.New(fmt.Sprintf("Occur error when buffer the response body (reqUrl=%s) :%s", reqUrl, err))}
+	}
+	defer body.Close()
+	newReader := func() (io.ReadCloser, error) {
+		return body.Reader(), nil
+	}
+	if s.buffer.Transcode {
+		if err := resp.TranscodeBody(); err != nil {
+			return nil, []error{errors.New(fmt.Sprintf("Occur error when transcode the response body (reqUrl=%s) :%s", reqUrl, err))}
+		}
+		newReader = body.TextReader
+	}
+	ctx = context.WithValue(ctx, responseKey{}, &resp)
 	respDeth := resp.Depth()
 	dataList := make([]base.Data, 0)
 	errorList := make([]error, 0)
 	for i, respParser := range respParses {
+		if err := ctx.Err(); err != nil {
+			errorList = append(errorList, err)
+			break
+		}
 		if respParser == nil {
 			errorList = append(errorList, errors.New(fmt.Sprintf("The document parser [%d] id valid!", i)))
 			continue
 		}
-		pDataList, pErrorList := respParser(httpResp, respDeth)
+		if httpResp.Body, err = newReader(); err != nil {
+			errorList = append(errorList, err)
+			break
+		}
+		pDataList, pErrorList := respParser(ctx, httpResp, respDeth)
 		if pDataList != nil {
 			for _, pData := range pDataList {
-				dataList = appendDataList(dataList, pData, respDeth)
+				dataList = appendDataList(dataList, pData, respDeth, resp.Seed())
 			}
 		}
 		if pErrorList != nil {
@@ -58,7 +105,7 @@ func (s *myAnalyzer) Analyze(respParses []ParseResponse, resp base.Response) ([]
 	}
 	return dataList, errorList
 }
-func appendDataList(dataList []base.Data, data base.Data, respDeth uint32) []base.Data {
+func appendDataList(dataList []base.Data, data base.Data, respDeth uint32, seed string) []base.Data {
 	if data == nil {
 		return dataList
 	}
@@ -68,7 +115,10 @@ func appendDataList(dataList []base.Data, data base.Data, respDeth uint32) []bas
 	}
 	newDeth := respDeth + 1
 	if req.Depth() != newDeth {
-		req = base.NewRequest(req.HttpReq(), newDeth)
+		req = req.WithDepth(newDeth)
+	}
+	if req.Seed() == "" {
+		req.SetSeed(seed)
 	}
 	return append(dataList, req)
 }
@@ -78,8 +128,10 @@ func appendErrorList(errorList []error, err error) []error {
 	}
 	return append(errorList, err)
 }
-func NewAnalyzer() Analyzer {
-	return &myAnalyzer{}
+
+// buffer为响应体的缓冲设置, 零值表示全部缓冲在内存中
+func NewAnalyzer(buffer base.BufferOptions) Analyzer {
+	return &myAnalyzer{id: genAnalyzerId(), buffer: buffer}
 }
 
 // 开始写 AnalyzerPool
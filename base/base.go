@@ -2,14 +2,22 @@ package base
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 // request
 type Request struct {
-	httpReq *http.Request
-	depth   uint32
+	httpReq   *http.Request
+	depth     uint32
+	seed      string // 请求所属的种子
+	priority  int    // 优先级, 越大越先被下载
+	meta      map[string]interface{}
+	attempts  uint32    // 已经下载过的次数
+	notBefore time.Time // 重试时在此之前不会被下载
 }
 
 func NewRequest(httpreq *http.Request, depth uint32) *Request {
@@ -21,18 +29,84 @@ func (s *Request) HttpReq() *http.Request {
 func (s *Request) Depth() uint32 {
 	return s.depth
 }
+func (s *Request) Seed() string {
+	return s.seed
+}
+func (s *Request) SetSeed(seed string) {
+	s.seed = seed
+}
+func (s *Request) Priority() int {
+	return s.priority
+}
+func (s *Request) SetPriority(priority int) {
+	s.priority = priority
+}
+
+func (s *Request) Attempts() uint32 {
+	return s.attempts
+}
+func (s *Request) SetAttempts(attempts uint32) {
+	s.attempts = attempts
+}
+func (s *Request) NotBefore() time.Time {
+	return s.notBefore
+}
+func (s *Request) SetNotBefore(t time.Time) {
+	s.notBefore = t
+}
+
+// 附加信息, 如站点地图中的lastmod
+func (s *Request) Meta(key string) (interface{}, bool) {
+	value, ok := s.meta[key]
+	return value, ok
+}
+func (s *Request) SetMeta(key string, value interface{}) {
+	if s.meta == nil {
+		s.meta = make(map[string]interface{})
+	}
+	s.meta[key] = value
+}
+
+// 所有附加信息的副本
+func (s *Request) Metadata() map[string]interface{} {
+	meta := make(map[string]interface{}, len(s.meta))
+	for key, value := range s.meta {
+		meta[key] = value
+	}
+	return meta
+}
+
+// 返回指定深度的副本, 保留种子 优先级和附加信息, 不保留重试状态
+func (s *Request) WithDepth(depth uint32) *Request {
+	req := *s
+	req.depth = depth
+	req.attempts = 0
+	req.notBefore = time.Time{}
+	if s.meta != nil {
+		req.meta = make(map[string]interface{}, len(s.meta))
+		for key, value := range s.meta {
+			req.meta[key] = value
+		}
+	}
+	return &req
+}
 func (s *Request) Valid() bool {
 	return s.httpReq != nil && s.httpReq.URL != nil
 }
 
 type Response struct {
-	httpResp *http.Response
-	depth    uint32
+	httpResp  *http.Response
+	depth     uint32
+	seed      string
+	req       *Request // 产生该响应的请求
+	skip      string   // 跳过的原因, 如类型不允许; 跳过的响应体为空
+	truncated *uint32  // 响应体超过限制被截断, 读到截断的位置后才会设置; 所有副本共享
+	body      *Body    // 缓冲后的响应体, 见BufferBody
 }
 
 // response
 func NewResponse(httpResp *http.Response, depth uint32) *Response {
-	return &Response{httpResp: httpResp, depth: depth}
+	return &Response{httpResp: httpResp, depth: depth, truncated: new(uint32)}
 }
 func (s *Response) HttpResp() *http.Response {
 	return s.httpResp
@@ -40,6 +114,86 @@ func (s *Response) HttpResp() *http.Response {
 func (s *Response) Depth() uint32 {
 	return s.depth
 }
+func (s *Response) Seed() string {
+	return s.seed
+}
+func (s *Response) SetSeed(seed string) {
+	s.seed = seed
+}
+func (s *Response) Request() *Request {
+	return s.req
+}
+func (s *Response) SetRequest(req *Request) {
+	s.req = req
+}
+func (s *Response) SkipReason() string {
+	return s.skip
+}
+func (s *Response) SetSkipReason(reason string) {
+	s.skip = reason
+}
+func (s *Response) Skipped() bool {
+	return s.skip != ""
+}
+
+// 响应在传给分析器时会被复制, 截断标记通过指针共享, 读响应体的副本也能看到
+func (s *Response) Truncated() bool {
+	return s.truncated != nil && atomic.LoadUint32(s.truncated) == 1
+}
+func (s *Response) SetTruncated(truncated bool) {
+	if s.truncated == nil {
+		s.truncated = new(uint32)
+	}
+	var value uint32
+	if truncated {
+		value = 1
+	}
+	atomic.StoreUint32(s.truncated, value)
+}
+
+// 读完并关闭原来的响应体, 缓冲后可以多次读取; 已经缓冲过时直接返回
+// 之后HttpResp().Body不能再读取, 需要从返回的Body获取reader
+func (s *Response) BufferBody(opts BufferOptions) (*Body, error) {
+	if s.body != nil {
+		return s.body, nil
+	}
+	httpResp := s.httpResp
+	defer httpResp.Body.Close()
+	body, err := NewBody(httpResp.Body, httpResp.Header.Get("Content-Type"), opts)
+	if err != nil {
+		return nil, err
+	}
+	s.body = body
+	return body, nil
+}
+
+// 没有缓冲时为空
+func (s *Response) Body() *Body {
+	return s.body
+}
+
+// 响应体原始的字符集, 转换为utf-8后仍然保留; 没有缓冲时为空
+func (s *Response) Encoding() string {
+	if s.body == nil {
+		return ""
+	}
+	return s.body.Charset()
+}
+
+// 缓冲后准备把响应体换成utf-8文本: 先解码, 再把Content-Type中的charset改为utf-8
+// 之后应该从Body().TextReader()读取响应体, 原始的字符集见Encoding
+func (s *Response) TranscodeBody() error {
+	if s.body == nil {
+		return errors.New("The response body is not buffered!")
+	}
+	if _, err := s.body.Text(); err != nil {
+		return err
+	}
+	if contentType := s.httpResp.Header.Get("Content-Type"); contentType != "" {
+		s.httpResp.Header.Set("Content-Type", utf8ContentType(contentType))
+	}
+	return nil
+}
 func (s *Response) Valid() bool {
 	return s.httpResp != nil && s.httpResp.Body != nil
 }
@@ -51,7 +205,6 @@ func (s Item) Valid() bool {
 	return s != nil
 }
 
-//
 type Data interface {
 	Valid() bool
 }
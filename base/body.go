@@ -0,0 +1,175 @@
+package base
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// 缓冲的响应体超过MaxBytes时返回, 可以用errors.Is判断
+var ErrBufferTooLarge = errors.New("The response body exceeds the buffer limit!")
+
+// 响应体的缓冲设置
+type BufferOptions struct {
+	// 最多缓冲的字节数, 0表示不限制
+	MaxBytes int64
+	// 内存中最多保存的字节数, 超过时全部写入临时文件, 0表示只使用内存
+	MemoryBytes int64
+	// 临时文件的目录, 为空时使用系统的临时目录
+	SpillDir string
+	// 解析函数读取的响应体转换为utf-8, 并把Content-Type中的charset改为utf-8
+	Transcode bool
+}
+
+// 缓冲的响应体, 可以多次读取 (并发安全), 用完后调用Close删除临时文件
+type Body struct {
+	data        []byte
+	file        *os.File // 写入临时文件时不为空
+	size        int64
+	contentType string
+	textOnce    sync.Once
+	text        string
+	charset     string
+	source      string
+	textErr     error
+}
+
+// 读完r并缓冲, 不关闭r; contentType用于解码文本
+func NewBody(r io.Reader, contentType string, opts BufferOptions) (*Body, error) {
+	s := &Body{contentType: contentType}
+	limit := opts.MaxBytes
+	if opts.MemoryBytes > 0 && (limit == 0 || opts.MemoryBytes < limit) {
+		limit = opts.MemoryBytes
+	}
+	var buf bytes.Buffer
+	reader := r
+	if limit > 0 {
+		reader = io.LimitReader(r, limit+1)
+	}
+	n, err := buf.ReadFrom(reader)
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 || n <= limit {
+		s.data, s.size = buf.Bytes(), n
+		return s, nil
+	}
+	if opts.MaxBytes > 0 && n > opts.MaxBytes {
+		return nil, ErrBufferTooLarge
+	}
+	if err := s.spill(buf.Bytes(), r, opts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 把已读的部分和剩余部分写入临时文件
+func (s *Body) spill(head []byte, rest io.Reader, opts BufferOptions) error {
+	file, err := os.CreateTemp(opts.SpillDir, "webcrawler-body-*")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(head); err != nil {
+		removeFile(file)
+		return err
+	}
+	var reader io.Reader = rest
+	if opts.MaxBytes > 0 {
+		reader = io.LimitReader(rest, opts.MaxBytes-int64(len(head))+1)
+	}
+	n, err := io.Copy(file, reader)
+	if err != nil {
+		removeFile(file)
+		return err
+	}
+	s.size = int64(len(head)) + n
+	if opts.MaxBytes > 0 && s.size > opts.MaxBytes {
+		removeFile(file)
+		return ErrBufferTooLarge
+	}
+	s.file = file
+	return nil
+}
+
+func removeFile(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+func (s *Body) Len() int64 {
+	return s.size
+}
+
+// 是否写入了临时文件
+func (s *Body) Spilled() bool {
+	return s.file != nil
+}
+
+// 每次返回一个新的从头读取的reader
+func (s *Body) Reader() io.ReadCloser {
+	if s.file != nil {
+		return io.NopCloser(io.NewSectionReader(s.file, 0, s.size))
+	}
+	return io.NopCloser(bytes.NewReader(s.data))
+}
+
+// 在内存中时返回同一个切片, 调用者不能修改; 在临时文件中时读出全部内容
+func (s *Body) Bytes() ([]byte, error) {
+	if s.file == nil {
+		return s.data, nil
+	}
+	data := make([]byte, s.size)
+	if _, err := s.file.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// 转换为utf-8的文本, 字符集见DetectCharset; 只解码一次
+func (s *Body) Text() (string, error) {
+	s.textOnce.Do(func() {
+		data, err := s.Bytes()
+		if err != nil {
+			s.textErr = err
+			return
+		}
+		s.charset, s.source = DetectCharset(data, s.contentType)
+		s.text, s.textErr = decodeText(data, s.charset)
+	})
+	return s.text, s.textErr
+}
+
+// 原始的字符集, 如utf-8 gbk big5
+func (s *Body) Charset() string {
+	s.Text()
+	return s.charset
+}
+
+// 字符集的来源, 如CHARSET_HEADER
+func (s *Body) CharsetSource() string {
+	s.Text()
+	return s.source
+}
+
+// 每次返回一个新的读取utf-8文本的reader
+func (s *Body) TextReader() (io.ReadCloser, error) {
+	text, err := s.Text()
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(text)), nil
+}
+
+func (s *Body) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	if removeErr := os.Remove(s.file.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
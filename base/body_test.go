@@ -0,0 +1,148 @@
+package base
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+)
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+	return data
+}
+
+// 临时目录中的文件数
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestNewBody(t *testing.T) {
+	cases := []struct {
+		name    string
+		size    int
+		opts    BufferOptions
+		spilled bool
+		err     error
+	}{
+		{"memory only", 1000, BufferOptions{}, false, nil},
+		{"at memory bytes", 100, BufferOptions{MemoryBytes: 100}, false, nil},
+		{"crosses memory bytes", 101, BufferOptions{MemoryBytes: 100}, true, nil},
+		{"spilled at max bytes", 500, BufferOptions{MemoryBytes: 100, MaxBytes: 500}, true, nil},
+		{"exceeds max bytes after spilling", 501, BufferOptions{MemoryBytes: 100, MaxBytes: 500}, false, ErrBufferTooLarge},
+		{"far exceeds max bytes after spilling", 5000, BufferOptions{MemoryBytes: 100, MaxBytes: 500}, false, ErrBufferTooLarge},
+		{"at max bytes in memory", 100, BufferOptions{MaxBytes: 100}, false, nil},
+		{"exceeds max bytes in memory", 101, BufferOptions{MaxBytes: 100}, false, ErrBufferTooLarge},
+		{"memory bytes above max bytes", 101, BufferOptions{MemoryBytes: 1000, MaxBytes: 100}, false, ErrBufferTooLarge},
+		{"empty", 0, BufferOptions{MemoryBytes: 100, MaxBytes: 500}, false, nil},
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		c.opts.SpillDir = dir
+		data := testData(c.size)
+		body, err := NewBody(bytes.NewReader(data), "text/plain", c.opts)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: NewBody() error = %v; want %v", c.name, err, c.err)
+			continue
+		}
+		if err != nil {
+			// 失败时不留下临时文件
+			if n := countFiles(t, dir); n != 0 {
+				t.Errorf("%s: %d temp files left after the error", c.name, n)
+			}
+			continue
+		}
+		if body.Spilled() != c.spilled || body.Len() != int64(c.size) {
+			t.Errorf("%s: Spilled() = %v, Len() = %d; want %v, %d", c.name, body.Spilled(), body.Len(), c.spilled, c.size)
+		}
+		wantFiles := 0
+		if c.spilled {
+			wantFiles = 1
+		}
+		if n := countFiles(t, dir); n != wantFiles {
+			t.Errorf("%s: %d temp files; want %d", c.name, n, wantFiles)
+		}
+		if got, err := body.Bytes(); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: Bytes() = %d bytes, %v; want %d bytes", c.name, len(got), err, len(data))
+		}
+		// 每次都从头读取
+		for i := 0; i < 2; i++ {
+			if got, err := io.ReadAll(body.Reader()); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%s: read %d: %d bytes, %v; want %d bytes", c.name, i, len(got), err, len(data))
+			}
+		}
+		if err := body.Close(); err != nil {
+			t.Errorf("%s: Close() = %v", c.name, err)
+		}
+		if n := countFiles(t, dir); n != 0 {
+			t.Errorf("%s: %d temp files left after Close()", c.name, n)
+		}
+	}
+}
+
+// 多个解析函数同时读取同一个响应体
+func TestBodyConcurrentReaders(t *testing.T) {
+	cases := []struct {
+		name string
+		opts BufferOptions
+	}{
+		{"memory", BufferOptions{}},
+		{"spilled", BufferOptions{MemoryBytes: 1000}},
+	}
+	data := testData(100000)
+	for _, c := range cases {
+		c.opts.SpillDir = t.TempDir()
+		body, err := NewBody(bytes.NewReader(data), "text/plain", c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				reader := body.Reader()
+				defer reader.Close()
+				// 小块读取, 让各个reader交错
+				got := make([]byte, 0, len(data))
+				buf := make([]byte, 777)
+				for {
+					n, err := reader.Read(buf)
+					got = append(got, buf[:n]...)
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+				if !bytes.Equal(got, data) {
+					errs <- errors.New("the content read is different")
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if text, err := body.Text(); err != nil || text != string(data) {
+			t.Errorf("%s: Text() = %d bytes, %v", c.name, len(text), err)
+		}
+		if err := body.Close(); err != nil {
+			t.Errorf("%s: Close() = %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package base
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+// 字符集的来源, 按检测的顺序
+const (
+	CHARSET_BOM    = "bom"
+	CHARSET_HEADER = "header" // Content-Type中的charset
+	CHARSET_META   = "meta"   // 前1024字节中的<meta charset>或<meta http-equiv>
+	CHARSET_SNIFF  = "sniff"  // 根据内容猜测
+)
+
+const sniffBytes = 64 * 1024 // 猜测字符集时最多检查的字节数
+
+var boms = []struct {
+	bom     []byte
+	charset string
+}{
+	{[]byte{0xEF, 0xBB, 0xBF}, "utf-8"},
+	{[]byte{0xFE, 0xFF}, "utf-16be"},
+	{[]byte{0xFF, 0xFE}, "utf-16le"},
+}
+
+// 检测字符集, 返回标准名称(如utf-8 gbk big5)和来源
+// 依次检查BOM Content-Type和<meta>, 都没有时猜测: 合法的utf-8, 否则按双字节的分布判断gbk和big5, 最后是windows-1252
+func DetectCharset(data []byte, contentType string) (string, string) {
+	for _, b := range boms {
+		if bytes.HasPrefix(data, b.bom) {
+			return b.charset, CHARSET_BOM
+		}
+	}
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if _, name := charset.Lookup(strings.TrimSpace(params["charset"])); name != "" {
+			return name, CHARSET_HEADER
+		}
+	}
+	if name := metaCharset(data); name != "" {
+		return name, CHARSET_META
+	}
+	return sniffCharset(data), CHARSET_SNIFF
+}
+
+// 去掉非ASCII字节后预扫描, 这样没有<meta>时结果一定是windows-1252
+// 声明为windows-1252(包括iso-8859-1和ascii)时当作没有声明, 交给猜测
+func metaCharset(data []byte) string {
+	if len(data) > 1024 {
+		data = data[:1024]
+	}
+	ascii := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b < 0x80 {
+			ascii = append(ascii, b)
+		}
+	}
+	if _, name, _ := charset.DetermineEncoding(ascii, ""); name != "windows-1252" {
+		return name
+	}
+	return ""
+}
+
+// 按双字节的分布猜测: gbk的常用字和标点几乎都在A1-FE/A1-FE区,
+// big5的常用字约有四成第二字节在40-7E, 单字节的西欧字符后面通常是ASCII字母
+func sniffCharset(data []byte) string {
+	if len(data) > sniffBytes {
+		data = data[:sniffBytes]
+		for i := len(data) - 1; i >= 0 && i > len(data)-4; i-- {
+			if utf8.RuneStart(data[i]) {
+				data = data[:i]
+				break
+			}
+		}
+	}
+	if utf8.Valid(data) {
+		return "utf-8"
+	}
+	pairs, gbPairs, lowPairs := 0, 0, 0
+	for i := 0; i+1 < len(data); i++ {
+		lead := data[i]
+		if lead < 0x80 {
+			continue
+		}
+		trail := data[i+1]
+		i++
+		pairs++
+		switch {
+		case lead >= 0xA1 && lead <= 0xFE && trail >= 0xA1 && trail <= 0xFE:
+			gbPairs++
+		case lead >= 0xA1 && lead <= 0xF9 && trail >= 0x40 && trail <= 0x7E:
+			lowPairs++
+		}
+	}
+	if pairs == 0 {
+		return "windows-1252"
+	}
+	if gbPairs*10 >= pairs*9 {
+		return "gbk"
+	}
+	if (gbPairs+lowPairs)*10 >= pairs*9 && lowPairs*10 >= pairs && lowPairs*10 <= pairs*7 {
+		return "big5"
+	}
+	return "windows-1252"
+}
+
+// 按字符集解码为utf-8并去掉BOM, 无法解码的字节换成U+FFFD
+func decodeText(data []byte, name string) (string, error) {
+	text := string(data)
+	if encoding, _ := charset.Lookup(name); encoding != nil && name != "utf-8" {
+		decoded, err := encoding.NewDecoder().Bytes(data)
+		if err != nil {
+			return "", err
+		}
+		text = string(decoded)
+	}
+	return strings.TrimPrefix(text, "\uFEFF"), nil
+}
+
+// 把Content-Type中的charset改为utf-8, 没有Content-Type时不修改
+func utf8ContentType(contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	params["charset"] = "utf-8"
+	return mime.FormatMediaType(mediaType, params)
+}
@@ -0,0 +1,87 @@
+package base
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+func encode(t *testing.T, e encoding.Encoding, s string) string {
+	t.Helper()
+	encoded, err := e.NewEncoder().String(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestDetectCharset(t *testing.T) {
+	const chinese = "网络爬虫按照一定的规则自动抓取万维网信息的程序或者脚本。它们被广泛用于搜索引擎。"
+	const traditional = "網路爬蟲是一種按照一定的規則自動抓取全球資訊網資訊的程式或者指令碼。"
+	gbk := encode(t, simplifiedchinese.GBK, chinese)
+	big5 := encode(t, traditionalchinese.Big5, traditional)
+	latin1 := encode(t, charmap.Windows1252, "Café crème brûlée à la française, señor.")
+	cases := []struct {
+		name        string
+		data        string
+		contentType string
+		charset     string
+		source      string
+	}{
+		{"utf-8 bom", "\xef\xbb\xbfhello", "text/html; charset=gbk", "utf-8", CHARSET_BOM},
+		{"utf-16le bom", "\xff\xfeh\x00i\x00", "", "utf-16le", CHARSET_BOM},
+		{"utf-16be bom", "\xfe\xff\x00h\x00i", "", "utf-16be", CHARSET_BOM},
+		{"header", gbk, "text/html; charset=GB2312", "gbk", CHARSET_HEADER},
+		{"header with quotes", "hello", `text/html; charset="utf-8"`, "utf-8", CHARSET_HEADER},
+		{"header latin1", latin1, "text/plain; charset=iso-8859-1", "windows-1252", CHARSET_HEADER},
+		{"unknown header charset", "hello", "text/html; charset=no-such-charset", "utf-8", CHARSET_SNIFF},
+		{"meta charset", `<html><head><meta charset="big5"></head>` + big5, "text/html", "big5", CHARSET_META},
+		{"meta http-equiv", `<meta http-equiv="Content-Type" content="text/html; charset=gb2312">` + gbk, "", "gbk", CHARSET_META},
+		{"meta after 1024 bytes", strings.Repeat(" ", 1100) + `<meta charset="big5">`, "", "utf-8", CHARSET_SNIFF},
+		{"meta latin1 is sniffed", `<meta charset="iso-8859-1">` + chinese, "", "utf-8", CHARSET_SNIFF},
+		{"ascii", "<html>hello</html>", "", "utf-8", CHARSET_SNIFF},
+		{"utf-8", chinese, "text/html", "utf-8", CHARSET_SNIFF},
+		{"gbk", "<p>" + gbk + "</p>", "text/html", "gbk", CHARSET_SNIFF},
+		{"big5", "<p>" + big5 + "</p>", "", "big5", CHARSET_SNIFF},
+		{"latin1", latin1, "", "windows-1252", CHARSET_SNIFF},
+		{"utf-8 cut at the sniff limit", strings.Repeat("a", sniffBytes-1) + "网", "", "utf-8", CHARSET_SNIFF},
+		{"empty", "", "", "utf-8", CHARSET_SNIFF},
+	}
+	for _, c := range cases {
+		charset, source := DetectCharset([]byte(c.data), c.contentType)
+		if charset != c.charset || source != c.source {
+			t.Errorf("%s: DetectCharset = %s, %s; want %s, %s", c.name, charset, source, c.charset, c.source)
+		}
+	}
+}
+
+func TestBodyText(t *testing.T) {
+	const text = "网络爬虫"
+	gbk := encode(t, simplifiedchinese.GBK, text)
+	cases := []struct {
+		name        string
+		data        string
+		contentType string
+		text        string
+		charset     string
+	}{
+		{"gbk", gbk, "text/html; charset=gbk", text, "gbk"},
+		{"utf-8 bom", "\xef\xbb\xbf" + text, "", text, "utf-8"},
+		{"utf-16le bom", "\xff\xfe\x51\x7f\xdc\x7e", "", "网络", "utf-16le"},
+		{"invalid utf-8", "a\xffb", "text/plain; charset=utf-8", "a\xffb", "utf-8"},
+	}
+	for _, c := range cases {
+		body, err := NewBody(strings.NewReader(c.data), c.contentType, BufferOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := body.Text()
+		if err != nil || got != c.text || body.Charset() != c.charset {
+			t.Errorf("%s: Text() = %q, %v, charset %s; want %q, %s", c.name, got, err, body.Charset(), c.text, c.charset)
+		}
+	}
+}
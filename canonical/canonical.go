@@ -0,0 +1,262 @@
+package canonical
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// url规范化规则
+type Rules struct {
+	LowercaseHost        bool `json:"lowercase_host" yaml:"lowercase_host" toml:"lowercase_host"`
+	StripDefaultPort     bool `json:"strip_default_port" yaml:"strip_default_port" toml:"strip_default_port"`
+	StripFragment        bool `json:"strip_fragment" yaml:"strip_fragment" toml:"strip_fragment"`
+	SortQuery            bool `json:"sort_query" yaml:"sort_query" toml:"sort_query"`
+	RemoveTrackingParams bool `json:"remove_tracking_params" yaml:"remove_tracking_params" toml:"remove_tracking_params"`
+	// 要去掉的查询参数, 以*结尾表示前缀, 为空时使用DefaultTrackingParams
+	TrackingParams []string `json:"tracking_params" yaml:"tracking_params" toml:"tracking_params"`
+	// 处理路径中的.和.., 空路径改为/
+	ResolveDotSegments bool `json:"resolve_dot_segments" yaml:"resolve_dot_segments" toml:"resolve_dot_segments"`
+	// 解码不需要编码的字符, 其它的编码统一为大写
+	NormalizeEncoding bool `json:"normalize_encoding" yaml:"normalize_encoding" toml:"normalize_encoding"`
+}
+
+var DefaultTrackingParams = []string{
+	"utm_*", "gclid", "fbclid", "msclkid", "dclid", "yclid", "mc_cid", "mc_eid", "_hsenc", "_hsmi", "spm",
+}
+
+// 开启所有规则
+func DefaultRules() Rules {
+	return Rules{
+		LowercaseHost:        true,
+		StripDefaultPort:     true,
+		StripFragment:        true,
+		SortQuery:            true,
+		RemoveTrackingParams: true,
+		ResolveDotSegments:   true,
+		NormalizeEncoding:    true,
+	}
+}
+
+// url规范化器, 用于去重和范围判断
+type Canonicalizer interface {
+	// 返回规范化后的副本, 不修改参数
+	Canonicalize(u *url.URL) *url.URL
+	// 规范化后的字符串形式
+	Key(u *url.URL) string
+}
+
+type myCanonicalizer struct {
+	rules          Rules
+	trackingExact  map[string]bool
+	trackingPrefix []string
+}
+
+func NewCanonicalizer(rules Rules) Canonicalizer {
+	c := &myCanonicalizer{
+		rules:         rules,
+		trackingExact: make(map[string]bool),
+	}
+	params := rules.TrackingParams
+	if len(params) == 0 {
+		params = DefaultTrackingParams
+	}
+	for _, param := range params {
+		param = strings.ToLower(param)
+		if strings.HasSuffix(param, "*") {
+			c.trackingPrefix = append(c.trackingPrefix, strings.TrimSuffix(param, "*"))
+		} else {
+			c.trackingExact[param] = true
+		}
+	}
+	return c
+}
+
+func (s *myCanonicalizer) Key(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return s.Canonicalize(u).String()
+}
+
+func (s *myCanonicalizer) Canonicalize(u *url.URL) *url.URL {
+	if u == nil {
+		return nil
+	}
+	c := *u
+	if c.User != nil {
+		user := *c.User
+		c.User = &user
+	}
+	c.Scheme = strings.ToLower(c.Scheme)
+	if s.rules.LowercaseHost {
+		c.Host = strings.ToLower(c.Host)
+	}
+	if s.rules.StripDefaultPort {
+		c.Host = stripDefaultPort(c.Scheme, c.Host)
+	}
+	if s.rules.StripFragment {
+		c.Fragment = ""
+		c.RawFragment = ""
+	}
+	if c.Opaque == "" {
+		p := c.EscapedPath()
+		if s.rules.NormalizeEncoding {
+			p = normalizeEscapes(p)
+		}
+		if s.rules.ResolveDotSegments {
+			p = removeDotSegments(p)
+			if p == "" && c.Host != "" {
+				p = "/"
+			}
+		}
+		if unescaped, err := url.PathUnescape(p); err == nil {
+			c.Path = unescaped
+			c.RawPath = p
+		}
+	}
+	if c.RawQuery != "" || c.ForceQuery {
+		c.RawQuery = s.canonicalQuery(c.RawQuery)
+		if c.RawQuery == "" {
+			c.ForceQuery = false
+		}
+	}
+	return &c
+}
+
+func (s *myCanonicalizer) canonicalQuery(rawQuery string) string {
+	parts := strings.FieldsFunc(rawQuery, func(r rune) bool {
+		return r == '&' || r == ';'
+	})
+	kept := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if s.rules.NormalizeEncoding {
+			part = normalizeEscapes(part)
+		}
+		if s.rules.RemoveTrackingParams && s.isTracking(part) {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	if s.rules.SortQuery {
+		sort.SliceStable(kept, func(i, j int) bool {
+			ki, kj := queryKey(kept[i]), queryKey(kept[j])
+			if ki != kj {
+				return ki < kj
+			}
+			return kept[i] < kept[j]
+		})
+	}
+	return strings.Join(kept, "&")
+}
+
+func (s *myCanonicalizer) isTracking(part string) bool {
+	key, err := url.QueryUnescape(queryKey(part))
+	if err != nil {
+		return false
+	}
+	key = strings.ToLower(key)
+	if s.trackingExact[key] {
+		return true
+	}
+	for _, prefix := range s.trackingPrefix {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func queryKey(part string) string {
+	if i := strings.Index(part, "="); i >= 0 {
+		return part[:i]
+	}
+	return part
+}
+
+func stripDefaultPort(scheme string, host string) string {
+	switch {
+	case scheme == "http" && strings.HasSuffix(host, ":80"):
+		return strings.TrimSuffix(host, ":80")
+	case scheme == "https" && strings.HasSuffix(host, ":443"):
+		return strings.TrimSuffix(host, ":443")
+	}
+	return strings.TrimSuffix(host, ":")
+}
+
+// 按RFC 3986 5.2.4 去掉路径中的.和..
+func removeDotSegments(p string) string {
+	if !strings.Contains(p, ".") {
+		return p
+	}
+	segments := strings.Split(p, "/")
+	out := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 1 || (len(out) == 1 && out[0] != "") {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, segment)
+		}
+	}
+	result := strings.Join(out, "/")
+	if strings.HasPrefix(p, "/") && !strings.HasPrefix(result, "/") {
+		result = "/" + result
+	}
+	return result
+}
+
+// 解码不需要编码的字符(字母 数字 - . _ ~), 其它的%XX统一为大写, 非法的%编码为%25
+func normalizeEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '%' {
+			buf.WriteByte(c)
+			continue
+		}
+		if i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			b := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if isUnreserved(b) {
+				buf.WriteByte(b)
+			} else {
+				buf.WriteByte('%')
+				buf.WriteString(strings.ToUpper(s[i+1 : i+3]))
+			}
+			i += 2
+			continue
+		}
+		buf.WriteString("%25")
+	}
+	return buf.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
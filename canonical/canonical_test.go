@@ -0,0 +1,85 @@
+package canonical
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	canon := NewCanonicalizer(DefaultRules())
+	cases := []struct {
+		raw string
+		key string
+	}{
+		// 主机名和默认端口
+		{"HTTP://Example.COM:80/a", "http://example.com/a"},
+		{"https://example.com:443/a", "https://example.com/a"},
+		{"https://example.com:80/a", "https://example.com:80/a"},
+		{"http://example.com:8080/a", "http://example.com:8080/a"},
+		{"http://example.com:/a", "http://example.com/a"},
+		{"http://example.com", "http://example.com/"},
+		// 片段
+		{"http://example.com/a#top", "http://example.com/a"},
+		// .和..
+		{"http://example.com/a/./b/../c", "http://example.com/a/c"},
+		{"http://example.com/a/b/..", "http://example.com/a/"},
+		{"http://example.com/a/.", "http://example.com/a/"},
+		{"http://example.com/../../a", "http://example.com/a"},
+		{"http://example.com/a/..b/c", "http://example.com/a/..b/c"},
+		// 编码
+		{"http://example.com/%7euser/%61", "http://example.com/~user/a"},
+		{"http://example.com/a%2fb", "http://example.com/a%2Fb"},
+		{"http://example.com/a%2Fb", "http://example.com/a%2Fb"},
+		{"http://example.com/%e4%b8%ad", "http://example.com/%E4%B8%AD"},
+		{"http://example.com/a?q=%7e%2f", "http://example.com/a?q=~%2F"},
+		// 查询参数
+		{"http://example.com/?b=2&a=1&a=0", "http://example.com/?a=0&a=1&b=2"},
+		{"http://example.com/?b=2;a=1", "http://example.com/?a=1&b=2"},
+		{"http://example.com/?utm_source=x&id=1&gclid=y", "http://example.com/?id=1"},
+		{"http://example.com/?UTM_Medium=x&FBCLID=y", "http://example.com/"},
+		{"http://example.com/?utm%5Fsource=x&id=1", "http://example.com/?id=1"},
+		{"http://example.com/?", "http://example.com/"},
+	}
+	for _, c := range cases {
+		u, err := url.Parse(c.raw)
+		if err != nil {
+			t.Fatalf("url.Parse(%q): %s", c.raw, err)
+		}
+		if key := canon.Key(u); key != c.key {
+			t.Errorf("Key(%q) = %q; want %q", c.raw, key, c.key)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	cases := []struct {
+		rules Rules
+		raw   string
+		key   string
+	}{
+		{Rules{}, "HTTP://Example.COM:80/a/../b?b=1&utm_source=x#f", "http://Example.COM:80/a/../b?b=1&utm_source=x#f"},
+		{Rules{SortQuery: true}, "http://example.com/?b=1&a=2", "http://example.com/?a=2&b=1"},
+		{Rules{RemoveTrackingParams: true, TrackingParams: []string{"ref", "src_*"}},
+			"http://example.com/?ref=x&src_a=1&utm_source=y", "http://example.com/?utm_source=y"},
+	}
+	for _, c := range cases {
+		u, _ := url.Parse(c.raw)
+		if key := NewCanonicalizer(c.rules).Key(u); key != c.key {
+			t.Errorf("Key(%q) with %+v = %q; want %q", c.raw, c.rules, key, c.key)
+		}
+	}
+}
+
+func TestCanonicalizeCopies(t *testing.T) {
+	u, _ := url.Parse("http://User@Example.com/a/../b#f")
+	c := NewCanonicalizer(DefaultRules()).Canonicalize(u)
+	if u.String() != "http://User@Example.com/a/../b#f" {
+		t.Errorf("Canonicalize modified its argument: %s", u)
+	}
+	if c.String() != "http://User@example.com/b" {
+		t.Errorf("Canonicalize = %s", c)
+	}
+	if NewCanonicalizer(DefaultRules()).Key(nil) != "" {
+		t.Error("Key(nil) should be empty")
+	}
+}
@@ -0,0 +1,208 @@
+package dedup
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	bloomGrowth     = 2   // 每个新过滤器的容量倍数
+	bloomTightening = 0.9 // 每个新过滤器的误判率倍数
+	// 快照中记录的哈希算法, 换了算法的快照中的位不能再用
+	bloomHashName = "fnv128a-fmix64"
+)
+
+// 可扩展的布隆过滤器去重器
+// 由一系列容量递增、误判率递减的过滤器组成, 总的误判率不超过fpRate
+// 误判时新的url会被当作已经存在而被忽略
+type bloomDeduplicator struct {
+	filters  []*bloomFilter
+	capacity uint64  // 第一个过滤器的容量
+	fpRate   float64 // 总的误判率
+	count    uint64
+	m        sync.RWMutex
+}
+
+func NewBloomDeduplicator(capacity uint64, fpRate float64) (Deduplicator, error) {
+	if capacity == 0 {
+		return nil, errors.New("The bloom filter capacity can not be 0!")
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		return nil, errors.New(fmt.Sprintf("The bloom filter false positive rate %v is invalid!", fpRate))
+	}
+	s := &bloomDeduplicator{
+		capacity: capacity,
+		fpRate:   fpRate,
+	}
+	s.grow()
+	return s, nil
+}
+
+func (s *bloomDeduplicator) grow() {
+	i := len(s.filters)
+	capacity := float64(s.capacity) * math.Pow(bloomGrowth, float64(i))
+	fpRate := s.fpRate * (1 - bloomTightening) * math.Pow(bloomTightening, float64(i))
+	s.filters = append(s.filters, newBloomFilter(uint64(capacity), fpRate))
+}
+
+func (s *bloomDeduplicator) Add(key string) (bool, error) {
+	h1, h2 := bloomHash(key)
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, f := range s.filters {
+		if f.contains(h1, h2) {
+			return false, nil
+		}
+	}
+	current := s.filters[len(s.filters)-1]
+	current.add(h1, h2)
+	s.count++
+	if current.count >= current.capacity {
+		s.grow()
+	}
+	return true, nil
+}
+func (s *bloomDeduplicator) Contains(key string) (bool, error) {
+	h1, h2 := bloomHash(key)
+	s.m.RLock()
+	defer s.m.RUnlock()
+	for _, f := range s.filters {
+		if f.contains(h1, h2) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (s *bloomDeduplicator) Len() uint64 {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.count
+}
+func (s *bloomDeduplicator) Close() error {
+	return nil
+}
+
+// 快照的格式
+type bloomSnapshot struct {
+	Hash     string
+	Capacity uint64
+	FpRate   float64
+	Count    uint64
+	Filters  []bloomFilterSnapshot
+}
+type bloomFilterSnapshot struct {
+	Bits     []uint64
+	M        uint64
+	K        uint64
+	Capacity uint64
+	Count    uint64
+}
+
+func (s *bloomDeduplicator) Snapshot(w io.Writer) error {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	snapshot := bloomSnapshot{Hash: bloomHashName, Capacity: s.capacity, FpRate: s.fpRate, Count: s.count}
+	for _, f := range s.filters {
+		snapshot.Filters = append(snapshot.Filters, bloomFilterSnapshot{
+			Bits: f.bits, M: f.m, K: f.k, Capacity: f.capacity, Count: f.count,
+		})
+	}
+	return gob.NewEncoder(w).Encode(&snapshot)
+}
+
+// 快照的容量和误判率会替换当前的设置
+func (s *bloomDeduplicator) Restore(r io.Reader) error {
+	var snapshot bloomSnapshot
+	if err := gob.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+	if snapshot.Hash != bloomHashName {
+		return errors.New(fmt.Sprintf("The bloom filter snapshot uses the hash %q instead of %q!", snapshot.Hash, bloomHashName))
+	}
+	if len(snapshot.Filters) == 0 {
+		return errors.New("The bloom filter snapshot is empty!")
+	}
+	filters := make([]*bloomFilter, 0, len(snapshot.Filters))
+	for _, f := range snapshot.Filters {
+		if f.M == 0 || uint64(len(f.Bits)) != (f.M+63)/64 {
+			return errors.New("The bloom filter snapshot is invalid!")
+		}
+		filters = append(filters, &bloomFilter{bits: f.Bits, m: f.M, k: f.K, capacity: f.Capacity, count: f.Count})
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.capacity, s.fpRate, s.count = snapshot.Capacity, snapshot.FpRate, snapshot.Count
+	s.filters = filters
+	return nil
+}
+
+// 单个布隆过滤器
+type bloomFilter struct {
+	bits     []uint64
+	m        uint64 // 位数
+	k        uint64 // 哈希函数个数
+	capacity uint64
+	count    uint64
+}
+
+func newBloomFilter(capacity uint64, fpRate float64) *bloomFilter {
+	if capacity == 0 {
+		capacity = 1
+	}
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Ceil(float64(m) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits:     make([]uint64, (m+63)/64),
+		m:        m,
+		k:        k,
+		capacity: capacity,
+	}
+}
+
+func (s *bloomFilter) add(h1, h2 uint64) {
+	for i := uint64(0); i < s.k; i++ {
+		pos := (h1 + i*h2) % s.m
+		s.bits[pos/64] |= 1 << (pos % 64)
+	}
+	s.count++
+}
+func (s *bloomFilter) contains(h1, h2 uint64) bool {
+	for i := uint64(0); i < s.k; i++ {
+		pos := (h1 + i*h2) % s.m
+		if s.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 两个独立的哈希值, 用 h1 + i*h2 模拟k个哈希函数
+// 取128位FNV-1a的高低两半; 低64位只和素数的低位(0x13b)相乘, 混合得很差, 所以两半都再经过fmix64
+func bloomHash(key string) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write([]byte(key))
+	sum := h.Sum(nil)
+	return fmix64(binary.BigEndian.Uint64(sum[:8])), fmix64(binary.BigEndian.Uint64(sum[8:])) | 1
+}
+
+// MurmurHash3的64位终结函数, 让每一位输入都影响所有输出位
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
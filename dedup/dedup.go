@@ -0,0 +1,86 @@
+package dedup
+
+import (
+	"io"
+	"sync"
+)
+
+// url去重器, 必须是并发安全的
+type Deduplicator interface {
+	// 第一次添加时返回true, 已经存在时返回false
+	Add(key string) (bool, error)
+	Contains(key string) (bool, error)
+	// 已添加的数量
+	Len() uint64
+	Close() error
+}
+
+// 可以遍历所有key的去重器
+type Iterable interface {
+	Range(f func(key string) bool) error
+}
+
+// 基于map的去重器
+type memoryDeduplicator struct {
+	keys map[string]struct{}
+	m    sync.RWMutex
+}
+
+func NewMemoryDeduplicator() Deduplicator {
+	return &memoryDeduplicator{keys: make(map[string]struct{})}
+}
+
+func (s *memoryDeduplicator) Add(key string) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.keys[key]; ok {
+		return false, nil
+	}
+	s.keys[key] = struct{}{}
+	return true, nil
+}
+func (s *memoryDeduplicator) Contains(key string) (bool, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	_, ok := s.keys[key]
+	return ok, nil
+}
+func (s *memoryDeduplicator) Len() uint64 {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return uint64(len(s.keys))
+}
+func (s *memoryDeduplicator) Range(f func(key string) bool) error {
+	s.m.RLock()
+	keys := make([]string, 0, len(s.keys))
+	for key := range s.keys {
+		keys = append(keys, key)
+	}
+	s.m.RUnlock()
+	for _, key := range keys {
+		if !f(key) {
+			break
+		}
+	}
+	return nil
+}
+func (s *memoryDeduplicator) Snapshot(w io.Writer) error {
+	return writeKeys(w, s)
+}
+func (s *memoryDeduplicator) Restore(r io.Reader) error {
+	keys := make(map[string]struct{})
+	err := readKeys(r, func(key string) error {
+		keys[key] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.keys = keys
+	return nil
+}
+func (s *memoryDeduplicator) Close() error {
+	return nil
+}
@@ -0,0 +1,265 @@
+package dedup
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloomFalsePositiveRate(t *testing.T) {
+	cases := []struct {
+		capacity uint64
+		fpRate   float64
+		added    int
+	}{
+		{10000, 0.01, 10000},
+		{1000, 0.01, 20000}, // 扩展多次
+		{1000, 0.001, 5000},
+	}
+	for _, c := range cases {
+		d, err := NewBloomDeduplicator(c.capacity, c.fpRate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		added := 0
+		for i := 0; i < c.added; i++ {
+			if ok, _ := d.Add(fmt.Sprintf("http://example.com/page/%d", i)); ok {
+				added++
+			}
+		}
+		for i := 0; i < c.added; i++ {
+			if ok, _ := d.Contains(fmt.Sprintf("http://example.com/page/%d", i)); !ok {
+				t.Fatalf("capacity %d: key %d is missing", c.capacity, i)
+			}
+		}
+		if d.Len() != uint64(added) {
+			t.Errorf("capacity %d: Len() = %d; want %d", c.capacity, d.Len(), added)
+		}
+		const probes = 100000
+		falsePositives := 0
+		for i := 0; i < probes; i++ {
+			if ok, _ := d.Contains(fmt.Sprintf("http://example.org/other/%d", i)); ok {
+				falsePositives++
+			}
+		}
+		if rate := float64(falsePositives) / probes; rate > c.fpRate {
+			t.Errorf("capacity %d, %d keys: false positive rate %v exceeds %v", c.capacity, c.added, rate, c.fpRate)
+		}
+	}
+}
+
+// 单个过滤器装满后的误判率应该接近它的目标, 包括只差几个字符的相似url
+// 哈希值和key都是固定的, 结果不会随机波动
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	cases := []struct {
+		capacity uint64
+		fpRate   float64
+		added    string // 加入的key的格式
+		probe    string // 探测的key的格式
+	}{
+		{10000, 0.01, "http://example.com/page/%d", "http://example.org/other/%d"},
+		{10000, 0.001, "http://example.com/page/%d", "http://example.com/page/%d/"},
+		{10000, 0.01, "%d", "x%d"},
+		{1000, 0.001, "%d", "%d-"},
+		{100000, 0.0001, "http://a.com/%d", "http://a.com/?p=%d"},
+	}
+	const probes = 200000
+	for _, c := range cases {
+		f := newBloomFilter(c.capacity, c.fpRate)
+		for i := 0; i < int(c.capacity); i++ {
+			f.add(bloomHash(fmt.Sprintf(c.added, i)))
+		}
+		falsePositives := 0
+		for i := 0; i < probes; i++ {
+			if f.contains(bloomHash(fmt.Sprintf(c.probe, i))) {
+				falsePositives++
+			}
+		}
+		// 留出统计误差
+		if rate := float64(falsePositives) / probes; rate > 1.5*c.fpRate {
+			t.Errorf("capacity %d, %q: false positive rate %v; want about %v", c.capacity, c.added, rate, c.fpRate)
+		}
+	}
+}
+
+func TestBloomInvalidArgs(t *testing.T) {
+	cases := []struct {
+		capacity uint64
+		fpRate   float64
+	}{
+		{0, 0.01},
+		{100, 0},
+		{100, 1},
+		{100, -0.5},
+	}
+	for _, c := range cases {
+		if _, err := NewBloomDeduplicator(c.capacity, c.fpRate); err == nil {
+			t.Errorf("NewBloomDeduplicator(%d, %v) should fail", c.capacity, c.fpRate)
+		}
+	}
+}
+
+func TestBloomSnapshot(t *testing.T) {
+	d, _ := NewBloomDeduplicator(100, 0.01)
+	for i := 0; i < 500; i++ {
+		d.Add(fmt.Sprint(i))
+	}
+	var buf bytes.Buffer
+	if err := d.(Snapshotter).Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := NewBloomDeduplicator(10, 0.1)
+	if err := restored.(Snapshotter).Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Len() != d.Len() {
+		t.Errorf("Len() = %d after restore; want %d", restored.Len(), d.Len())
+	}
+	for i := 0; i < 500; i++ {
+		if ok, _ := restored.Add(fmt.Sprint(i)); ok {
+			t.Fatalf("key %d was added again after restore", i)
+		}
+	}
+	// 其它哈希算法(如旧版本)的快照不能恢复
+	buf.Reset()
+	gob.NewEncoder(&buf).Encode(&bloomSnapshot{Capacity: 100, FpRate: 0.01, Filters: []bloomFilterSnapshot{{Bits: make([]uint64, 1), M: 64, K: 1}}})
+	if err := restored.(Snapshotter).Restore(&buf); err == nil {
+		t.Error("restored a snapshot without the hash name")
+	}
+	if restored.Len() != d.Len() {
+		t.Errorf("Len() = %d after a failed restore; want %d", restored.Len(), d.Len())
+	}
+}
+
+func TestDiskReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.db")
+	d, err := NewDiskDeduplicator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"http://a.com/", "http://b.com/", "http://a.com/"}
+	want := []bool{true, true, false}
+	for i, key := range keys {
+		if ok, err := d.Add(key); err != nil || ok != want[i] {
+			t.Errorf("Add(%q) = %v, %v; want %v", key, ok, err, want[i])
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = NewDiskDeduplicator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.Len() != 2 {
+		t.Errorf("Len() = %d after reopen; want 2", d.Len())
+	}
+	cases := []struct {
+		key   string
+		found bool
+	}{
+		{"http://a.com/", true},
+		{"http://b.com/", true},
+		{"http://c.com/", false},
+	}
+	for _, c := range cases {
+		if found, err := d.Contains(c.key); err != nil || found != c.found {
+			t.Errorf("Contains(%q) = %v, %v after reopen; want %v", c.key, found, err, c.found)
+		}
+	}
+	if ok, _ := d.Add("http://a.com/"); ok {
+		t.Error("a key added before reopen was added again")
+	}
+	if ok, _ := d.Add("http://c.com/"); !ok || d.Len() != 3 {
+		t.Errorf("Add of a new key after reopen = %v, Len() = %d", ok, d.Len())
+	}
+}
+
+// 检查点只记录Sync的标记, 回滚时删除标记之后添加的key
+func TestDiskSyncRollback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.db")
+	d, err := NewDiskDeduplicator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.(Snapshotter); ok {
+		t.Fatal("the disk deduplicator should not copy its keys into snapshots")
+	}
+	persistent := d.(Persistent)
+	if persistent.Path() != path {
+		t.Errorf("Path() = %s; want %s", persistent.Path(), path)
+	}
+	add := func(keys ...string) {
+		for _, key := range keys {
+			if _, err := d.Add(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	sync := func() uint64 {
+		marker, err := persistent.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return marker
+	}
+	add("a", "b")
+	first := sync()
+	add("c", "a")
+	second := sync()
+	add("d")
+	third := sync()
+	add("e")
+	// 重新打开后保留当前的代
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = NewDiskDeduplicator(path); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	persistent = d.(Persistent)
+	add("f")
+
+	cases := []struct {
+		marker uint64
+		ok     bool
+		keys   string
+	}{
+		{third + 1, false, ""},
+		{first, false, ""}, // 已经被清理
+		{third, true, "[a b c d]"},
+		{second, true, "[a b c]"},
+		{third, false, ""}, // 回滚后不能再前进
+	}
+	for _, c := range cases {
+		err := persistent.Rollback(c.marker)
+		if (err == nil) != c.ok {
+			t.Errorf("Rollback(%d) error = %v; want ok %v", c.marker, err, c.ok)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		keys := make([]string, 0)
+		d.(Iterable).Range(func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if fmt.Sprint(keys) != c.keys || d.Len() != uint64(len(keys)) {
+			t.Errorf("after Rollback(%d): keys %v, Len() %d; want %s", c.marker, keys, d.Len(), c.keys)
+		}
+	}
+	// 回滚后新添加的key属于回滚到的代
+	add("g")
+	if err := persistent.Rollback(second); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := d.Contains("g"); found {
+		t.Error("a key added after the rollback was kept")
+	}
+}
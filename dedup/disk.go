@@ -0,0 +1,203 @@
+package dedup
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	diskBucket       = []byte("urls")
+	diskMetaBucket   = []byte("meta")
+	diskGenBucket    = []byte("generations") // 每一代添加的key, 每代一个子桶
+	diskGenKey       = []byte("generation")  // 当前的代
+	diskOldestGenKey = []byte("oldest")      // 保留的最早的代, 更早的代已被清理
+)
+
+// 基于bbolt的磁盘去重器, 适合内存放不下的大量url
+// 数据本身就在磁盘上, 检查点不复制key, 只记录路径和Sync返回的标记(见Persistent)
+type diskDeduplicator struct {
+	db         *bolt.DB
+	count      uint64
+	generation uint64 // 当前的代, 只在写事务中修改
+}
+
+// 打开或创建去重数据库, 已有的数据会被保留
+func NewDiskDeduplicator(path string) (Deduplicator, error) {
+	if path == "" {
+		return nil, errors.New("The dedup database path is empty!")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Occur error when open dedup database %s :%s", path, err))
+	}
+	s := &diskDeduplicator{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(diskBucket)
+		if err != nil {
+			return err
+		}
+		s.count = uint64(b.Stats().KeyN)
+		meta, err := tx.CreateBucketIfNotExists(diskMetaBucket)
+		if err != nil {
+			return err
+		}
+		s.generation = getUint64(meta, diskGenKey)
+		_, err = tx.CreateBucketIfNotExists(diskGenBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *diskDeduplicator) Add(key string) (bool, error) {
+	var added bool
+	// Batch会合并并发的写入, 失败时可能重试, 所以每次都重新设置added
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		added = false
+		b := tx.Bucket(diskBucket)
+		if b.Get([]byte(key)) != nil {
+			return nil
+		}
+		if err := b.Put([]byte(key), []byte{}); err != nil {
+			return err
+		}
+		gen, err := tx.Bucket(diskGenBucket).CreateBucketIfNotExists(uint64Bytes(atomic.LoadUint64(&s.generation)))
+		if err != nil {
+			return err
+		}
+		if err := gen.Put([]byte(key), []byte{}); err != nil {
+			return err
+		}
+		added = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if added {
+		atomic.AddUint64(&s.count, 1)
+	}
+	return added, nil
+}
+func (s *diskDeduplicator) Contains(key string) (bool, error) {
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(diskBucket).Get([]byte(key)) != nil
+		return nil
+	})
+	return found, err
+}
+func (s *diskDeduplicator) Len() uint64 {
+	return atomic.LoadUint64(&s.count)
+}
+func (s *diskDeduplicator) Range(f func(key string) bool) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(diskBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if !f(string(k)) {
+				break
+			}
+		}
+		return nil
+	})
+}
+func (s *diskDeduplicator) Path() string {
+	return s.db.Path()
+}
+
+// 开始新的一代, 只保留上一代和新一代添加的key的记录, 所以可以回滚到上一次或这一次Sync
+func (s *diskDeduplicator) Sync() (uint64, error) {
+	var next uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		current := atomic.LoadUint64(&s.generation)
+		next = current + 1
+		gens := tx.Bucket(diskGenBucket)
+		stale := make([][]byte, 0)
+		c := gens.Cursor()
+		for name, _ := c.First(); name != nil && binary.BigEndian.Uint64(name) < current; name, _ = c.Next() {
+			stale = append(stale, append([]byte{}, name...))
+		}
+		for _, name := range stale {
+			if err := gens.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(diskMetaBucket)
+		if err := meta.Put(diskOldestGenKey, uint64Bytes(current)); err != nil {
+			return err
+		}
+		if err := meta.Put(diskGenKey, uint64Bytes(next)); err != nil {
+			return err
+		}
+		atomic.StoreUint64(&s.generation, next)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+// 删除marker这一代及之后添加的key, 回到Sync返回marker时的状态
+func (s *diskDeduplicator) Rollback(marker uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(diskMetaBucket)
+		current := atomic.LoadUint64(&s.generation)
+		if marker > current || marker < getUint64(meta, diskOldestGenKey) {
+			return errors.New(fmt.Sprintf("The dedup database %s can not roll back to %d (current:%d,oldest:%d)!",
+				s.db.Path(), marker, current, getUint64(meta, diskOldestGenKey)))
+		}
+		b := tx.Bucket(diskBucket)
+		gens := tx.Bucket(diskGenBucket)
+		stale := make([][]byte, 0)
+		var removed uint64
+		c := gens.Cursor()
+		for name, _ := c.Seek(uint64Bytes(marker)); name != nil; name, _ = c.Next() {
+			err := gens.Bucket(name).ForEach(func(key, _ []byte) error {
+				removed++
+				return b.Delete(key)
+			})
+			if err != nil {
+				return err
+			}
+			stale = append(stale, append([]byte{}, name...))
+		}
+		for _, name := range stale {
+			if err := gens.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		if err := meta.Put(diskGenKey, uint64Bytes(marker)); err != nil {
+			return err
+		}
+		atomic.StoreUint64(&s.generation, marker)
+		if removed > 0 {
+			atomic.AddUint64(&s.count, ^(removed - 1))
+		}
+		return nil
+	})
+}
+func (s *diskDeduplicator) Close() error {
+	return s.db.Close()
+}
+
+func uint64Bytes(v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	return buf
+}
+func getUint64(b *bolt.Bucket, key []byte) uint64 {
+	value := b.Get(key)
+	if len(value) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(value)
+}
@@ -0,0 +1,73 @@
+package dedup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 可以保存和恢复的去重器, 用于断点续爬
+// Restore会丢弃去重器中已有的key
+type Snapshotter interface {
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// 数据本身保存在磁盘上的去重器, 用于断点续爬时检查点只记录路径和标记, 不复制所有key
+type Persistent interface {
+	// 数据库文件的路径
+	Path() string
+	// 标记当前的状态, 返回的标记记在检查点中
+	Sync() (uint64, error)
+	// 删除标记之后添加的key, 回到Sync返回该标记时的状态; 只能回到最近两次Sync的标记
+	Rollback(marker uint64) error
+}
+
+// 最长的key, 防止读到损坏的快照时分配过多内存
+const maxKeyLen = 1 << 20
+
+// 每个key前面是它的长度(uvarint)
+func writeKeys(w io.Writer, iterable Iterable) error {
+	bw := bufio.NewWriter(w)
+	var werr error
+	buf := make([]byte, binary.MaxVarintLen64)
+	err := iterable.Range(func(key string) bool {
+		n := binary.PutUvarint(buf, uint64(len(key)))
+		if _, werr = bw.Write(buf[:n]); werr != nil {
+			return false
+		}
+		_, werr = bw.WriteString(key)
+		return werr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if werr != nil {
+		return werr
+	}
+	return bw.Flush()
+}
+func readKeys(r io.Reader, f func(key string) error) error {
+	br := bufio.NewReader(r)
+	for {
+		n, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n > maxKeyLen {
+			return errors.New(fmt.Sprintf("The dedup snapshot key length %d is invalid!", n))
+		}
+		key := make([]byte, n)
+		if _, err := io.ReadFull(br, key); err != nil {
+			return err
+		}
+		if err := f(string(key)); err != nil {
+			return err
+		}
+	}
+}
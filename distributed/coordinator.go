@@ -0,0 +1,413 @@
+package distributed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"webcrawler/dedup"
+
+	"github.com/bugfan/logrus"
+)
+
+const (
+	defaultLeaseTimeout  = 5 * time.Minute
+	defaultWorkerTimeout = 30 * time.Second
+	heartbeatsPerTimeout = 3        // 超时时间内发送心跳的次数
+	maxMessageSize       = 32 << 20 // 请求体的上限
+)
+
+// 协调者: 负责去重和保存待爬取队列, 按主机的一致性哈希把请求分配给工作进程
+// 工作进程离开(超时没有心跳)或请求超时没有完成时, 请求会被重新分配
+type Coordinator interface {
+	http.Handler
+	Status() Status
+	// 所有请求都已处理完时关闭
+	Done() <-chan struct{}
+	// 停止检查超时, 不会关闭去重器
+	Close()
+}
+
+type CoordinatorConfig struct {
+	// 请求被取出或续期后多久没有完成就重新分配, 0表示使用默认值
+	LeaseTimeout time.Duration
+	// 多久没有心跳就认为工作进程已离开, 0表示使用默认值
+	WorkerTimeout time.Duration
+	// 每个工作进程在哈希环上的虚拟节点数, 0表示使用默认值
+	Replicas int
+	// 为空时使用内存去重器
+	Deduplicator dedup.Deduplicator
+}
+
+// 已分配的请求
+type lease struct {
+	task    *Task
+	host    string
+	worker  string
+	expires time.Time
+}
+
+type myCoordinator struct {
+	leaseTimeout  time.Duration
+	workerTimeout time.Duration
+	dedup         dedup.Deduplicator
+	ring          *Ring
+	workers       map[string]time.Time // 工作进程 -> 最后一次心跳
+	workerSeq     uint64
+	pending       map[string][]*Task // 主机 -> 等待分配的请求
+	pendingLen    int
+	leases        map[uint64]*lease
+	taskSeq       uint64
+	submitted     uint64
+	completed     uint64
+	requeued      uint64
+	done          chan struct{}
+	stop          chan struct{}
+	stopOnce      sync.Once
+	mux           *http.ServeMux
+	m             sync.Mutex
+}
+
+func NewCoordinator(cfg CoordinatorConfig) Coordinator {
+	s := &myCoordinator{
+		leaseTimeout:  cfg.LeaseTimeout,
+		workerTimeout: cfg.WorkerTimeout,
+		dedup:         cfg.Deduplicator,
+		ring:          NewRing(cfg.Replicas),
+		workers:       make(map[string]time.Time),
+		pending:       make(map[string][]*Task),
+		leases:        make(map[uint64]*lease),
+		done:          make(chan struct{}),
+		stop:          make(chan struct{}),
+		mux:           http.NewServeMux(),
+	}
+	if s.leaseTimeout <= 0 {
+		s.leaseTimeout = defaultLeaseTimeout
+	}
+	if s.workerTimeout <= 0 {
+		s.workerTimeout = defaultWorkerTimeout
+	}
+	if s.dedup == nil {
+		s.dedup = dedup.NewMemoryDeduplicator()
+	}
+	s.mux.HandleFunc(PATH_REGISTER, s.handleRegister)
+	s.mux.HandleFunc(PATH_HEARTBEAT, s.handleHeartbeat)
+	s.mux.HandleFunc(PATH_POLL, s.handlePoll)
+	s.mux.HandleFunc(PATH_SUBMIT, s.handleSubmit)
+	s.mux.HandleFunc(PATH_COMPLETE, s.handleComplete)
+	s.mux.HandleFunc(PATH_LEAVE, s.handleLeave)
+	s.mux.HandleFunc(PATH_STATUS, s.handleStatus)
+	go s.expireLoop()
+	return s
+}
+
+func (s *myCoordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+func (s *myCoordinator) Done() <-chan struct{} {
+	return s.done
+}
+func (s *myCoordinator) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+func (s *myCoordinator) Status() Status {
+	s.m.Lock()
+	defer s.m.Unlock()
+	status := Status{
+		Workers:   make([]string, 0, len(s.workers)),
+		Pending:   s.pendingLen,
+		Leased:    len(s.leases),
+		Submitted: s.submitted,
+		Completed: s.completed,
+		Requeued:  s.requeued,
+		URLs:      s.dedup.Len(),
+		Finished:  s.finished(),
+	}
+	for worker := range s.workers {
+		status.Workers = append(status.Workers, worker)
+	}
+	sort.Strings(status.Workers)
+	return status
+}
+
+// 心跳同时为请求续期, 所以也要比请求超时短
+func (s *myCoordinator) heartbeatInterval() time.Duration {
+	timeout := s.workerTimeout
+	if s.leaseTimeout < timeout {
+		timeout = s.leaseTimeout
+	}
+	return timeout / heartbeatsPerTimeout
+}
+
+// 定期回收超时的请求和工作进程
+func (s *myCoordinator) expireLoop() {
+	ticker := time.NewTicker(s.heartbeatInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.m.Lock()
+			s.expire(now)
+			s.m.Unlock()
+		}
+	}
+}
+
+// 调用时必须持有锁
+func (s *myCoordinator) expire(now time.Time) {
+	for worker, lastSeen := range s.workers {
+		if now.Sub(lastSeen) > s.workerTimeout {
+			logrus.Warnf("The worker %s has no heartbeat since %s, reassign its tasks\n", worker, lastSeen.Format(time.RFC3339))
+			s.removeWorker(worker)
+		}
+	}
+	for id, l := range s.leases {
+		if now.After(l.expires) {
+			logrus.Warnf("The task %d (%s) leased by %s is expired\n", id, l.task.URL, l.worker)
+			s.requeue(id, l)
+		}
+	}
+}
+
+// 调用时必须持有锁
+func (s *myCoordinator) touchWorker(worker string) {
+	s.workers[worker] = time.Now()
+	s.ring.Add(worker)
+}
+func (s *myCoordinator) removeWorker(worker string) {
+	delete(s.workers, worker)
+	s.ring.Remove(worker)
+	for id, l := range s.leases {
+		if l.worker == worker {
+			s.requeue(id, l)
+		}
+	}
+}
+
+// 为工作进程本地持有的请求续期, 已经重新分配的不变
+func (s *myCoordinator) renew(worker string, ids []uint64) {
+	expires := time.Now().Add(s.leaseTimeout)
+	for _, id := range ids {
+		if l, ok := s.leases[id]; ok && l.worker == worker {
+			l.expires = expires
+		}
+	}
+}
+
+// 放回队首, 尽快重新分配
+func (s *myCoordinator) requeue(id uint64, l *lease) {
+	delete(s.leases, id)
+	s.pending[l.host] = append([]*Task{l.task}, s.pending[l.host]...)
+	s.pendingLen++
+	s.requeued++
+}
+
+// 去重后加入队列, 调用时必须持有锁
+func (s *myCoordinator) submit(tasks []Task) (int, error) {
+	accepted := 0
+	for i := range tasks {
+		task := tasks[i]
+		if task.Key == "" {
+			task.Key = task.URL
+		}
+		added, err := s.dedup.Add(task.Key)
+		if err != nil {
+			return accepted, err
+		}
+		if !added {
+			continue
+		}
+		s.taskSeq++
+		task.ID = s.taskSeq
+		host := task.host()
+		s.pending[host] = append(s.pending[host], &task)
+		s.pendingLen++
+		s.submitted++
+		accepted++
+	}
+	return accepted, nil
+}
+
+// 取出最多max个属于该工作进程的主机的请求, 调用时必须持有锁
+func (s *myCoordinator) poll(worker string, max int) []Task {
+	tasks := make([]Task, 0)
+	now := time.Now()
+	for host, queue := range s.pending {
+		if len(tasks) >= max {
+			break
+		}
+		if s.ring.Get(host) != worker {
+			continue
+		}
+		n := max - len(tasks)
+		if n > len(queue) {
+			n = len(queue)
+		}
+		for _, task := range queue[:n] {
+			s.leases[task.ID] = &lease{task: task, host: host, worker: worker, expires: now.Add(s.leaseTimeout)}
+			tasks = append(tasks, *task)
+		}
+		s.pendingLen -= n
+		if n == len(queue) {
+			delete(s.pending, host)
+		} else {
+			s.pending[host] = queue[n:]
+		}
+	}
+	return tasks
+}
+
+// 已经有请求且都处理完了, 调用时必须持有锁
+func (s *myCoordinator) finished() bool {
+	return s.submitted > 0 && s.pendingLen == 0 && len(s.leases) == 0
+}
+func (s *myCoordinator) checkDone() {
+	if !s.finished() {
+		return
+	}
+	select {
+	case <-s.done:
+	default:
+		logrus.Infof("All tasks are completed: submitted:%d,requeued:%d\n", s.submitted, s.requeued)
+		close(s.done)
+	}
+}
+
+func (s *myCoordinator) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req RegisterRequest
+	if !readMessage(w, r, &req) {
+		return
+	}
+	name := req.Name
+	if name == "" {
+		name = "worker"
+	}
+	s.m.Lock()
+	s.workerSeq++
+	worker := fmt.Sprintf("%s-%d", name, s.workerSeq)
+	s.touchWorker(worker)
+	s.m.Unlock()
+	logrus.Infof("The worker %s joined\n", worker)
+	writeMessage(w, RegisterResponse{WorkerID: worker, HeartbeatInterval: s.heartbeatInterval()})
+}
+
+// 被认为已离开的工作进程再次发送心跳时重新加入
+func (s *myCoordinator) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var req HeartbeatRequest
+	if !readWorkerMessage(w, r, &req, &req.WorkerID) {
+		return
+	}
+	s.m.Lock()
+	s.touchWorker(req.WorkerID)
+	s.renew(req.WorkerID, req.Tasks)
+	finished := s.finished()
+	s.m.Unlock()
+	writeMessage(w, PollResponse{Tasks: []Task{}, Finished: finished})
+}
+func (s *myCoordinator) handlePoll(w http.ResponseWriter, r *http.Request) {
+	var req PollRequest
+	if !readWorkerMessage(w, r, &req, &req.WorkerID) {
+		return
+	}
+	if req.Max <= 0 {
+		http.Error(w, fmt.Sprintf("The max %d is invalid!", req.Max), http.StatusBadRequest)
+		return
+	}
+	s.m.Lock()
+	s.touchWorker(req.WorkerID)
+	tasks := s.poll(req.WorkerID, req.Max)
+	finished := s.finished()
+	s.m.Unlock()
+	writeMessage(w, PollResponse{Tasks: tasks, Finished: finished})
+}
+func (s *myCoordinator) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	var req SubmitRequest
+	if !readWorkerMessage(w, r, &req, &req.WorkerID) {
+		return
+	}
+	s.m.Lock()
+	s.touchWorker(req.WorkerID)
+	accepted, err := s.submit(req.Tasks)
+	s.m.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeMessage(w, SubmitResponse{Accepted: accepted})
+}
+
+// 先加入新请求再确认, 请求已被重新分配给其它进程时只加入新请求
+func (s *myCoordinator) handleComplete(w http.ResponseWriter, r *http.Request) {
+	var req CompleteRequest
+	if !readWorkerMessage(w, r, &req, &req.WorkerID) {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.touchWorker(req.WorkerID)
+	accepted, err := s.submit(req.Tasks)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if l, ok := s.leases[req.TaskID]; ok && l.worker == req.WorkerID {
+		delete(s.leases, req.TaskID)
+		s.completed++
+	}
+	s.checkDone()
+	writeMessage(w, SubmitResponse{Accepted: accepted})
+}
+
+// 工作进程主动离开, 它还没有完成的请求立即重新分配
+func (s *myCoordinator) handleLeave(w http.ResponseWriter, r *http.Request) {
+	var req WorkerRequest
+	if !readWorkerMessage(w, r, &req, &req.WorkerID) {
+		return
+	}
+	s.m.Lock()
+	s.removeWorker(req.WorkerID)
+	s.m.Unlock()
+	logrus.Infof("The worker %s left\n", req.WorkerID)
+	w.WriteHeader(http.StatusNoContent)
+}
+func (s *myCoordinator) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeMessage(w, s.Status())
+}
+
+func readMessage(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(v); err != nil {
+		http.Error(w, fmt.Sprintf("The message is invalid: %s", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+func readWorkerMessage(w http.ResponseWriter, r *http.Request, v interface{}, worker *string) bool {
+	if !readMessage(w, r, v) {
+		return false
+	}
+	if *worker == "" {
+		http.Error(w, "The worker id is empty!", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+func writeMessage(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorln("Occur error when write message :", err)
+	}
+}
@@ -0,0 +1,510 @@
+package distributed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	anlz "webcrawler/analyzer"
+	"webcrawler/base"
+	ipl "webcrawler/itempipeline"
+	"webcrawler/scheduler"
+)
+
+const treeMaxLen = 5 // 每个站点有2^treeMaxLen-1个页面
+
+var linkPattern = regexp.MustCompile(`href="([^"]+)"`)
+
+// 测试站点, 一致性哈希只看主机名, 所以每个站点使用不同的主机名, 由http客户端连接到对应的端口
+type treeSites struct {
+	hosts []string
+	addrs map[string]string
+	flaky map[string]bool // 首页第一次返回503的站点
+	hits  map[string]int  // url -> 下载次数
+	m     sync.Mutex
+}
+
+// 每个路径长度小于treeMaxLen的页面链接到两个子页面
+func newTreeSites(t *testing.T, hosts ...string) *treeSites {
+	sites := &treeSites{hosts: hosts, addrs: make(map[string]string), flaky: make(map[string]bool), hits: make(map[string]int)}
+	for _, host := range hosts {
+		host := host
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/robots.txt" {
+				http.NotFound(w, r)
+				return
+			}
+			url := "http://" + host + r.URL.Path
+			sites.m.Lock()
+			sites.hits[url]++
+			unavailable := sites.flaky[host] && r.URL.Path == "/" && sites.hits[url] == 1
+			sites.m.Unlock()
+			if unavailable {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			if len(r.URL.Path) < treeMaxLen {
+				fmt.Fprintf(w, `<a href="%sx">x</a> <a href="%sy">y</a> <a href="/">home</a>`, r.URL.Path, r.URL.Path)
+			}
+		}))
+		t.Cleanup(srv.Close)
+		sites.addrs[host] = srv.Listener.Addr().String()
+	}
+	return sites
+}
+func (s *treeSites) setFlaky(host string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.flaky[host] = true
+}
+func (s *treeSites) hitCount(url string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.hits[url]
+}
+func (s *treeSites) pages() int {
+	return len(s.hosts) * (1<<treeMaxLen - 1)
+}
+func (s *treeSites) client() *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			target, ok := s.addrs[host]
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("The host %s is unknown!", host))
+			}
+			return dialer.DialContext(ctx, network, target)
+		},
+	}}
+}
+
+// 站点按一致性哈希分配给各个工作进程的结果
+func (s *treeSites) owners(workers ...string) map[string][]string {
+	ring := NewRing(0)
+	for _, worker := range workers {
+		ring.Add(worker)
+	}
+	owners := make(map[string][]string)
+	for _, host := range s.hosts {
+		owner := ring.Get(host)
+		owners[owner] = append(owners[owner], host)
+	}
+	return owners
+}
+
+// 记录每个url被哪些工作进程爬取 (并发安全)
+type crawlLog struct {
+	crawled map[string][]string
+	m       sync.Mutex
+}
+
+func newCrawlLog() *crawlLog {
+	return &crawlLog{crawled: make(map[string][]string)}
+}
+func (s *crawlLog) add(url string, worker string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.crawled[url] = append(s.crawled[url], worker)
+	count := 0
+	for _, by := range s.crawled {
+		for _, w := range by {
+			if w == worker {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// 每个页面只被爬取一次
+func (s *crawlLog) check(t *testing.T, pages int) {
+	t.Helper()
+	s.m.Lock()
+	defer s.m.Unlock()
+	if len(s.crawled) != pages {
+		t.Errorf("crawled %d pages; want %d", len(s.crawled), pages)
+	}
+	for url, by := range s.crawled {
+		if len(by) != 1 {
+			t.Errorf("%s was crawled %d times by %v", url, len(by), by)
+		}
+	}
+}
+func (s *crawlLog) workers() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	set := make(map[string]bool)
+	for _, by := range s.crawled {
+		for _, worker := range by {
+			set[worker] = true
+		}
+	}
+	workers := make([]string, 0, len(set))
+	for worker := range set {
+		workers = append(workers, worker)
+	}
+	sort.Strings(workers)
+	return workers
+}
+
+// 用工作进程启动调度器, onItem在每个条目处理后调用, 参数为该工作进程处理过的条目数
+// 返回的函数等待错误通道关闭并返回其中的错误, 测试结束时也会停止调度器并等待错误通道关闭
+func startCrawler(t *testing.T, ctx context.Context, worker Worker, sites *treeSites, log *crawlLog,
+	onItem func(count int)) (scheduler.Scheduler, func() []error) {
+	t.Helper()
+	parse := func(ctx context.Context, httpResp *http.Response, respDepth uint32) ([]base.Data, []error) {
+		body, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			return nil, []error{err}
+		}
+		dataList := []base.Data{base.Item{"url": httpResp.Request.URL.String()}}
+		for _, match := range linkPattern.FindAllStringSubmatch(string(body), -1) {
+			u, err := httpResp.Request.URL.Parse(match[1])
+			if err != nil {
+				return nil, []error{err}
+			}
+			httpReq, _ := http.NewRequest(http.MethodGet, u.String(), nil)
+			dataList = append(dataList, base.NewRequest(httpReq, respDepth))
+		}
+		return dataList, nil
+	}
+	process := func(ctx context.Context, item base.Item) (base.Item, error) {
+		count := log.add(item["url"].(string), worker.Id())
+		if onItem != nil {
+			onItem(count)
+		}
+		return item, nil
+	}
+	cfg := scheduler.CrawlConfig{
+		DownloaderPoolSize:  3,
+		AnalyzerPoolSize:    2,
+		CrawlDepth:          treeMaxLen + 1,
+		Scope:               scheduler.ScopeConfig{Mode: "host"},
+		SharedFrontier:      worker,
+		HttpClientGenerator: sites.client,
+		// 重试的间隔比测试中最短的请求超时长
+		Retry:          scheduler.RetryConfig{MaxRetries: 2, BaseDelay: scheduler.Duration(2 * time.Second), DisableJitter: true},
+		RespParsers:    []anlz.ParseResponse{parse},
+		ItemProcessors: []ipl.ProcessItem{process},
+	}
+	for _, host := range sites.hosts {
+		cfg.Seeds = append(cfg.Seeds, scheduler.Seed{URL: "http://" + host + "/"})
+	}
+	if errs := cfg.Validate(); len(errs) > 0 {
+		t.Fatalf("The crawl config is invalid: %v", errs)
+	}
+	sched := scheduler.NewScheduler()
+	if err := sched.Start(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+	errs := make([]error, 0)
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for err := range sched.ErrorChan() {
+			errs = append(errs, err)
+		}
+	}()
+	t.Cleanup(func() {
+		sched.Stop()
+		<-drained
+	})
+	return sched, func() []error {
+		<-drained
+		return errs
+	}
+}
+
+func newTestWorker(t *testing.T, addr string, name string, client *http.Client) Worker {
+	t.Helper()
+	worker, err := NewWorker(addr, name, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { worker.Close() })
+	return worker
+}
+
+func waitCoordinator(t *testing.T, ctx context.Context, coordinator Coordinator) Status {
+	t.Helper()
+	select {
+	case <-coordinator.Done():
+	case <-ctx.Done():
+		t.Fatalf("the coordinator is not done: %s", coordinator.Status())
+	}
+	status := coordinator.Status()
+	if !status.Finished || status.Leased != 0 || status.Pending != 0 || status.Completed != status.Submitted {
+		t.Errorf("coordinator status: %s", status)
+	}
+	return status
+}
+
+// 一个协调者和两个工作进程爬取多个站点, 每个页面只被爬取一次, 每个工作进程只爬取分配给它的站点
+func TestCoordinatorWithTwoWorkers(t *testing.T) {
+	sites := newTreeSites(t, "site0.test", "site1.test", "site2.test", "site3.test")
+	coordinator := NewCoordinator(CoordinatorConfig{WorkerTimeout: 2 * time.Second, LeaseTimeout: 10 * time.Second})
+	defer coordinator.Close()
+	coordinatorSrv := httptest.NewServer(coordinator)
+	defer coordinatorSrv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	// 依次注册, 工作进程的id和站点的分配是确定的
+	workers := []Worker{newTestWorker(t, coordinatorSrv.URL, "a", nil), newTestWorker(t, coordinatorSrv.URL, "b", nil)}
+	owners := sites.owners(workers[0].Id(), workers[1].Id())
+	if len(owners) != 2 {
+		t.Fatalf("the sites are not split between the workers: %v", owners)
+	}
+	log := newCrawlLog()
+	waits := make([]func() []error, 0)
+	for _, worker := range workers {
+		_, errs := startCrawler(t, ctx, worker, sites, log, nil)
+		waits = append(waits, errs)
+	}
+	for i, errs := range waits {
+		if errs := errs(); len(errs) > 0 {
+			t.Errorf("%s: crawl errors: %v", workers[i].Id(), errs)
+		}
+	}
+	status := waitCoordinator(t, ctx, coordinator)
+	log.check(t, sites.pages())
+	if status.URLs != uint64(sites.pages()) {
+		t.Errorf("coordinator saw %d urls; want %d", status.URLs, sites.pages())
+	}
+	if workers := fmt.Sprint(log.workers()); workers != "[a-1 b-2]" {
+		t.Errorf("pages were crawled by %s; want both workers", workers)
+	}
+}
+
+// 一个工作进程中途停止并离开, 另一个接手它的站点, 没有页面被重复爬取
+func TestWorkerLeavesMidCrawl(t *testing.T) {
+	sites := newTreeSites(t, "site0.test", "site1.test", "site2.test", "site3.test")
+	coordinator := NewCoordinator(CoordinatorConfig{WorkerTimeout: 2 * time.Second, LeaseTimeout: 10 * time.Second})
+	defer coordinator.Close()
+	coordinatorSrv := httptest.NewServer(coordinator)
+	defer coordinatorSrv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	a := newTestWorker(t, coordinatorSrv.URL, "a", nil)
+	b := newTestWorker(t, coordinatorSrv.URL, "b", nil)
+	if owners := sites.owners(a.Id(), b.Id()); len(owners[b.Id()]) == 0 {
+		t.Fatalf("no site is assigned to %s: %v", b.Id(), owners)
+	}
+	log := newCrawlLog()
+	_, errsA := startCrawler(t, ctx, a, sites, log, nil)
+	stopB := make(chan struct{})
+	var once sync.Once
+	schedB, errsB := startCrawler(t, ctx, b, sites, log, func(count int) {
+		if count >= 3 {
+			once.Do(func() { close(stopB) })
+		}
+	})
+	select {
+	case <-stopB:
+	case <-ctx.Done():
+		t.Fatalf("%s crawled nothing", b.Id())
+	}
+	if !schedB.Stop() {
+		t.Fatalf("%s is not running", b.Id())
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if errs := errsB(); len(errs) > 0 {
+		t.Errorf("%s: crawl errors: %v", b.Id(), errs)
+	}
+	if errs := errsA(); len(errs) > 0 {
+		t.Errorf("%s: crawl errors: %v", a.Id(), errs)
+	}
+	status := waitCoordinator(t, ctx, coordinator)
+	log.check(t, sites.pages())
+	if fmt.Sprint(status.Workers) != "[a-1]" {
+		t.Errorf("workers %v after b left; want [a-1]", status.Workers)
+	}
+	if workers := fmt.Sprint(log.workers()); workers != "[a-1 b-2]" {
+		t.Errorf("pages were crawled by %s; want both workers", workers)
+	}
+}
+
+// 可以切断的连接, 模拟崩溃的工作进程
+type cutTransport struct {
+	cut uint32
+}
+
+func (s *cutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadUint32(&s.cut) == 1 {
+		return nil, errors.New("The connection is cut!")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// 工作进程取出请求后没有心跳, 超时后它的请求重新分配给其它工作进程
+func TestWorkerTimeoutReassignsTasks(t *testing.T) {
+	sites := newTreeSites(t, "site0.test", "site1.test", "site2.test", "site3.test")
+	coordinator := NewCoordinator(CoordinatorConfig{WorkerTimeout: time.Second, LeaseTimeout: 10 * time.Second})
+	defer coordinator.Close()
+	coordinatorSrv := httptest.NewServer(coordinator)
+	defer coordinatorSrv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	a := newTestWorker(t, coordinatorSrv.URL, "a", nil)
+	transport := &cutTransport{}
+	b := newTestWorker(t, coordinatorSrv.URL, "b", &http.Client{Transport: transport})
+	owned := sites.owners(a.Id(), b.Id())[b.Id()]
+	if len(owned) == 0 {
+		t.Fatalf("no site is assigned to %s", b.Id())
+	}
+	log := newCrawlLog()
+	_, errsA := startCrawler(t, ctx, a, sites, log, nil)
+	// b取出它的站点的首页后崩溃
+	polled := make([]*base.Request, 0)
+	for len(polled) < len(owned) {
+		reqs, err := b.Poll(len(owned))
+		if err != nil {
+			t.Fatal(err)
+		}
+		polled = append(polled, reqs...)
+		select {
+		case <-ctx.Done():
+			t.Fatalf("%s polled %d tasks; want %d", b.Id(), len(polled), len(owned))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	atomic.StoreUint32(&transport.cut, 1)
+
+	if errs := errsA(); len(errs) > 0 {
+		t.Errorf("%s: crawl errors: %v", a.Id(), errs)
+	}
+	status := waitCoordinator(t, ctx, coordinator)
+	log.check(t, sites.pages())
+	if fmt.Sprint(status.Workers) != "[a-1]" {
+		t.Errorf("workers %v after b timed out; want [a-1]", status.Workers)
+	}
+	if status.Requeued < uint64(len(owned)) {
+		t.Errorf("requeued %d tasks; want at least %d", status.Requeued, len(owned))
+	}
+}
+
+// 请求超时没有完成时重新分配
+func TestLeaseExpires(t *testing.T) {
+	coordinator := NewCoordinator(CoordinatorConfig{WorkerTimeout: 2 * time.Second, LeaseTimeout: 300 * time.Millisecond})
+	defer coordinator.Close()
+	coordinatorSrv := httptest.NewServer(coordinator)
+	defer coordinatorSrv.Close()
+
+	worker := newTestWorker(t, coordinatorSrv.URL, "a", nil)
+	httpReq, _ := http.NewRequest(http.MethodGet, "http://site0.test/", nil)
+	if err := worker.Submit([]scheduler.SharedRequest{{Req: base.NewRequest(httpReq, 0), Key: "http://site0.test/"}}); err != nil {
+		t.Fatal(err)
+	}
+	poll := func() []*base.Request {
+		reqs, err := worker.Poll(16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reqs
+	}
+	first := poll()
+	if len(first) != 1 {
+		t.Fatalf("polled %d tasks; want 1", len(first))
+	}
+	if reqs := poll(); len(reqs) != 0 {
+		t.Fatalf("polled %d tasks while the first is leased", len(reqs))
+	}
+	var again []*base.Request
+	deadline := time.Now().Add(5 * time.Second)
+	for len(again) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		again = poll()
+	}
+	if len(again) != 1 || taskId(again[0]) != taskId(first[0]) {
+		t.Fatalf("polled %d tasks after the lease expired; want the task %d again", len(again), taskId(first[0]))
+	}
+	if status := coordinator.Status(); status.Requeued != 1 {
+		t.Errorf("requeued %d tasks; want 1", status.Requeued)
+	}
+	// 超时的租约已经失效, 用新的租约完成
+	if err := worker.Complete(again[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-coordinator.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the coordinator is not done: %s", coordinator.Status())
+	}
+}
+
+// 本地持有的请求在心跳时续期, 不再持有后超时重新分配
+func TestHoldRenewsLease(t *testing.T) {
+	const leaseTimeout = 300 * time.Millisecond
+	coordinator := NewCoordinator(CoordinatorConfig{WorkerTimeout: 2 * time.Second, LeaseTimeout: leaseTimeout})
+	defer coordinator.Close()
+	coordinatorSrv := httptest.NewServer(coordinator)
+	defer coordinatorSrv.Close()
+
+	worker := newTestWorker(t, coordinatorSrv.URL, "a", nil)
+	httpReq, _ := http.NewRequest(http.MethodGet, "http://site0.test/", nil)
+	if err := worker.Submit([]scheduler.SharedRequest{{Req: base.NewRequest(httpReq, 0), Key: "http://site0.test/"}}); err != nil {
+		t.Fatal(err)
+	}
+	reqs, err := worker.Poll(16)
+	if err != nil || len(reqs) != 1 {
+		t.Fatalf("Poll() = %d tasks, %v; want 1", len(reqs), err)
+	}
+	worker.Hold(reqs)
+	time.Sleep(3 * leaseTimeout)
+	if status := coordinator.Status(); status.Requeued != 0 || status.Leased != 1 {
+		t.Fatalf("the held task was not renewed: %s", status)
+	}
+	worker.Hold(nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for coordinator.Status().Requeued == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if status := coordinator.Status(); status.Requeued != 1 {
+		t.Errorf("the released task was not requeued: %s", status)
+	}
+}
+
+// 等待重试的请求留在本地时不会超时, 不会被重新分配后重复爬取
+func TestRetryKeepsLease(t *testing.T) {
+	sites := newTreeSites(t, "site0.test")
+	sites.setFlaky("site0.test")
+	coordinator := NewCoordinator(CoordinatorConfig{WorkerTimeout: 2 * time.Second, LeaseTimeout: 600 * time.Millisecond})
+	defer coordinator.Close()
+	coordinatorSrv := httptest.NewServer(coordinator)
+	defer coordinatorSrv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	worker := newTestWorker(t, coordinatorSrv.URL, "a", nil)
+	log := newCrawlLog()
+	_, errs := startCrawler(t, ctx, worker, sites, log, nil)
+	if errs := errs(); len(errs) > 0 {
+		t.Errorf("crawl errors: %v", errs)
+	}
+	status := waitCoordinator(t, ctx, coordinator)
+	log.check(t, sites.pages())
+	if hits := sites.hitCount("http://site0.test/"); hits != 2 {
+		t.Errorf("the home page was downloaded %d times; want 2", hits)
+	}
+	if status.Requeued != 0 {
+		t.Errorf("requeued %d tasks; want 0", status.Requeued)
+	}
+}
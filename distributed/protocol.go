@@ -0,0 +1,155 @@
+package distributed
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"webcrawler/base"
+	"webcrawler/scheduler"
+)
+
+// 协调者的http接口, 请求和响应都是json, 除status外都使用POST
+const (
+	PATH_REGISTER  = "/register"  // RegisterRequest -> RegisterResponse
+	PATH_HEARTBEAT = "/heartbeat" // HeartbeatRequest -> PollResponse(没有Tasks)
+	PATH_POLL      = "/poll"      // PollRequest -> PollResponse
+	PATH_SUBMIT    = "/submit"    // SubmitRequest -> SubmitResponse
+	PATH_COMPLETE  = "/complete"  // CompleteRequest -> SubmitResponse
+	PATH_LEAVE     = "/leave"     // WorkerRequest -> 空
+	PATH_STATUS    = "/status"    // GET -> Status
+)
+
+// 写进base.Request的附加信息: 请求在协调者中的id, uint64
+const META_TASK_ID = "distributed.task_id"
+
+// 在协调者和工作进程间传递的请求
+// 附加信息按json编码, 如time.Time会变成字符串
+type Task struct {
+	ID       uint64                 `json:"id"`
+	Method   string                 `json:"method"`
+	URL      string                 `json:"url"`
+	Header   http.Header            `json:"header,omitempty"`
+	Body     []byte                 `json:"body,omitempty"`
+	Key      string                 `json:"key"` // 规范化后的url, 用于去重
+	Depth    uint32                 `json:"depth"`
+	Seed     string                 `json:"seed"`
+	Priority int                    `json:"priority"`
+	Meta     map[string]interface{} `json:"meta,omitempty"`
+}
+
+func newTask(req scheduler.SharedRequest) (Task, error) {
+	httpReq := req.Req.HttpReq()
+	if httpReq == nil || httpReq.URL == nil {
+		return Task{}, errors.New("The http request is invalid!")
+	}
+	task := Task{
+		Method:   httpReq.Method,
+		URL:      httpReq.URL.String(),
+		Header:   httpReq.Header,
+		Key:      req.Key,
+		Depth:    req.Req.Depth(),
+		Seed:     req.Req.Seed(),
+		Priority: req.Req.Priority(),
+		Meta:     req.Req.Metadata(),
+	}
+	// 从父请求复制过来的id不属于新请求
+	delete(task.Meta, META_TASK_ID)
+	if httpReq.GetBody != nil {
+		body, err := httpReq.GetBody()
+		if err != nil {
+			return task, err
+		}
+		defer body.Close()
+		if task.Body, err = io.ReadAll(body); err != nil {
+			return task, err
+		}
+	}
+	return task, nil
+}
+func (s Task) request() (*base.Request, error) {
+	var body io.Reader
+	if s.Body != nil {
+		body = bytes.NewReader(s.Body)
+	}
+	httpReq, err := http.NewRequest(s.Method, s.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	if s.Header != nil {
+		httpReq.Header = s.Header
+	}
+	req := base.NewRequest(httpReq, s.Depth)
+	req.SetSeed(s.Seed)
+	req.SetPriority(s.Priority)
+	for key, value := range s.Meta {
+		req.SetMeta(key, value)
+	}
+	req.SetMeta(META_TASK_ID, s.ID)
+	return req, nil
+}
+
+// 一致性哈希使用的主机名, 不含端口
+func (s Task) host() string {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+type RegisterRequest struct {
+	Name string `json:"name"` // 工作进程id的前缀, 可以为空
+}
+type RegisterResponse struct {
+	WorkerID          string        `json:"worker_id"`
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+}
+type WorkerRequest struct {
+	WorkerID string `json:"worker_id"`
+}
+type HeartbeatRequest struct {
+	WorkerID string   `json:"worker_id"`
+	Tasks    []uint64 `json:"tasks,omitempty"` // 本地还没有完成的请求, 续期
+}
+type PollRequest struct {
+	WorkerID string `json:"worker_id"`
+	Max      int    `json:"max"`
+}
+type PollResponse struct {
+	Tasks    []Task `json:"tasks"`
+	Finished bool   `json:"finished"` // 所有请求都已处理完
+}
+type SubmitRequest struct {
+	WorkerID string `json:"worker_id"`
+	Tasks    []Task `json:"tasks"`
+}
+type CompleteRequest struct {
+	WorkerID string `json:"worker_id"`
+	TaskID   uint64 `json:"task_id"`
+	Tasks    []Task `json:"tasks"`
+}
+type SubmitResponse struct {
+	Accepted int `json:"accepted"` // 去重后加入队列的数量
+}
+
+// 协调者的状态
+type Status struct {
+	Workers   []string `json:"workers"`
+	Pending   int      `json:"pending"`   // 等待分配的请求
+	Leased    int      `json:"leased"`    // 已分配还没有完成的请求
+	Submitted uint64   `json:"submitted"` // 去重后加入队列的请求
+	Completed uint64   `json:"completed"`
+	Requeued  uint64   `json:"requeued"` // 超时或工作进程离开后重新分配的请求
+	URLs      uint64   `json:"urls"`     // 去重器中的url数
+	Finished  bool     `json:"finished"`
+}
+
+func (s Status) String() string {
+	return fmt.Sprintf("workers:%d,pending:%d,leased:%d,submitted:%d,completed:%d,requeued:%d,urls:%d,finished:%v",
+		len(s.Workers), s.Pending, s.Leased, s.Submitted, s.Completed, s.Requeued, s.URLs, s.Finished)
+}
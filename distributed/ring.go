@@ -0,0 +1,92 @@
+package distributed
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// 每个节点默认的虚拟节点数
+const DefaultReplicas = 64
+
+// 一致性哈希环, 节点增减时只有少部分key会换节点 (非并发安全)
+type Ring struct {
+	replicas int
+	hashes   []uint32          // 有序的虚拟节点哈希
+	owners   map[uint32]string // 虚拟节点哈希 -> 节点
+	nodes    map[string]bool
+}
+
+func NewRing(replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	return &Ring{
+		replicas: replicas,
+		hashes:   make([]uint32, 0),
+		owners:   make(map[uint32]string),
+		nodes:    make(map[string]bool),
+	}
+}
+
+// 同ketama使用md5, 只差最后一个字符的主机名(如127.0.0.1和127.0.0.2)也能分散开
+func hashKey(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(sum[:4])
+}
+
+func (s *Ring) Add(node string) {
+	if s.nodes[node] {
+		return
+	}
+	s.nodes[node] = true
+	for i := 0; i < s.replicas; i++ {
+		hash := hashKey(node + "#" + strconv.Itoa(i))
+		// 哈希冲突时保留先加入的节点
+		if _, ok := s.owners[hash]; ok {
+			continue
+		}
+		s.owners[hash] = node
+		s.hashes = append(s.hashes, hash)
+	}
+	sort.Slice(s.hashes, func(i, j int) bool {
+		return s.hashes[i] < s.hashes[j]
+	})
+}
+func (s *Ring) Remove(node string) {
+	if !s.nodes[node] {
+		return
+	}
+	delete(s.nodes, node)
+	hashes := s.hashes[:0]
+	for _, hash := range s.hashes {
+		if s.owners[hash] == node {
+			delete(s.owners, hash)
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	s.hashes = hashes
+}
+
+// key所属的节点, 环为空时返回""
+func (s *Ring) Get(key string) string {
+	if len(s.hashes) == 0 {
+		return ""
+	}
+	hash := hashKey(key)
+	i := sort.Search(len(s.hashes), func(i int) bool {
+		return s.hashes[i] >= hash
+	})
+	if i == len(s.hashes) {
+		i = 0
+	}
+	return s.owners[s.hashes[i]]
+}
+func (s *Ring) Contains(node string) bool {
+	return s.nodes[node]
+}
+func (s *Ring) Len() int {
+	return len(s.nodes)
+}
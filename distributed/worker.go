@@ -0,0 +1,209 @@
+package distributed
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"webcrawler/base"
+	"webcrawler/scheduler"
+
+	"github.com/bugfan/logrus"
+)
+
+const defaultWorkerClientTimeout = 30 * time.Second
+
+// 工作进程: 作为scheduler.CrawlConfig.SharedFrontier使用, 通过http和协调者通信
+// 调度器停止后应调用Close, 让还没有完成的请求立即重新分配
+type Worker interface {
+	scheduler.SharedFrontier
+	Id() string
+	Close() error
+}
+
+type myWorker struct {
+	addr     string
+	client   *http.Client
+	id       string
+	finished uint32   // 协调者报告的所有请求都已处理完
+	held     []uint64 // 本地还没有完成的请求, 心跳时续期
+	heldM    sync.Mutex
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	once     sync.Once
+}
+
+// addr为协调者的地址, 如 http://127.0.0.1:8080; client为空时使用默认的
+func NewWorker(addr string, name string, client *http.Client) (Worker, error) {
+	if client == nil {
+		client = &http.Client{Timeout: defaultWorkerClientTimeout}
+	}
+	s := &myWorker{
+		addr:   strings.TrimRight(addr, "/"),
+		client: client,
+		stop:   make(chan struct{}),
+	}
+	var resp RegisterResponse
+	if err := s.call(PATH_REGISTER, RegisterRequest{Name: name}, &resp); err != nil {
+		return nil, err
+	}
+	s.id = resp.WorkerID
+	interval := resp.HeartbeatInterval
+	if interval <= 0 {
+		interval = defaultWorkerTimeout / heartbeatsPerTimeout
+	}
+	s.wg.Add(1)
+	go s.heartbeat(interval)
+	return s, nil
+}
+
+func (s *myWorker) Id() string {
+	return s.id
+}
+func (s *myWorker) heartbeat(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			var resp PollResponse
+			if err := s.call(PATH_HEARTBEAT, HeartbeatRequest{WorkerID: s.id, Tasks: s.heldTasks()}, &resp); err != nil {
+				logrus.Errorln("Occur error when send heartbeat :", err)
+				continue
+			}
+			s.setFinished(resp.Finished)
+		}
+	}
+}
+func (s *myWorker) setFinished(finished bool) {
+	if finished {
+		atomic.StoreUint32(&s.finished, 1)
+	} else {
+		atomic.StoreUint32(&s.finished, 0)
+	}
+}
+
+func (s *myWorker) Submit(reqs []scheduler.SharedRequest) error {
+	tasks, err := newTasks(reqs)
+	if err != nil {
+		return err
+	}
+	var resp SubmitResponse
+	return s.call(PATH_SUBMIT, SubmitRequest{WorkerID: s.id, Tasks: tasks}, &resp)
+}
+func (s *myWorker) Poll(max int) ([]*base.Request, error) {
+	var resp PollResponse
+	if err := s.call(PATH_POLL, PollRequest{WorkerID: s.id, Max: max}, &resp); err != nil {
+		return nil, err
+	}
+	s.setFinished(resp.Finished)
+	reqs := make([]*base.Request, 0, len(resp.Tasks))
+	for _, task := range resp.Tasks {
+		req, err := task.request()
+		if err != nil {
+			// 无法还原的请求不会完成, 超时后由协调者重新分配
+			logrus.Errorf("The task %d (%s) is invalid :%s\n", task.ID, task.URL, err)
+			continue
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+func (s *myWorker) Complete(req *base.Request, reqs []scheduler.SharedRequest) error {
+	tasks, err := newTasks(reqs)
+	if err != nil {
+		return err
+	}
+	// 不是从协调者取出的请求只提交新请求
+	id := taskId(req)
+	if id == 0 {
+		if len(tasks) == 0 {
+			return nil
+		}
+		return s.call(PATH_SUBMIT, SubmitRequest{WorkerID: s.id, Tasks: tasks}, &SubmitResponse{})
+	}
+	return s.call(PATH_COMPLETE, CompleteRequest{WorkerID: s.id, TaskID: id, Tasks: tasks}, &SubmitResponse{})
+}
+func (s *myWorker) Finished() bool {
+	return atomic.LoadUint32(&s.finished) == 1
+}
+func (s *myWorker) Hold(reqs []*base.Request) {
+	ids := make([]uint64, 0, len(reqs))
+	for _, req := range reqs {
+		if id := taskId(req); id != 0 {
+			ids = append(ids, id)
+		}
+	}
+	s.heldM.Lock()
+	defer s.heldM.Unlock()
+	s.held = ids
+}
+func (s *myWorker) heldTasks() []uint64 {
+	s.heldM.Lock()
+	defer s.heldM.Unlock()
+	return s.held
+}
+
+// 停止心跳并离开, 可以重复调用
+func (s *myWorker) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.stop)
+		s.wg.Wait()
+		err = s.call(PATH_LEAVE, WorkerRequest{WorkerID: s.id}, nil)
+	})
+	return err
+}
+
+// 请求在协调者中的id, 不是从协调者取出的请求返回0
+func taskId(req *base.Request) uint64 {
+	value, ok := req.Meta(META_TASK_ID)
+	if !ok {
+		return 0
+	}
+	id, _ := value.(uint64)
+	return id
+}
+
+func newTasks(reqs []scheduler.SharedRequest) ([]Task, error) {
+	tasks := make([]Task, 0, len(reqs))
+	for _, req := range reqs {
+		task, err := newTask(req)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// 发送json请求, resp为空时忽略响应体
+func (s *myWorker) call(path string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpResp, err := s.client.Post(s.addr+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Occur error when call coordinator %s :%s", path, err))
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode < 200 || httpResp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return errors.New(fmt.Sprintf("The coordinator %s returned %s: %s", path, httpResp.Status, strings.TrimSpace(string(msg))))
+	}
+	if resp == nil {
+		io.Copy(io.Discard, httpResp.Body)
+		return nil
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
@@ -1,6 +1,7 @@
 package downloader
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -18,32 +19,100 @@ func genDownloaderId() uint32 {
 // downloader
 type PageDownloader interface {
 	Id() uint32
-	Download(req *base.Request) (*base.Response, error)
+	// ctx结束时会中断正在进行的http请求
+	// 每次下载都会增加req的下载次数, 需要重试时返回*RetryError
+	// 不满足响应限制的响应体为空, 并带有跳过的原因; ctx来自WithoutLimits时不检查限制
+	Download(ctx context.Context, req *base.Request) (*base.Response, error)
 }
 type myPageDownloader struct {
-	id         uint32
-	httpClient http.Client
+	id          uint32
+	httpClient  http.Client
+	retry       *RetryPolicy
+	limits      *ResponseLimits
+	middlewares []DownloaderMiddleware
 }
 
 func (s *myPageDownloader) Id() uint32 {
-	return 0
+	return s.id
 }
 
-func (s *myPageDownloader) Download(req *base.Request) (*base.Response, error) {
-	res, err := s.httpClient.Do(req.HttpReq())
+func (s *myPageDownloader) Download(ctx context.Context, req *base.Request) (*base.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	req.SetAttempts(req.Attempts() + 1)
+	limits := s.responseLimits(ctx)
+	resp, n, err := s.processRequest(ctx, req)
+	if resp == nil && err == nil {
+		resp, err = s.fetch(ctx, req)
+	} else if resp != nil {
+		// 中间件直接返回的响应(如缓存命中)和下载的一样要满足响应限制
+		resp = limits.limit(resp)
+	}
 	if err != nil {
+		if errors.Is(err, ErrDropRequest) {
+			return nil, err
+		}
+		if resp, n, err = s.processError(ctx, req, n, err); err != nil {
+			return nil, err
+		}
+		resp = limits.limit(resp)
+	}
+	limited := resp
+	if resp, err = s.processResponse(ctx, req, n, resp); err != nil {
 		return nil, err
 	}
-	return base.NewResponse(res, req.Depth()), nil
+	// 被中间件替换的响应(如验证后的缓存)也要检查
+	if resp != limited {
+		resp = limits.limit(resp)
+	}
+	if !resp.Valid() {
+		return nil, errors.New("The downloader middleware returned an invalid response!")
+	}
+	// 中间件构造的响应可以不设置Request, 解析函数需要用它解析相对链接
+	if httpResp := resp.HttpResp(); httpResp.Request == nil {
+		httpResp.Request = req.HttpReq()
+	}
+	resp.SetSeed(req.Seed())
+	resp.SetRequest(req)
+	return resp, nil
 }
-func NewPageDownloader(client *http.Client) PageDownloader {
+
+// 发送http请求, 需要重试时返回*RetryError
+func (s *myPageDownloader) fetch(ctx context.Context, req *base.Request) (*base.Response, error) {
+	res, err := s.httpClient.Do(req.HttpReq().WithContext(ctx))
+	if err != nil && ctx.Err() != nil {
+		return nil, err
+	}
+	if retryErr := s.retry.check(req.Attempts(), res, err); retryErr != nil {
+		return nil, retryErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.responseLimits(ctx).apply(res, req.Depth()), nil
+}
+
+// ctx来自WithoutLimits时返回nil
+func (s *myPageDownloader) responseLimits(ctx context.Context) *ResponseLimits {
+	if limitsDisabled(ctx) {
+		return nil
+	}
+	return s.limits
+}
+
+// retry为空时不重试, limits为空时不限制响应, 中间件见DownloaderMiddleware
+func NewPageDownloader(client *http.Client, retry *RetryPolicy, limits *ResponseLimits, middlewares ...DownloaderMiddleware) PageDownloader {
 	id := genDownloaderId()
 	if client == nil {
 		client = &http.Client{}
 	}
 	return &myPageDownloader{
-		id:         id,
-		httpClient: *client,
+		id:          id,
+		httpClient:  *client,
+		retry:       retry,
+		limits:      limits,
+		middlewares: middlewares,
 	}
 }
 
@@ -0,0 +1,144 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"webcrawler/base"
+)
+
+// 响应体超过限制并且不截断时, 读取响应体返回的错误, 可以用errors.Is判断
+var ErrBodyTooLarge = errors.New("The response body is too large!")
+
+// 响应的限制, 在读取响应体之前根据响应头检查
+// 不满足的响应会关闭响应体, 换成空的响应体并带上跳过的原因, 见base.Response.SkipReason
+type ResponseLimits struct {
+	// 响应体的最大字节数, 0表示不限制
+	MaxBodyBytes int64
+	// 超过MaxBodyBytes时截断响应体, 否则Content-Length超过时跳过响应,
+	// 长度未知的响应体读取超过时返回ErrBodyTooLarge
+	TruncateBody bool
+	// 允许的MIME类型, 如text/html text/*, 为空时允许所有类型
+	AllowedTypes []string
+	// 禁止的MIME类型, 优先于AllowedTypes
+	DeniedTypes []string
+}
+
+// 检查MIME类型的格式, 只支持type/subtype和type/*
+func CheckMimePattern(pattern string) error {
+	parts := strings.Split(pattern, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[0] == "*" || parts[1] == "" {
+		return errors.New(fmt.Sprintf("The mime type %q is invalid!", pattern))
+	}
+	return nil
+}
+
+func matchMime(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == mediaType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回跳过响应的原因, 不需要跳过时为空
+// 没有Content-Type的响应不按类型过滤
+func (s *ResponseLimits) skipReason(resp *http.Response) string {
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			mediaType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+		}
+		if matchMime(s.DeniedTypes, mediaType) {
+			return fmt.Sprintf("content type %s is denied", mediaType)
+		}
+		if len(s.AllowedTypes) > 0 && !matchMime(s.AllowedTypes, mediaType) {
+			return fmt.Sprintf("content type %s is not allowed", mediaType)
+		}
+	}
+	if s.MaxBodyBytes > 0 && !s.TruncateBody && resp.ContentLength > s.MaxBodyBytes {
+		return fmt.Sprintf("content length %d exceeds %d bytes", resp.ContentLength, s.MaxBodyBytes)
+	}
+	return ""
+}
+
+type noLimitsKey struct{}
+
+// 用返回的ctx下载时不检查响应限制, 用于robots.txt和sitemap这类不交给解析函数的请求
+func WithoutLimits(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noLimitsKey{}, true)
+}
+
+func limitsDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(noLimitsKey{}).(bool)
+	return disabled
+}
+
+// 按限制处理响应, limits为空时不做处理
+func (s *ResponseLimits) apply(resp *http.Response, depth uint32) *base.Response {
+	return s.limit(base.NewResponse(resp, depth))
+}
+
+// 按限制处理已经构造好的响应, 如中间件返回的缓存; limits为空或响应已被跳过时不做处理
+func (s *ResponseLimits) limit(resp *base.Response) *base.Response {
+	if s == nil || resp == nil || resp.Skipped() {
+		return resp
+	}
+	httpResp := resp.HttpResp()
+	if reason := s.skipReason(httpResp); reason != "" {
+		httpResp.Body.Close()
+		httpResp.Body = http.NoBody
+		httpResp.ContentLength = 0
+		resp.SetSkipReason(reason)
+		return resp
+	}
+	if s.MaxBodyBytes > 0 {
+		httpResp.Body = &limitedBody{body: httpResp.Body, remaining: s.MaxBodyBytes, truncate: s.TruncateBody, resp: resp}
+	}
+	return resp
+}
+
+// 限制读取字节数的响应体, 多读一个字节来判断是否超过
+// 截断时设置resp的Truncated, 缓存等中间件据此判断响应体是否完整
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	truncate  bool
+	end       error // 读到上限后的结果, 只判断一次
+	resp      *base.Response
+}
+
+func (s *limitedBody) Read(p []byte) (int, error) {
+	if s.remaining <= 0 {
+		if s.end == nil {
+			s.end = io.EOF
+			var one [1]byte
+			if n, _ := io.ReadFull(s.body, one[:]); n > 0 {
+				if s.truncate {
+					s.resp.SetTruncated(true)
+				} else {
+					s.end = ErrBodyTooLarge
+				}
+			}
+		}
+		return 0, s.end
+	}
+	if int64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.body.Read(p)
+	s.remaining -= int64(n)
+	return n, err
+}
+func (s *limitedBody) Close() error {
+	return s.body.Close()
+}
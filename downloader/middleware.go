@@ -0,0 +1,105 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"webcrawler/base"
+)
+
+// 中间件丢弃请求时返回的错误, 可以用errors.Is判断
+var ErrDropRequest = errors.New("The request is dropped by downloader middleware!")
+
+// 下载器中间件, 按配置的顺序包在http请求外面:
+// ProcessRequest按顺序调用, ProcessResponse和ProcessError按相反的顺序调用,
+// 并且只调用ProcessRequest已经被调用过的中间件
+type DownloaderMiddleware interface {
+	// 可以修改请求; 返回非空的响应(Body不能为空, 可以是http.NoBody)时不再发送请求, 也不再调用后面的中间件;
+	// 响应的Request为空时由下载器设为req.HttpReq();
+	// 返回ErrDropRequest时丢弃请求, 返回其它错误时进入ProcessError
+	ProcessRequest(ctx context.Context, req *base.Request) (*base.Response, error)
+	// 可以修改或替换响应, 替换时由中间件负责关闭原来的响应体; 返回ErrDropRequest时丢弃请求
+	ProcessResponse(ctx context.Context, req *base.Request, resp *base.Response) (*base.Response, error)
+	// 下载失败(包括需要重试的RetryError)时调用, 返回非空的响应表示已恢复, 继续调用ProcessResponse;
+	// 否则返回的错误(可以是原来的)交给前面的中间件
+	ProcessError(ctx context.Context, req *base.Request, err error) (*base.Response, error)
+}
+
+// 用函数实现的中间件, 为空的函数不做任何处理
+type MiddlewareFuncs struct {
+	Request  func(ctx context.Context, req *base.Request) (*base.Response, error)
+	Response func(ctx context.Context, req *base.Request, resp *base.Response) (*base.Response, error)
+	Error    func(ctx context.Context, req *base.Request, err error) (*base.Response, error)
+}
+
+func (s MiddlewareFuncs) ProcessRequest(ctx context.Context, req *base.Request) (*base.Response, error) {
+	if s.Request == nil {
+		return nil, nil
+	}
+	return s.Request(ctx, req)
+}
+func (s MiddlewareFuncs) ProcessResponse(ctx context.Context, req *base.Request, resp *base.Response) (*base.Response, error) {
+	if s.Response == nil {
+		return resp, nil
+	}
+	return s.Response(ctx, req, resp)
+}
+func (s MiddlewareFuncs) ProcessError(ctx context.Context, req *base.Request, err error) (*base.Response, error) {
+	if s.Error == nil {
+		return nil, err
+	}
+	return s.Error(ctx, req, err)
+}
+
+// 依次调用ProcessRequest, 返回调用过的中间件数量
+func (s *myPageDownloader) processRequest(ctx context.Context, req *base.Request) (*base.Response, int, error) {
+	for i, mw := range s.middlewares {
+		resp, err := mw.ProcessRequest(ctx, req)
+		if err != nil {
+			return nil, i + 1, err
+		}
+		if resp != nil {
+			return resp, i + 1, nil
+		}
+	}
+	return nil, len(s.middlewares), nil
+}
+
+// 从第n个中间件开始反向调用ProcessError, 恢复后从该中间件开始调用ProcessResponse
+func (s *myPageDownloader) processError(ctx context.Context, req *base.Request, n int, err error) (*base.Response, int, error) {
+	for i := n - 1; i >= 0; i-- {
+		resp, mwErr := s.middlewares[i].ProcessError(ctx, req, err)
+		if errors.Is(mwErr, ErrDropRequest) {
+			return nil, 0, mwErr
+		}
+		if resp != nil {
+			return resp, i + 1, nil
+		}
+		if mwErr != nil {
+			err = mwErr
+		}
+	}
+	return nil, 0, err
+}
+
+// 从第n个中间件开始反向调用ProcessResponse, 出错时关闭响应体
+func (s *myPageDownloader) processResponse(ctx context.Context, req *base.Request, n int, resp *base.Response) (*base.Response, error) {
+	for i := n - 1; i >= 0; i-- {
+		processed, err := s.middlewares[i].ProcessResponse(ctx, req, resp)
+		if err != nil || processed == nil {
+			closeResponse(resp)
+			if err == nil {
+				err = ErrDropRequest
+			}
+			return nil, err
+		}
+		resp = processed
+	}
+	return resp, nil
+}
+
+func closeResponse(resp *base.Response) {
+	if resp == nil || resp.HttpResp() == nil || resp.HttpResp().Body == nil {
+		return
+	}
+	resp.HttpResp().Body.Close()
+}
@@ -0,0 +1,176 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultRetryBaseDelay = time.Second
+	DefaultRetryMaxDelay  = time.Minute
+	maxDrainBytes         = 64 * 1024 // 重试前最多读取的响应体, 读完才能复用连接
+)
+
+// 默认重试的状态码
+var DefaultRetryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// 重试策略: 网络错误 超时和指定的状态码会重试, 间隔按指数增长
+// 下载器不会等待, 而是返回RetryError, 由调用者在间隔后重新下载
+type RetryPolicy struct {
+	// 最多重试的次数, 0表示不重试
+	MaxRetries uint32
+	// 第一次重试的间隔, 之后每次翻倍, 0表示使用默认值
+	BaseDelay time.Duration
+	// 间隔的上限, 也是Retry-After的上限, 0表示使用默认值
+	MaxDelay time.Duration
+	// 为空时使用DefaultRetryStatusCodes
+	StatusCodes []int
+	// 不在间隔上加随机抖动
+	DisableJitter bool
+}
+
+// 需要重试的下载结果
+type RetryError struct {
+	Err        error          // 网络错误, 状态码需要重试时为空
+	Response   *http.Response // 需要重试的响应, 响应体已关闭; 网络错误时为空
+	Attempts   uint32         // 已经下载过的次数
+	Delay      time.Duration  // 建议的重试间隔
+	StatusCode int
+}
+
+func (s *RetryError) Error() string {
+	if s.Err != nil {
+		return fmt.Sprintf("retry after %s (attempt %d): %s", s.Delay, s.Attempts, s.Err)
+	}
+	return fmt.Sprintf("retry after %s (attempt %d): status %d", s.Delay, s.Attempts, s.StatusCode)
+}
+func (s *RetryError) Unwrap() error {
+	return s.Err
+}
+
+func (s *RetryPolicy) baseDelay() time.Duration {
+	if s.BaseDelay <= 0 {
+		return DefaultRetryBaseDelay
+	}
+	return s.BaseDelay
+}
+func (s *RetryPolicy) maxDelay() time.Duration {
+	if s.MaxDelay <= 0 {
+		return DefaultRetryMaxDelay
+	}
+	return s.MaxDelay
+}
+
+// 状态码是否需要重试
+func (s *RetryPolicy) RetryStatus(code int) bool {
+	codes := s.StatusCodes
+	if len(codes) == 0 {
+		codes = DefaultRetryStatusCodes
+	}
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// 网络错误和超时需要重试, 如协议不支持这样的错误重试也不会成功
+// http.Client返回的*url.Error本身实现了net.Error, 所以判断它包装的错误
+func RetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// 第attempts次下载失败后的间隔: 优先使用Retry-After, 否则为BaseDelay*2^(attempts-1)
+// 加上抖动后在[delay/2, delay]之间
+func (s *RetryPolicy) Backoff(attempts uint32, resp *http.Response, now time.Time) time.Duration {
+	max := s.maxDelay()
+	if resp != nil {
+		if delay, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), now); ok {
+			if delay > max {
+				delay = max
+			}
+			return delay
+		}
+	}
+	delay := s.baseDelay()
+	for i := uint32(1); i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if !s.DisableJitter && delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	return delay
+}
+
+// 根据下载结果判断是否需要重试, 需要时关闭响应体并返回RetryError
+func (s *RetryPolicy) check(attempts uint32, resp *http.Response, err error) *RetryError {
+	if s == nil || attempts > s.MaxRetries {
+		return nil
+	}
+	now := time.Now()
+	if err != nil {
+		if !RetryableError(err) {
+			return nil
+		}
+		return &RetryError{Err: err, Attempts: attempts, Delay: s.Backoff(attempts, nil, now)}
+	}
+	if !s.RetryStatus(resp.StatusCode) {
+		return nil
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainBytes))
+	resp.Body.Close()
+	return &RetryError{Response: resp, Attempts: attempts, StatusCode: resp.StatusCode, Delay: s.Backoff(attempts, resp, now)}
+}
+
+// Retry-After可以是秒数或http时间
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
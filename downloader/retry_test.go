@@ -0,0 +1,157 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type temporaryError struct {
+	temporary bool
+}
+
+func (s temporaryError) Error() string {
+	return fmt.Sprintf("temporary: %v", s.temporary)
+}
+func (s temporaryError) Temporary() bool {
+	return s.temporary
+}
+
+func TestRetryableError(t *testing.T) {
+	urlErr := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://example.com/", Err: err}
+	}
+	cases := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"nil", nil, false},
+		{"eof", io.EOF, true},
+		{"unexpected eof", urlErr(io.ErrUnexpectedEOF), true},
+		{"wrapped eof", fmt.Errorf("read body: %w", io.EOF), true},
+		{"connection refused", urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), true},
+		{"dns", urlErr(&net.DNSError{Err: "no such host", Name: "example.invalid"}), true},
+		{"timeout", urlErr(context.DeadlineExceeded), true},
+		{"temporary", urlErr(temporaryError{true}), true},
+		{"not temporary", urlErr(temporaryError{false}), false},
+		{"canceled", urlErr(context.Canceled), false},
+		{"unsupported scheme", urlErr(errors.New(`unsupported protocol scheme "ftp"`)), false},
+		{"plain", errors.New("parse error"), false},
+		{"too large", ErrBodyTooLarge, false},
+	}
+	for _, c := range cases {
+		if retryable := RetryableError(c.err); retryable != c.retryable {
+			t.Errorf("%s: RetryableError(%v) = %v; want %v", c.name, c.err, retryable, c.retryable)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{"1.5", 0, false},
+		{"soon", 0, false},
+		{"Wed, 01 May 2024 12:00:30 GMT", 30 * time.Second, true},
+		{"Wednesday, 01-May-24 12:01:00 GMT", time.Minute, true},
+		{"Wed May  1 12:00:10 2024", 10 * time.Second, true},
+		{"Wed, 01 May 2024 11:59:00 GMT", 0, true}, // 已经过去的时间
+	}
+	for _, c := range cases {
+		delay, ok := ParseRetryAfter(c.value, now)
+		if delay != c.delay || ok != c.ok {
+			t.Errorf("ParseRetryAfter(%q) = %v, %v; want %v, %v", c.value, delay, ok, c.delay, c.ok)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	policy := &RetryPolicy{MaxRetries: 10, BaseDelay: time.Second, MaxDelay: 10 * time.Second, DisableJitter: true}
+	retryAfter := func(value string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": []string{value}}}
+	}
+	cases := []struct {
+		attempts uint32
+		resp     *http.Response
+		delay    time.Duration
+	}{
+		{1, nil, time.Second},
+		{2, nil, 2 * time.Second},
+		{4, nil, 8 * time.Second},
+		{5, nil, 10 * time.Second},
+		{30, nil, 10 * time.Second},
+		{1, retryAfter("3"), 3 * time.Second},
+		{1, retryAfter("3600"), 10 * time.Second},
+		{3, retryAfter("invalid"), 4 * time.Second},
+	}
+	for _, c := range cases {
+		if delay := policy.Backoff(c.attempts, c.resp, now); delay != c.delay {
+			t.Errorf("Backoff(%d) = %v; want %v", c.attempts, delay, c.delay)
+		}
+	}
+	jittered := &RetryPolicy{BaseDelay: time.Second}
+	for i := 0; i < 100; i++ {
+		if delay := jittered.Backoff(2, nil, now); delay < time.Second || delay > 2*time.Second {
+			t.Fatalf("Backoff with jitter = %v; want it in [1s, 2s]", delay)
+		}
+	}
+}
+
+func TestRetryCheck(t *testing.T) {
+	response := func(code int) *http.Response {
+		return &http.Response{StatusCode: code, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("body"))}
+	}
+	policy := &RetryPolicy{MaxRetries: 2, StatusCodes: []int{http.StatusServiceUnavailable}, DisableJitter: true}
+	cases := []struct {
+		name     string
+		policy   *RetryPolicy
+		attempts uint32
+		resp     *http.Response
+		err      error
+		retry    bool
+	}{
+		{"no policy", nil, 1, nil, io.EOF, false},
+		{"network error", policy, 1, nil, io.EOF, true},
+		{"permanent error", policy, 1, nil, errors.New("bad request"), false},
+		{"retry status", policy, 2, response(http.StatusServiceUnavailable), nil, true},
+		{"default status not listed", policy, 1, response(http.StatusBadGateway), nil, false},
+		{"ok", policy, 1, response(http.StatusOK), nil, false},
+		{"retries used up", policy, 3, nil, io.EOF, false},
+	}
+	for _, c := range cases {
+		retryErr := c.policy.check(c.attempts, c.resp, c.err)
+		if (retryErr != nil) != c.retry {
+			t.Errorf("%s: check() = %v; want retry %v", c.name, retryErr, c.retry)
+			continue
+		}
+		if retryErr == nil {
+			continue
+		}
+		if retryErr.Attempts != c.attempts {
+			t.Errorf("%s: Attempts = %d; want %d", c.name, retryErr.Attempts, c.attempts)
+		}
+		if c.err != nil && !errors.Is(retryErr, c.err) {
+			t.Errorf("%s: RetryError should wrap %v", c.name, c.err)
+		}
+		if c.resp != nil && retryErr.StatusCode != c.resp.StatusCode {
+			t.Errorf("%s: StatusCode = %d; want %d", c.name, retryErr.StatusCode, c.resp.StatusCode)
+		}
+	}
+}
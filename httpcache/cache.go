@@ -0,0 +1,408 @@
+package httpcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"webcrawler/base"
+	"webcrawler/canonical"
+	dl "webcrawler/downloader"
+)
+
+const (
+	// 从缓存返回的响应带有这个头
+	HEADER_FROM_CACHE = "X-From-Cache"
+	// 记录缓存设置的验证头, 重新下载前先去掉, 避免带上过期的验证头
+	META_VALIDATORS = "httpcache.validators"
+)
+
+// 离线模式下请求没有缓存时返回, 请求会被丢弃
+var ErrNotCached error = notCachedError{}
+
+type notCachedError struct{}
+
+func (s notCachedError) Error() string {
+	return "The response is not cached (offline mode)!"
+}
+func (s notCachedError) Is(target error) bool {
+	return target == dl.ErrDropRequest
+}
+
+// 可以缓存的状态码
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// 磁盘上的http缓存, 作为下载器中间件使用, 应该放在中间件的最后
+// 只缓存GET请求, 按规范化的url和Vary头区分; 过期的缓存用If-None-Match/If-Modified-Since验证, 304视为命中
+// 响应体被完整读取后才会存入缓存
+type Cache interface {
+	dl.DownloaderMiddleware
+	Stats() Stats
+	Summary() string
+}
+
+type Config struct {
+	// 缓存目录, 不存在时创建
+	Dir string
+	// 只从缓存读取, 没有缓存的请求返回ErrNotCached
+	Offline bool
+	// 为空时使用canonical.DefaultRules
+	Canonicalizer canonical.Canonicalizer
+}
+
+type Stats struct {
+	Hits        uint64 // 从缓存返回, 包括验证后的
+	Revalidated uint64 // 服务器返回304的
+	Misses      uint64
+	Stored      uint64
+	Errors      uint64 // 读写缓存文件失败的次数, 失败时当作没有缓存
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("hits:%d,revalidated:%d,misses:%d,stored:%d,errors:%d",
+		s.Hits, s.Revalidated, s.Misses, s.Stored, s.Errors)
+}
+
+type myCache struct {
+	store         *store
+	offline       bool
+	canonicalizer canonical.Canonicalizer
+	hits          uint64
+	revalidated   uint64
+	misses        uint64
+	stored        uint64
+	errors        uint64
+}
+
+func NewCache(cfg Config) (Cache, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("The http cache directory is empty!")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, errors.New(fmt.Sprintf("Occur error when create http cache directory %s :%s", cfg.Dir, err))
+	}
+	canonicalizer := cfg.Canonicalizer
+	if canonicalizer == nil {
+		canonicalizer = canonical.NewCanonicalizer(canonical.DefaultRules())
+	}
+	return &myCache{store: &store{dir: cfg.Dir}, offline: cfg.Offline, canonicalizer: canonicalizer}, nil
+}
+
+func (s *myCache) Stats() Stats {
+	return Stats{
+		Hits:        atomic.LoadUint64(&s.hits),
+		Revalidated: atomic.LoadUint64(&s.revalidated),
+		Misses:      atomic.LoadUint64(&s.misses),
+		Stored:      atomic.LoadUint64(&s.stored),
+		Errors:      atomic.LoadUint64(&s.errors),
+	}
+}
+func (s *myCache) Summary() string {
+	return fmt.Sprintf("dir:%s,offline:%v,%s", s.store.dir, s.offline, s.Stats())
+}
+
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != "" && req.Method != http.MethodGet {
+		return false
+	}
+	_, noStore := cacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+func (s *myCache) ProcessRequest(ctx context.Context, req *base.Request) (*base.Response, error) {
+	httpReq := req.HttpReq()
+	if !cacheableRequest(httpReq) {
+		return nil, nil
+	}
+	s.clearValidators(req)
+	key := s.canonicalizer.Key(httpReq.URL)
+	e, body, size, err := s.store.open(s.store.lookupHash(key, httpReq.Header))
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+	}
+	if e == nil {
+		if s.offline {
+			atomic.AddUint64(&s.misses, 1)
+			return nil, ErrNotCached
+		}
+		return nil, nil
+	}
+	_, noCache := cacheControl(httpReq.Header)["no-cache"]
+	if s.offline || (!noCache && fresh(e, time.Now())) {
+		atomic.AddUint64(&s.hits, 1)
+		return base.NewResponse(cachedResponse(e, body, size, httpReq), req.Depth()), nil
+	}
+	body.Close()
+	s.setValidators(req, e)
+	return nil, nil
+}
+
+// 去掉上次设置的验证头, 请求自己设置的不受影响
+func (s *myCache) clearValidators(req *base.Request) {
+	value, ok := req.Meta(META_VALIDATORS)
+	validators, _ := value.(string)
+	if !ok || validators == "" {
+		return
+	}
+	header := req.HttpReq().Header
+	parts := strings.SplitN(validators, "\n", 2)
+	if len(parts) == 2 {
+		if parts[0] != "" && header.Get("If-None-Match") == parts[0] {
+			header.Del("If-None-Match")
+		}
+		if parts[1] != "" && header.Get("If-Modified-Since") == parts[1] {
+			header.Del("If-Modified-Since")
+		}
+	}
+	req.SetMeta(META_VALIDATORS, "")
+}
+
+func (s *myCache) setValidators(req *base.Request, e *entry) {
+	header := req.HttpReq().Header
+	if header == nil {
+		header = make(http.Header)
+		req.HttpReq().Header = header
+	}
+	if header.Get("If-None-Match") != "" || header.Get("If-Modified-Since") != "" {
+		return
+	}
+	etag, lastModified := e.etag(), e.lastModified()
+	if etag == "" && lastModified == "" {
+		return
+	}
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		header.Set("If-Modified-Since", lastModified)
+	}
+	req.SetMeta(META_VALIDATORS, etag+"\n"+lastModified)
+}
+
+// 请求的验证头和缓存一致时, 304才是对缓存的验证
+func validatorsMatch(e *entry, header http.Header) bool {
+	if etag := header.Get("If-None-Match"); etag != "" {
+		return etag == e.etag()
+	}
+	if since := header.Get("If-Modified-Since"); since != "" {
+		return since == e.lastModified()
+	}
+	return false
+}
+
+func (s *myCache) ProcessResponse(ctx context.Context, req *base.Request, resp *base.Response) (*base.Response, error) {
+	httpReq, httpResp := req.HttpReq(), resp.HttpResp()
+	if !cacheableRequest(httpReq) || resp.Skipped() || httpResp.Header.Get(HEADER_FROM_CACHE) != "" {
+		return resp, nil
+	}
+	key := s.canonicalizer.Key(httpReq.URL)
+	if httpResp.StatusCode == http.StatusNotModified {
+		if revalidated := s.revalidate(key, httpReq, httpResp, resp.Depth()); revalidated != nil {
+			return revalidated, nil
+		}
+		return resp, nil
+	}
+	atomic.AddUint64(&s.misses, 1)
+	if !cacheableStatus[httpResp.StatusCode] {
+		return resp, nil
+	}
+	if _, noStore := cacheControl(httpResp.Header)["no-store"]; noStore {
+		return resp, nil
+	}
+	names, ok := varyNames(httpResp.Header)
+	if !ok {
+		return resp, nil
+	}
+	hash := s.store.variantHash(key, names, httpReq.Header)
+	e := &entry{Url: httpReq.URL.String(), StatusCode: httpResp.StatusCode, Header: httpResp.Header.Clone(), Stored: time.Now()}
+	file, err := s.store.create(hash, e)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return resp, nil
+	}
+	httpResp.Body = &cachingBody{
+		body:      httpResp.Body,
+		file:      file,
+		expected:  httpResp.ContentLength,
+		truncated: resp.Truncated,
+		commit: func(file *os.File) {
+			if err := s.store.commit(file, hash, key, names); err != nil {
+				atomic.AddUint64(&s.errors, 1)
+				return
+			}
+			atomic.AddUint64(&s.stored, 1)
+		},
+		abort: func(err error) {
+			if err != nil {
+				atomic.AddUint64(&s.errors, 1)
+			}
+		},
+	}
+	return resp, nil
+}
+
+// 用304的头更新缓存并返回缓存的响应, 不是对缓存的验证时返回nil
+func (s *myCache) revalidate(key string, httpReq *http.Request, httpResp *http.Response, depth uint32) *base.Response {
+	hash := s.store.lookupHash(key, httpReq.Header)
+	e, body, _, err := s.store.open(hash)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+	}
+	if e == nil {
+		return nil
+	}
+	body.Close()
+	if !validatorsMatch(e, httpReq.Header) {
+		return nil
+	}
+	for name, values := range httpResp.Header {
+		if name == "Content-Length" {
+			continue
+		}
+		e.Header[name] = values
+	}
+	e.Stored = time.Now()
+	if err := s.store.update(hash, e); err != nil {
+		atomic.AddUint64(&s.errors, 1)
+	}
+	e, body, size, err := s.store.open(hash)
+	if err != nil || e == nil {
+		atomic.AddUint64(&s.errors, 1)
+		return nil
+	}
+	io.Copy(io.Discard, httpResp.Body)
+	httpResp.Body.Close()
+	atomic.AddUint64(&s.hits, 1)
+	atomic.AddUint64(&s.revalidated, 1)
+	return base.NewResponse(cachedResponse(e, body, size, httpReq), depth)
+}
+
+func (s *myCache) ProcessError(ctx context.Context, req *base.Request, err error) (*base.Response, error) {
+	return nil, err
+}
+
+func cachedResponse(e *entry, body io.ReadCloser, size int64, req *http.Request) *http.Response {
+	header := e.Header.Clone()
+	header.Set(HEADER_FROM_CACHE, "1")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: size,
+		Request:       req,
+	}
+}
+
+// 解析Cache-Control, 指令名为小写
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, arg, _ := strings.Cut(part, "=")
+			directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), "\"")
+		}
+	}
+	return directives
+}
+
+// 按max-age或Expires判断缓存是否新鲜, 都没有时需要验证
+func fresh(e *entry, now time.Time) bool {
+	directives := cacheControl(e.Header)
+	if _, ok := directives["no-cache"]; ok {
+		return false
+	}
+	age := now.Sub(e.Stored)
+	if seconds, err := strconv.Atoi(e.Header.Get("Age")); err == nil && seconds > 0 {
+		age += time.Duration(seconds) * time.Second
+	}
+	if maxAge, ok := directives["max-age"]; ok {
+		seconds, err := strconv.Atoi(maxAge)
+		return err == nil && age < time.Duration(seconds)*time.Second
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return false
+		}
+		date, err := http.ParseTime(e.Header.Get("Date"))
+		if err != nil {
+			date = e.Stored
+		}
+		return age < expiresAt.Sub(date)
+	}
+	return false
+}
+
+// 读取响应体的同时写入缓存文件, 读完并且长度正确时提交, 否则丢弃
+// 被响应限制截断的响应体不完整, 长度未知时也能发现, 同样丢弃
+type cachingBody struct {
+	body      io.ReadCloser
+	file      *os.File // 提交或丢弃后为空
+	expected  int64    // Content-Length, 未知时为-1
+	written   int64
+	truncated func() bool
+	commit    func(file *os.File)
+	abort     func(err error)
+}
+
+func (s *cachingBody) Read(p []byte) (int, error) {
+	n, err := s.body.Read(p)
+	if s.file == nil {
+		return n, err
+	}
+	if n > 0 {
+		if _, werr := s.file.Write(p[:n]); werr != nil {
+			s.discard(werr)
+			return n, err
+		}
+		s.written += int64(n)
+	}
+	if err == io.EOF {
+		if s.truncated() || (s.expected >= 0 && s.written != s.expected) {
+			s.discard(nil)
+		} else {
+			file := s.file
+			s.file = nil
+			s.commit(file)
+		}
+	} else if err != nil {
+		s.discard(nil)
+	}
+	return n, err
+}
+
+func (s *cachingBody) discard(err error) {
+	s.file.Close()
+	os.Remove(s.file.Name())
+	s.file = nil
+	s.abort(err)
+}
+
+// 没有读完就关闭时丢弃
+func (s *cachingBody) Close() error {
+	if s.file != nil {
+		s.discard(nil)
+	}
+	return s.body.Close()
+}
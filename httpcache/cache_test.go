@@ -0,0 +1,328 @@
+package httpcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"webcrawler/base"
+	dl "webcrawler/downloader"
+)
+
+// 测试用的源站, 记录每个路径收到的请求和验证头
+type origin struct {
+	*httptest.Server
+	requests map[string][]string
+	m        sync.Mutex
+}
+
+func newOrigin(t *testing.T) *origin {
+	s := &origin{requests: make(map[string][]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.m.Lock()
+		s.requests[r.URL.Path] = append(s.requests[r.URL.Path], r.Header.Get("If-None-Match")+r.Header.Get("If-Modified-Since"))
+		s.m.Unlock()
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			fmt.Fprint(w, "fresh")
+		case "/etag":
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.Header().Set("X-Revalidated", "yes")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprint(w, "etag")
+		case "/lastmod":
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			if r.Header.Get("If-Modified-Since") == "Mon, 02 Jan 2006 15:04:05 GMT" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprint(w, "lastmod")
+		case "/vary":
+			w.Header().Set("Vary", "Accept-Language")
+			w.Header().Set("Cache-Control", "max-age=3600")
+			fmt.Fprint(w, "lang-"+r.Header.Get("Accept-Language"))
+		case "/vary-star":
+			w.Header().Set("Vary", "*")
+			w.Header().Set("Cache-Control", "max-age=3600")
+			fmt.Fprint(w, "star")
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store, max-age=3600")
+			fmt.Fprint(w, "nostore")
+		case "/error":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/big":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.Write([]byte("0123456789"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("abcdefghij"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *origin) hits(path string) []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]string{}, s.requests[path]...)
+}
+
+type result struct {
+	body      string
+	fromCache bool
+	header    http.Header
+}
+
+func get(t *testing.T, d dl.PageDownloader, rawUrl string, header http.Header) (*result, error) {
+	t.Helper()
+	httpReq, _ := http.NewRequest(http.MethodGet, rawUrl, nil)
+	for name, values := range header {
+		httpReq.Header[name] = values
+	}
+	resp, err := d.Download(context.Background(), base.NewRequest(httpReq, 0))
+	if err != nil {
+		return nil, err
+	}
+	httpResp := resp.HttpResp()
+	defer httpResp.Body.Close()
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &result{body: string(body), fromCache: httpResp.Header.Get(HEADER_FROM_CACHE) != "", header: httpResp.Header}, nil
+}
+
+func TestCache(t *testing.T) {
+	srv := newOrigin(t)
+	cache, err := NewCache(Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := dl.NewPageDownloader(&http.Client{}, nil, nil, cache)
+	lang := func(value string) http.Header {
+		return http.Header{"Accept-Language": []string{value}}
+	}
+	cases := []struct {
+		name      string
+		path      string
+		header    http.Header
+		body      string
+		fromCache bool
+	}{
+		{"fresh miss", "/fresh", nil, "fresh", false},
+		{"fresh hit", "/fresh", nil, "fresh", true},
+		{"fresh hit with another url form", "/fresh?utm_source=x", nil, "fresh", true},
+		{"no-cache request", "/fresh", http.Header{"Cache-Control": []string{"no-cache"}}, "fresh", false},
+		{"etag miss", "/etag", nil, "etag", false},
+		{"etag revalidated", "/etag", nil, "etag", true},
+		{"lastmod miss", "/lastmod", nil, "lastmod", false},
+		{"lastmod revalidated", "/lastmod", nil, "lastmod", true},
+		{"vary en miss", "/vary", lang("en"), "lang-en", false},
+		{"vary fr miss", "/vary", lang("fr"), "lang-fr", false},
+		{"vary en hit", "/vary", lang("en"), "lang-en", true},
+		{"vary fr hit", "/vary", lang("fr"), "lang-fr", true},
+		{"vary star", "/vary-star", nil, "star", false},
+		{"vary star again", "/vary-star", nil, "star", false},
+		{"no-store", "/nostore", nil, "nostore", false},
+		{"no-store again", "/nostore", nil, "nostore", false},
+		{"server error", "/error", nil, "", false},
+		{"server error again", "/error", nil, "", false},
+	}
+	for _, c := range cases {
+		r, err := get(t, d, srv.URL+c.path, c.header)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if r.body != c.body || r.fromCache != c.fromCache {
+			t.Errorf("%s: body %q, from cache %v; want %q, %v", c.name, r.body, r.fromCache, c.body, c.fromCache)
+		}
+	}
+	validators := []struct {
+		path string
+		want []string
+	}{
+		{"/etag", []string{"", `"v1"`}},
+		{"/lastmod", []string{"", "Mon, 02 Jan 2006 15:04:05 GMT"}},
+		{"/fresh", []string{"", ""}},
+		{"/vary", []string{"", ""}},
+	}
+	for _, v := range validators {
+		if hits := srv.hits(v.path); fmt.Sprint(hits) != fmt.Sprint(v.want) {
+			t.Errorf("%s: origin got validators %q; want %q", v.path, hits, v.want)
+		}
+	}
+	stats := cache.Stats()
+	if stats.Hits != 6 || stats.Revalidated != 2 || stats.Errors != 0 {
+		t.Errorf("Stats() = %s", stats)
+	}
+}
+
+func TestRevalidateUpdatesHeaders(t *testing.T) {
+	srv := newOrigin(t)
+	cache, _ := NewCache(Config{Dir: t.TempDir()})
+	d := dl.NewPageDownloader(&http.Client{}, nil, nil, cache)
+	get(t, d, srv.URL+"/etag", nil)
+	r, err := get(t, d, srv.URL+"/etag", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.fromCache || r.header.Get("X-Revalidated") != "yes" {
+		t.Errorf("the 304 headers were not merged: %v", r.header)
+	}
+	// 请求自己带的验证头和缓存不一致时, 304不是对缓存的验证
+	r, err = get(t, d, srv.URL+"/etag", http.Header{"If-None-Match": []string{`"v0"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.fromCache || r.body != "etag" {
+		t.Errorf("body %q, from cache %v; want a fresh download", r.body, r.fromCache)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	srv := newOrigin(t)
+	dir := t.TempDir()
+	online, _ := NewCache(Config{Dir: dir})
+	d := dl.NewPageDownloader(&http.Client{}, nil, nil, online)
+	for _, path := range []string{"/fresh", "/etag"} {
+		if _, err := get(t, d, srv.URL+path, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.Close()
+
+	offline, _ := NewCache(Config{Dir: dir, Offline: true})
+	d = dl.NewPageDownloader(&http.Client{}, nil, nil, offline)
+	cases := []struct {
+		path string
+		body string // 为空时应该返回ErrNotCached
+	}{
+		{"/fresh", "fresh"},
+		{"/etag", "etag"}, // 需要验证的缓存也直接返回
+		{"/vary", ""},
+	}
+	for _, c := range cases {
+		r, err := get(t, d, srv.URL+c.path, nil)
+		if c.body == "" {
+			if !errors.Is(err, ErrNotCached) || !errors.Is(err, dl.ErrDropRequest) {
+				t.Errorf("%s: err = %v; want ErrNotCached", c.path, err)
+			}
+			continue
+		}
+		if err != nil || r.body != c.body || !r.fromCache {
+			t.Errorf("%s: %+v, %v; want %q from cache", c.path, r, err, c.body)
+		}
+	}
+	if stats := offline.Stats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("Stats() = %s", stats)
+	}
+}
+
+func TestTruncatedNotStored(t *testing.T) {
+	srv := newOrigin(t)
+	cache, _ := NewCache(Config{Dir: t.TempDir()})
+	cases := []struct {
+		maxBytes  int64
+		body      string
+		fromCache bool
+	}{
+		{12, "0123456789ab", false},
+		{12, "0123456789ab", false},
+		{20, "0123456789abcdefghij", false},
+		{20, "0123456789abcdefghij", true},
+	}
+	for i, c := range cases {
+		d := dl.NewPageDownloader(&http.Client{}, nil, &dl.ResponseLimits{MaxBodyBytes: c.maxBytes, TruncateBody: true}, cache)
+		r, err := get(t, d, srv.URL+"/big", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.body != c.body || r.fromCache != c.fromCache {
+			t.Errorf("[%d] body %q, from cache %v; want %q, %v", i, r.body, r.fromCache, c.body, c.fromCache)
+		}
+	}
+}
+
+// 缓存命中和验证后的缓存也要满足下载器的响应限制
+func TestCacheHitLimits(t *testing.T) {
+	srv := newOrigin(t)
+	cache, _ := NewCache(Config{Dir: t.TempDir()})
+	d := dl.NewPageDownloader(&http.Client{}, nil, nil, cache)
+	for _, path := range []string{"/fresh", "/etag", "/big"} {
+		if _, err := get(t, d, srv.URL+path, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		name      string
+		path      string
+		limits    dl.ResponseLimits
+		skipped   bool
+		body      string
+		truncated bool
+	}{
+		{"denied type", "/fresh", dl.ResponseLimits{DeniedTypes: []string{"text/plain"}}, true, "", false},
+		{"not allowed type", "/fresh", dl.ResponseLimits{AllowedTypes: []string{"text/html"}}, true, "", false},
+		{"allowed type", "/fresh", dl.ResponseLimits{AllowedTypes: []string{"text/*"}}, false, "fresh", false},
+		{"revalidated denied type", "/etag", dl.ResponseLimits{DeniedTypes: []string{"text/plain"}}, true, "", false},
+		{"too large", "/big", dl.ResponseLimits{MaxBodyBytes: 10}, true, "", false},
+		{"truncated", "/big", dl.ResponseLimits{MaxBodyBytes: 10, TruncateBody: true}, false, "0123456789", true},
+	}
+	for _, c := range cases {
+		limits := c.limits
+		d := dl.NewPageDownloader(&http.Client{}, nil, &limits, cache)
+		httpReq, _ := http.NewRequest(http.MethodGet, srv.URL+c.path, nil)
+		resp, err := d.Download(context.Background(), base.NewRequest(httpReq, 0))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		httpResp := resp.HttpResp()
+		body, _ := io.ReadAll(httpResp.Body)
+		httpResp.Body.Close()
+		if httpResp.Header.Get(HEADER_FROM_CACHE) == "" {
+			t.Errorf("%s: the response is not from the cache", c.name)
+		}
+		if resp.Skipped() != c.skipped || string(body) != c.body || resp.Truncated() != c.truncated {
+			t.Errorf("%s: skipped %v, body %q, truncated %v; want %v, %q, %v",
+				c.name, resp.Skipped(), body, resp.Truncated(), c.skipped, c.body, c.truncated)
+		}
+	}
+}
+
+func TestFresh(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	stored := now.Add(-time.Minute)
+	cases := []struct {
+		header http.Header
+		fresh  bool
+	}{
+		{http.Header{}, false},
+		{http.Header{"Cache-Control": {"max-age=120"}}, true},
+		{http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{http.Header{"Cache-Control": {"public, MAX-AGE=\"120\""}}, true},
+		{http.Header{"Cache-Control": {"max-age=120"}, "Age": {"90"}}, false},
+		{http.Header{"Cache-Control": {"no-cache, max-age=120"}}, false},
+		{http.Header{"Cache-Control": {"max-age=abc"}}, false},
+		{http.Header{"Date": {"Wed, 01 May 2024 11:59:00 GMT"}, "Expires": {"Wed, 01 May 2024 12:01:00 GMT"}}, true},
+		{http.Header{"Date": {"Wed, 01 May 2024 11:59:00 GMT"}, "Expires": {"Wed, 01 May 2024 11:59:30 GMT"}}, false},
+		{http.Header{"Expires": {"0"}}, false},
+		{http.Header{"Cache-Control": {"max-age=0"}, "Expires": {"Wed, 01 May 2025 12:00:00 GMT"}}, false},
+	}
+	for _, c := range cases {
+		if fresh := fresh(&entry{Header: c.header, Stored: stored}, now); fresh != c.fresh {
+			t.Errorf("fresh(%v) = %v; want %v", c.header, fresh, c.fresh)
+		}
+	}
+}
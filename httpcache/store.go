@@ -0,0 +1,230 @@
+package httpcache
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 缓存文件: 第一行是json格式的元数据, 之后是响应体
+type entry struct {
+	Url        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Stored     time.Time   `json:"stored"` // 存入或最后一次验证的时间
+}
+
+func (s *entry) etag() string {
+	return s.Header.Get("ETag")
+}
+func (s *entry) lastModified() string {
+	return s.Header.Get("Last-Modified")
+}
+
+// 按字段名排序的Vary头, 没有时为空; 包含*时返回false, 表示不能缓存
+func varyNames(header http.Header) ([]string, bool) {
+	names := make([]string, 0)
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+func hashKey(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		io.WriteString(h, part)
+		io.WriteString(h, "\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 目录中的文件按哈希的前两位分散到子目录
+type store struct {
+	dir string
+}
+
+func (s *store) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// url对应的Vary字段名保存在url哈希的.vary文件中
+func (s *store) varyPath(key string) string {
+	return s.path(hashKey(key)) + ".vary"
+}
+
+// 根据url和请求中Vary字段的值计算缓存文件的哈希
+func (s *store) variantHash(key string, names []string, reqHeader http.Header) string {
+	parts := []string{key}
+	for _, name := range names {
+		parts = append(parts, name+":"+strings.Join(reqHeader.Values(name), ","))
+	}
+	return hashKey(parts...)
+}
+
+func (s *store) loadVary(key string) []string {
+	data, err := os.ReadFile(s.varyPath(key))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	if json.Unmarshal(data, &names) != nil {
+		return nil
+	}
+	return names
+}
+
+// 返回请求对应的缓存文件的哈希
+func (s *store) lookupHash(key string, reqHeader http.Header) string {
+	return s.variantHash(key, s.loadVary(key), reqHeader)
+}
+
+// 读取元数据和响应体, 不存在时返回nil
+func (s *store) open(hash string) (*entry, io.ReadCloser, int64, error) {
+	file, err := os.Open(s.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, 0, nil
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	reader := bufio.NewReader(file)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		file.Close()
+		return nil, nil, 0, err
+	}
+	e := &entry{}
+	if err := json.Unmarshal(line, e); err != nil {
+		file.Close()
+		return nil, nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, 0, err
+	}
+	body := struct {
+		io.Reader
+		io.Closer
+	}{reader, file}
+	return e, body, info.Size() - int64(len(line)), nil
+}
+
+// 在同一目录创建临时文件并写入元数据, 提交时改名
+func (s *store) create(hash string, e *entry) (*os.File, error) {
+	path := s.path(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), hash+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeMeta(file, e); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+func writeMeta(w io.Writer, e *entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func (s *store) commit(file *os.File, hash string, key string, names []string) error {
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := s.saveVary(key, names); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), s.path(hash))
+}
+
+func (s *store) saveVary(key string, names []string) error {
+	path := s.varyPath(key)
+	if len(names) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// 验证成功后只更新元数据, 响应体不变
+func (s *store) update(hash string, e *entry) error {
+	old, body, _, err := s.open(hash)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return nil
+	}
+	defer body.Close()
+	file, err := s.create(hash, e)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), s.path(hash))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
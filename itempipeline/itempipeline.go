@@ -1,6 +1,7 @@
 package itempipeline
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync/atomic"
@@ -8,15 +9,17 @@ import (
 )
 
 type ItemPipeline interface {
-	Send(item base.Item) []error
+	Send(ctx context.Context, item base.Item) []error
 	FailFast() bool
 	SetFailFast(failFast bool)
 	Count() []uint64
+	// 恢复Count的结果, 用于断点续爬
+	SetCount(counts []uint64)
 	ProcessingNumber() uint64
 	Summary() string
 }
 
-type ProcessItem func(item base.Item) (result base.Item, err error)
+type ProcessItem func(ctx context.Context, item base.Item) (result base.Item, err error)
 
 func NewItemPipeline(itemProcessors []ProcessItem) ItemPipeline {
 	if itemProcessors == nil {
@@ -41,7 +44,7 @@ type myItemPipeline struct {
 	processingNumber uint64
 }
 
-func (s *myItemPipeline) Send(item base.Item) []error {
+func (s *myItemPipeline) Send(ctx context.Context, item base.Item) []error {
 	// 原子操作
 	atomic.AddUint64(&s.processingNumber, 1)
 	defer atomic.AddUint64(&s.processingNumber, ^uint64(0))
@@ -54,7 +57,7 @@ func (s *myItemPipeline) Send(item base.Item) []error {
 	atomic.AddUint64(&s.accepted, 1)
 	var currentItem base.Item = item
 	for _, itemProcessor := range s.itemProcessors {
-		processItem, err := itemProcessor(currentItem)
+		processItem, err := itemProcessor(ctx, currentItem)
 		if err != nil {
 			errs = append(errs, err)
 			if s.failFast {
@@ -66,23 +69,31 @@ func (s *myItemPipeline) Send(item base.Item) []error {
 		}
 		atomic.AddUint64(&s.processed, 1)
 	}
-	return nil
+	return errs
 }
 func (s *myItemPipeline) FailFast() bool {
-	return true
+	return s.failFast
 }
 func (s *myItemPipeline) SetFailFast(failFast bool) {
-
-	return
+	s.failFast = failFast
 }
-func (s *myItemPipeline) Count() (counts []uint64) {
+func (s *myItemPipeline) Count() []uint64 {
+	counts := make([]uint64, 3)
 	counts[0] = atomic.LoadUint64(&s.sent)
 	counts[1] = atomic.LoadUint64(&s.accepted)
 	counts[2] = atomic.LoadUint64(&s.processed)
-	return
+	return counts
+}
+func (s *myItemPipeline) SetCount(counts []uint64) {
+	if len(counts) < 3 {
+		return
+	}
+	atomic.StoreUint64(&s.sent, counts[0])
+	atomic.StoreUint64(&s.accepted, counts[1])
+	atomic.StoreUint64(&s.processed, counts[2])
 }
 func (s *myItemPipeline) ProcessingNumber() uint64 {
-	return atomic.LoadUint64(&s.processed)
+	return atomic.LoadUint64(&s.processingNumber)
 }
 func (s *myItemPipeline) Summary() string {
 	count := s.Count()
@@ -1,5 +1,289 @@
 package main
 
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	anlz "webcrawler/analyzer"
+	"webcrawler/base"
+	"webcrawler/distributed"
+	ipl "webcrawler/itempipeline"
+	"webcrawler/scheduler"
+
+	"github.com/bugfan/logrus"
+	"golang.org/x/net/html"
+)
+
+const usage = `Usage:
+  webcrawler [-config crawl.yaml] [-seed url]... [-depth n] [-out items.jsonl]
+      单机爬取, 每个页面输出一行json: url status title
+  webcrawler -listen :8080
+      运行协调者, 所有请求处理完后退出
+  webcrawler -coordinator http://127.0.0.1:8080 [-name a] [-config crawl.yaml] [-seed url]...
+      作为工作进程, 和其它工作进程共享协调者的待爬取队列
+
+Flags:
+`
+
+type seedFlags []string
+
+func (s *seedFlags) String() string {
+	return strings.Join(*s, ",")
+}
+func (s *seedFlags) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// 命令行参数
+type options struct {
+	configPath  string
+	seeds       seedFlags
+	depth       uint
+	out         string
+	listen      string
+	coordinator string
+	name        string
+}
+
+// 解析并检查命令行参数
+func parseOptions(args []string, output io.Writer) (*options, error) {
+	opts := &options{}
+	flags := flag.NewFlagSet("webcrawler", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&opts.configPath, "config", "", "配置文件(.yaml/.yml/.json/.toml)")
+	flags.Var(&opts.seeds, "seed", "种子url, 可以重复, 追加到配置的种子之后")
+	flags.UintVar(&opts.depth, "depth", 0, "爬取深度, 0表示使用配置的值")
+	flags.StringVar(&opts.out, "out", "", "输出文件, 为空时输出到标准输出")
+	flags.StringVar(&opts.listen, "listen", "", "运行协调者的监听地址")
+	flags.StringVar(&opts.coordinator, "coordinator", "", "协调者的地址, 设置后作为工作进程运行")
+	flags.StringVar(&opts.name, "name", "", "工作进程的名字, 为空时使用主机名")
+	flags.Usage = func() {
+		fmt.Fprint(output, usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, errors.New(fmt.Sprintf("Unexpected arguments: %v", flags.Args()))
+	}
+	if opts.listen != "" {
+		if opts.coordinator != "" || opts.configPath != "" || len(opts.seeds) > 0 || opts.out != "" || opts.name != "" || opts.depth > 0 {
+			return nil, errors.New("-listen runs the coordinator and can not be used with other flags")
+		}
+		return opts, nil
+	}
+	if opts.name != "" && opts.coordinator == "" {
+		return nil, errors.New("-name is only used with -coordinator")
+	}
+	if opts.configPath == "" && len(opts.seeds) == 0 {
+		return nil, errors.New("No seeds: set -config or -seed")
+	}
+	return opts, nil
+}
+
 func main() {
+	opts, err := parseOptions(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if opts.listen != "" {
+		err = runCoordinator(ctx, opts.listen)
+	} else {
+		err = runCrawler(ctx, opts)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func runCoordinator(ctx context.Context, addr string) error {
+	c := distributed.NewCoordinator(distributed.CoordinatorConfig{})
+	defer c.Close()
+	server := &http.Server{Addr: addr, Handler: c}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+	logrus.Infof("The coordinator is listening on %s\n", addr)
+	select {
+	case err := <-errCh:
+		return err
+	case <-c.Done():
+		logrus.Infof("All requests are done: %s\n", c.Status())
+		waitWorkersLeft(ctx, c)
+	case <-ctx.Done():
+		logrus.Infof("The coordinator is stopped: %s\n", c.Status())
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// 工作进程通过轮询和心跳得知爬取结束, 所以要等它们都离开(或超时)后才能退出
+func waitWorkersLeft(ctx context.Context, c distributed.Coordinator) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for len(c.Status().Workers) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func runCrawler(ctx context.Context, opts *options) error {
+	cfg := &scheduler.CrawlConfig{DownloaderPoolSize: 8, AnalyzerPoolSize: 4, CrawlDepth: 1}
+	if opts.configPath != "" {
+		loaded, err := scheduler.LoadCrawlConfig(opts.configPath)
+		if err != nil {
+			return err
+		}
+		cfg = loaded
+	}
+	for _, seed := range opts.seeds {
+		cfg.Seeds = append(cfg.Seeds, scheduler.Seed{URL: seed})
+	}
+	if opts.depth > 0 {
+		cfg.CrawlDepth = uint32(opts.depth)
+	}
+	cfg.BodyBuffer.Transcode = true
+	cfg.HttpClientGenerator = func() *http.Client { return &http.Client{} }
+	cfg.RespParsers = []anlz.ParseResponse{parseLinks}
+
+	var writer io.Writer = os.Stdout
+	if opts.out != "" {
+		file, err := os.Create(opts.out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+	cfg.ItemProcessors = []ipl.ProcessItem{newItemWriter(writer)}
+
+	var worker distributed.Worker
+	if opts.coordinator != "" {
+		name := opts.name
+		if name == "" {
+			name, _ = os.Hostname()
+		}
+		var err error
+		if worker, err = distributed.NewWorker(opts.coordinator, name, nil); err != nil {
+			return err
+		}
+		defer worker.Close()
+		cfg.SharedFrontier = worker
+	}
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return errors.New(fmt.Sprintf("The crawl config is invalid: %v", errs))
+	}
+
+	sched := scheduler.NewScheduler()
+	if err := sched.Start(ctx, *cfg); err != nil {
+		return err
+	}
+	go func() {
+		for err := range sched.ErrorChan() {
+			logrus.Warnf("%s\n", err)
+		}
+	}()
+	<-sched.Done()
+	fmt.Fprint(os.Stderr, sched.Summary("").String())
+	return nil
+}
+
+// 每个条目写成一行json
+func newItemWriter(w io.Writer) ipl.ProcessItem {
+	var m sync.Mutex
+	encoder := json.NewEncoder(w)
+	return func(ctx context.Context, item base.Item) (base.Item, error) {
+		m.Lock()
+		defer m.Unlock()
+		return item, encoder.Encode(item)
+	}
+}
 
+// 提取html页面中的链接和标题, 相对链接按<base href>或页面地址解析
+func parseLinks(ctx context.Context, httpResp *http.Response, respDepth uint32) ([]base.Data, []error) {
+	pageUrl := httpResp.Request.URL
+	item := base.Item{"url": pageUrl.String(), "status": httpResp.StatusCode}
+	dataList := []base.Data{item}
+	if !strings.Contains(httpResp.Header.Get("Content-Type"), "html") {
+		return dataList, nil
+	}
+	errs := make([]error, 0)
+	baseUrl := pageUrl
+	tokenizer := html.NewTokenizer(httpResp.Body)
+	inTitle := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				errs = append(errs, err)
+			}
+			return dataList, errs
+		case html.TextToken:
+			if inTitle {
+				item["title"] = strings.TrimSpace(string(tokenizer.Text()))
+			}
+		case html.EndTagToken:
+			inTitle = false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data == "title" {
+				inTitle = item["title"] == nil
+				continue
+			}
+			var href string
+			for _, attr := range token.Attr {
+				if attr.Key == "href" {
+					href = strings.TrimSpace(attr.Val)
+				}
+			}
+			if href == "" {
+				continue
+			}
+			if token.Data == "base" {
+				if u, err := pageUrl.Parse(href); err == nil {
+					baseUrl = u
+				}
+				continue
+			}
+			if token.Data != "a" && token.Data != "area" {
+				continue
+			}
+			u, err := baseUrl.Parse(href)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				continue
+			}
+			u.Fragment = ""
+			httpReq, err := http.NewRequest(http.MethodGet, u.String(), nil)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			dataList = append(dataList, base.NewRequest(httpReq, respDepth))
+		}
+	}
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"webcrawler/base"
+)
+
+func TestParseOptions(t *testing.T) {
+	cases := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"-seed", "http://a.com/"}, true},
+		{[]string{"-seed", "http://a.com/", "-seed", "http://b.com/", "-depth", "3", "-out", "items.jsonl"}, true},
+		{[]string{"-config", "crawl.yaml"}, true},
+		{[]string{"-coordinator", "http://127.0.0.1:8080", "-name", "a", "-seed", "http://a.com/"}, true},
+		{[]string{"-listen", ":8080"}, true},
+		{[]string{}, false},
+		{[]string{"-depth", "2"}, false},
+		{[]string{"-listen", ":8080", "-seed", "http://a.com/"}, false},
+		{[]string{"-listen", ":8080", "-coordinator", "http://127.0.0.1:8080"}, false},
+		{[]string{"-name", "a", "-seed", "http://a.com/"}, false},
+		{[]string{"-seed", "http://a.com/", "extra"}, false},
+		{[]string{"-depth", "-1", "-seed", "http://a.com/"}, false},
+		{[]string{"-unknown"}, false},
+	}
+	for _, c := range cases {
+		_, err := parseOptions(c.args, io.Discard)
+		if (err == nil) != c.ok {
+			t.Errorf("parseOptions(%q) error = %v; want ok %v", c.args, err, c.ok)
+		}
+	}
+	opts, err := parseOptions([]string{"-seed", "http://a.com/", "-seed", "http://b.com/", "-depth", "3"}, io.Discard)
+	if err != nil || fmt.Sprint(opts.seeds) != "[http://a.com/ http://b.com/]" || opts.depth != 3 {
+		t.Errorf("parseOptions() = %+v, %v", opts, err)
+	}
+}
+
+func TestParseLinks(t *testing.T) {
+	const page = `<html><head><title> Home </title><base href="/docs/"></head><body>
+<a href="a.html#top">a</a> <a href="http://b.com/x">b</a> <a href="mailto:x@y.z">mail</a>
+<a href="javascript:void(0)">js</a> <a>empty</a> <area href="../c.html"> <link href="style.css">
+<title>second</title></body></html>`
+	cases := []struct {
+		contentType string
+		body        string
+		title       interface{}
+		links       []string
+	}{
+		{"text/html; charset=utf-8", page, "Home", []string{"http://a.com/docs/a.html", "http://b.com/x", "http://a.com/c.html"}},
+		{"application/json", `{"href":"/x"}`, nil, nil},
+		{"text/html", `<a href="b.html">b</a>`, nil, []string{"http://a.com/dir/b.html"}},
+	}
+	for _, c := range cases {
+		httpReq, _ := http.NewRequest(http.MethodGet, "http://a.com/dir/page.html", nil)
+		httpResp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{c.contentType}},
+			Body:       io.NopCloser(strings.NewReader(c.body)),
+			Request:    httpReq,
+		}
+		dataList, errs := parseLinks(context.Background(), httpResp, 1)
+		if len(errs) > 0 {
+			t.Errorf("%s: parseLinks() errors: %v", c.contentType, errs)
+		}
+		item, ok := dataList[0].(base.Item)
+		if !ok || item["url"] != "http://a.com/dir/page.html" || item["status"] != http.StatusOK || item["title"] != c.title {
+			t.Errorf("%s: item = %v; want title %v", c.contentType, dataList[0], c.title)
+		}
+		links := make([]string, 0)
+		for _, data := range dataList[1:] {
+			links = append(links, data.(*base.Request).HttpReq().URL.String())
+		}
+		if fmt.Sprint(links) != fmt.Sprint(c.links) {
+			t.Errorf("%s: links = %v; want %v", c.contentType, links, c.links)
+		}
+	}
+}
+
+// 并发写入时每个条目仍然是完整的一行
+func TestItemWriter(t *testing.T) {
+	var buf bytes.Buffer
+	process := newItemWriter(&buf)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			process(context.Background(), base.Item{"url": fmt.Sprintf("http://a.com/%d", i)})
+		}(i)
+	}
+	wg.Wait()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 20 {
+		t.Fatalf("%d lines; want 20", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, `{"url":"http://a.com/`) || !strings.HasSuffix(line, `"}`) {
+			t.Errorf("malformed line %q", line)
+		}
+	}
+}
@@ -1,32 +1,53 @@
 package middleware
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"math"
 	"reflect"
+	"sort"
 	"sync"
 	"webcrawler/base"
 )
 
 // 通道管理器
 type ChannelManager interface {
-	Init(chanLen uint, reset bool) bool
+	Init(args ChannelArgs, reset bool) bool
 	Close() bool
 	ReqChan() (chan base.Request, error)
 	RespChan() (chan base.Response, error)
 	ItemChan() (chan base.Item, error)
 	ErrorChan() (chan error, error)
-	ChannelLen() uint
+	ChannelArgs() ChannelArgs
 	Status() ChannelManagerStatus
 	Summary() string
 }
 type ChannelManagerStatus uint8
 
+// 各通道的长度
+type ChannelArgs struct {
+	ReqChanLen   uint
+	RespChanLen  uint
+	ItemChanLen  uint
+	ErrorChanLen uint
+}
+
+func (s ChannelArgs) Check() error {
+	if s.ReqChanLen == 0 || s.RespChanLen == 0 || s.ItemChanLen == 0 || s.ErrorChanLen == 0 {
+		return errors.New(fmt.Sprintf("The Channel Length is invalid: %s", s))
+	}
+	return nil
+}
+func (s ChannelArgs) String() string {
+	return fmt.Sprintf("reqChanLen:%d,respChanLen:%d,itemChanLen:%d,errorChanLen:%d",
+		s.ReqChanLen, s.RespChanLen, s.ItemChanLen, s.ErrorChanLen)
+}
+
 var statusNameMap = map[ChannelManagerStatus]string{
-	CHANNEL_MANAGER_STATUS_CLOSED:        "uninitialized",
+	CHANNEL_MANAGER_STATUS_UNINITIALIZED: "uninitialized",
 	CHANNEL_MANAGER_STATUS_INITIALIZED:   "initialized",
-	CHANNEL_MANAGER_STATUS_UNINITIALIZED: "closed",
+	CHANNEL_MANAGER_STATUS_CLOSED:        "closed",
 }
 
 const (
@@ -37,29 +58,29 @@ const (
 )
 
 type myChannelManager struct {
-	channelLen uint
-	reqCh      chan base.Request
-	respCh     chan base.Response
-	itemCh     chan base.Item
-	errorCh    chan error
-	status     ChannelManagerStatus //通道管理器的状态
-	m          sync.RWMutex
+	channelArgs ChannelArgs
+	reqCh       chan base.Request
+	respCh      chan base.Response
+	itemCh      chan base.Item
+	errorCh     chan error
+	status      ChannelManagerStatus //通道管理器的状态
+	m           sync.RWMutex
 }
 
-func (s *myChannelManager) Init(channelLen uint, reset bool) bool {
-	if channelLen <= 0 {
-		panic(errors.New("The Channel Length is invalid"))
+func (s *myChannelManager) Init(channelArgs ChannelArgs, reset bool) bool {
+	if err := channelArgs.Check(); err != nil {
+		panic(err)
 	}
 	s.m.Lock()
 	defer s.m.Unlock()
 	if s.status == CHANNEL_MANAGER_STATUS_INITIALIZED && !reset {
 		return false
 	}
-	s.channelLen = channelLen
-	s.reqCh = make(chan base.Request, channelLen)
-	s.respCh = make(chan base.Response, channelLen)
-	s.itemCh = make(chan base.Item, channelLen)
-	s.errorCh = make(chan error, channelLen)
+	s.channelArgs = channelArgs
+	s.reqCh = make(chan base.Request, channelArgs.ReqChanLen)
+	s.respCh = make(chan base.Response, channelArgs.RespChanLen)
+	s.itemCh = make(chan base.Item, channelArgs.ItemChanLen)
+	s.errorCh = make(chan error, channelArgs.ErrorChanLen)
 	s.status = CHANNEL_MANAGER_STATUS_INITIALIZED
 	return true
 }
@@ -118,10 +139,10 @@ func (s *myChannelManager) ErrorChan() (chan error, error) {
 	}
 	return s.errorCh, nil
 }
-func (s *myChannelManager) ChannelLen() uint {
+func (s *myChannelManager) ChannelArgs() ChannelArgs {
 	s.m.RLock()
 	defer s.m.RUnlock()
-	return s.channelLen
+	return s.channelArgs
 }
 func (s *myChannelManager) Status() ChannelManagerStatus {
 	s.m.RLock()
@@ -131,15 +152,30 @@ func (s *myChannelManager) Status() ChannelManagerStatus {
 func (s *myChannelManager) Summary() string {
 	s.m.RLock()
 	defer s.m.RUnlock()
-	return fmt.Sprintf("status:%s", "reqCh:%d/%d", "respCh:%d/%d", "itemCh:%d/%d", "errorCh:%s/%s",
-		s.status, len(s.reqCh), cap(s.reqCh), len(s.respCh), cap(s.respCh), len(s.itemCh), cap(s.itemCh), len(s.errorCh), cap(s.errorCh))
+	statusName, ok := statusNameMap[s.status]
+	if !ok {
+		statusName = fmt.Sprintf("%d", s.status)
+	}
+	return fmt.Sprintf("status:%s, reqCh:%d/%d, respCh:%d/%d, itemCh:%d/%d, errorCh:%d/%d",
+		statusName, len(s.reqCh), cap(s.reqCh), len(s.respCh), cap(s.respCh), len(s.itemCh), cap(s.itemCh), len(s.errorCh), cap(s.errorCh))
 }
-func NewChannelManager(channelLen uint) ChannelManager {
-	if channelLen <= 0 {
-		channelLen = defaultChanLen
+
+// 长度为0的通道使用默认长度
+func NewChannelManager(channelArgs ChannelArgs) ChannelManager {
+	if channelArgs.ReqChanLen == 0 {
+		channelArgs.ReqChanLen = defaultChanLen
+	}
+	if channelArgs.RespChanLen == 0 {
+		channelArgs.RespChanLen = defaultChanLen
+	}
+	if channelArgs.ItemChanLen == 0 {
+		channelArgs.ItemChanLen = defaultChanLen
+	}
+	if channelArgs.ErrorChanLen == 0 {
+		channelArgs.ErrorChanLen = defaultChanLen
 	}
 	chanman := &myChannelManager{}
-	chanman.Init(channelLen, true)
+	chanman.Init(channelArgs, true)
 	return chanman
 }
 
@@ -202,14 +238,14 @@ func (s *myPool) Take() (Entity, error) {
 	if !ok {
 		return nil, errors.New("The inner container is invalid!")
 	}
-	s.idContainer[e.Id()] = false
+	s.optidContianer(e.Id(), true, false)
 	return e, nil
 }
 func (s *myPool) Total() uint32 {
 	return s.total
 }
 func (s *myPool) Used() uint32 {
-	return uint32(len(s.container))
+	return s.total - uint32(len(s.container))
 }
 func (s *myPool) Return(e Entity) error {
 	if e == nil {
@@ -256,6 +292,9 @@ func NewPool(total uint32, entityType reflect.Type, genEntity func() Entity) (Po
 		if entityType != reflect.TypeOf(newEntity) {
 			return nil, errors.New(fmt.Sprintf("The Type of given is not real type -> %v\n", entityType))
 		}
+		if _, ok := idContainer[newEntity.Id()]; ok {
+			return nil, errors.New(fmt.Sprintf("The entity id %d is duplicated!\n", newEntity.Id()))
+		}
 		container <- newEntity
 		idContainer[newEntity.Id()] = true
 	}
@@ -289,7 +328,11 @@ type myStopSign struct {
 func (s *myStopSign) DealTotal() uint32 {
 	s.m.RLock()
 	defer s.m.RUnlock()
-	return uint32(len(s.dealCountMap))
+	var total uint32
+	for _, v := range s.dealCountMap {
+		total += v
+	}
+	return total
 }
 func (s *myStopSign) DealCount(code string) uint32 {
 	s.m.RLock()
@@ -301,7 +344,24 @@ func (s *myStopSign) DealCount(code string) uint32 {
 	return v
 }
 func (s *myStopSign) Summary() string {
-	return ""
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if !s.signed {
+		return "signed:false"
+	}
+	codes := make([]string, 0, len(s.dealCountMap))
+	for code := range s.dealCountMap {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	var buf bytes.Buffer
+	for i, code := range codes {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString(fmt.Sprintf("%s:%d", code, s.dealCountMap[code]))
+	}
+	return fmt.Sprintf("signed:true,dealCount:{%s}", buf.String())
 }
 func (s *myStopSign) Reset() {
 	s.m.Lock()
@@ -319,6 +379,8 @@ func (s *myStopSign) Sign() bool {
 	return true
 }
 func (s *myStopSign) Signed() bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
 	return s.signed
 }
 func (s *myStopSign) Deal(codeSting string) {
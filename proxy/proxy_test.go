@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T, cfg Config) Pool {
+	t.Helper()
+	pool, err := NewPool(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func pick(t *testing.T, pool Pool, rawUrl string) string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, rawUrl, nil)
+	proxy, err := pool.Pick(req)
+	if err != nil {
+		t.Fatalf("Pick(%s) = %v", rawUrl, err)
+	}
+	return proxy.Host
+}
+
+func TestRotation(t *testing.T) {
+	cases := []struct {
+		rotation string
+		urls     []string // 依次请求的url
+		want     string   // 依次选择的代理
+	}{
+		{ROTATION_ROUND_ROBIN, []string{"http://a.com/", "http://a.com/", "http://b.com/", "http://a.com/"}, "[p1:80 p2:80 p3:80 p1:80]"},
+		{"", []string{"http://a.com/", "http://b.com/"}, "[p1:80 p2:80]"},
+		{ROTATION_STICKY, []string{"http://a.com/", "http://b.com/", "http://A.com/x", "http://b.com/y", "http://c.com/"}, "[p1:80 p2:80 p1:80 p2:80 p3:80]"},
+	}
+	for _, c := range cases {
+		// 重复的代理只保留一个
+		pool := newTestPool(t, Config{URLs: []string{"p1:80", "http://p2:80", "p3:80", "p1:80"}, Rotation: c.rotation})
+		picked := make([]string, 0)
+		for _, rawUrl := range c.urls {
+			picked = append(picked, pick(t, pool, rawUrl))
+		}
+		if fmt.Sprint(picked) != c.want {
+			t.Errorf("%q: picked %v; want %s", c.rotation, picked, c.want)
+		}
+	}
+}
+
+func TestBanThreshold(t *testing.T) {
+	failure := errors.New("connection refused")
+	cases := []struct {
+		name    string
+		codes   []int     // FailureStatusCodes
+		reports []int     // 依次报告的状态码, 0表示网络错误, 200表示成功
+		bans    uint64    // 期望的禁用次数
+		stat    [3]uint64 // 期望的请求 成功 失败次数
+	}{
+		{"407", nil, []int{407, 407, 407}, 1, [3]uint64{3, 0, 3}},
+		{"network errors", nil, []int{0, 0, 0}, 1, [3]uint64{3, 0, 3}},
+		{"reset by success", nil, []int{407, 407, 200, 407, 407}, 0, [3]uint64{5, 1, 4}},
+		{"twice", nil, []int{0, 0, 0, 0, 0, 0}, 2, [3]uint64{6, 0, 6}},
+		// 目标网站的限流不算代理失败
+		{"429", nil, []int{429, 429, 429, 429}, 0, [3]uint64{4, 4, 0}},
+		{"5xx", nil, []int{500, 503, 502}, 0, [3]uint64{3, 3, 0}},
+		{"custom codes", []int{429}, []int{429, 429, 429}, 1, [3]uint64{3, 0, 3}},
+		{"custom codes without 407", []int{429}, []int{407, 407, 407}, 0, [3]uint64{3, 3, 0}},
+	}
+	for _, c := range cases {
+		pool := newTestPool(t, Config{URLs: []string{"p1:80", "p2:80"}, FailureStatusCodes: c.codes})
+		proxy, _ := Parse("p1:80")
+		for _, code := range c.reports {
+			switch code {
+			case 0:
+				pool.Report(proxy, time.Millisecond, nil, failure)
+			default:
+				pool.Report(proxy, time.Millisecond, &http.Response{StatusCode: code}, nil)
+			}
+		}
+		stat := pool.Stats()[0]
+		if stat.Bans != c.bans || [3]uint64{stat.Requests, stat.Successes, stat.Failures} != c.stat {
+			t.Errorf("%s: stat %s; want bans:%d, requests successes failures %v", c.name, stat, c.bans, c.stat)
+		}
+		if banned := !stat.BannedUntil.IsZero(); banned != (c.bans > 0) {
+			t.Errorf("%s: banned %v; want %v", c.name, banned, c.bans > 0)
+		}
+		// 被禁用的代理不会被选择
+		if c.bans > 0 {
+			for i := 0; i < 3; i++ {
+				if host := pick(t, pool, "http://a.com/"); host != "p2:80" {
+					t.Errorf("%s: picked %s while p1:80 is banned", c.name, host)
+				}
+			}
+		}
+	}
+}
+
+func TestUnban(t *testing.T) {
+	const banTime = 100 * time.Millisecond
+	pool := newTestPool(t, Config{URLs: []string{"p1:80", "p2:80"}, MaxFailures: 1, BanTime: banTime, Rotation: ROTATION_STICKY})
+	if host := pick(t, pool, "http://a.com/"); host != "p1:80" {
+		t.Fatalf("picked %s; want p1:80", host)
+	}
+	for _, raw := range []string{"p1:80", "p2:80"} {
+		proxy, _ := Parse(raw)
+		pool.Report(proxy, 0, nil, errors.New("timeout"))
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://a.com/", nil)
+	if proxy, err := pool.Pick(req); err != ErrNoProxy {
+		t.Fatalf("Pick() = %v, %v while all proxies are banned; want ErrNoProxy", proxy, err)
+	}
+	if temporary, ok := ErrNoProxy.(interface{ Temporary() bool }); !ok || !temporary.Temporary() {
+		t.Error("ErrNoProxy should be temporary")
+	}
+	time.Sleep(banTime + 20*time.Millisecond)
+	for _, stat := range pool.Stats() {
+		if !stat.BannedUntil.IsZero() || stat.Bans != 1 {
+			t.Errorf("stat %s after the ban time", stat)
+		}
+	}
+	// 解禁后主机仍然使用原来的代理
+	if host := pick(t, pool, "http://a.com/"); host != "p1:80" {
+		t.Errorf("picked %s after the ban time; want p1:80", host)
+	}
+}
+
+// 经过两个代理发送请求, 返回407的代理被禁用后请求都经过另一个
+func TestTransport(t *testing.T) {
+	var m sync.Mutex
+	received := make(map[string]int)
+	newProxy := func(name string, status int) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.Lock()
+			received[name]++
+			m.Unlock()
+			// 代理收到的是完整的url
+			if r.URL.Host != "target.test" {
+				t.Errorf("%s received %s", name, r.URL)
+			}
+			w.WriteHeader(status)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	bad, good := newProxy("bad", http.StatusProxyAuthRequired), newProxy("good", http.StatusOK)
+	pool := newTestPool(t, Config{URLs: []string{bad.URL, good.URL}})
+	client := &http.Client{Transport: pool.Transport(&http.Transport{})}
+	codes := make([]int, 0)
+	for i := 0; i < 8; i++ {
+		resp, err := client.Get("http://target.test/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		codes = append(codes, resp.StatusCode)
+	}
+	if want := "[407 200 407 200 407 200 200 200]"; fmt.Sprint(codes) != want {
+		t.Errorf("status codes %v; want %s", codes, want)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if received["bad"] != DefaultMaxFailures || received["good"] != 5 {
+		t.Errorf("proxies received %v; want bad:%d good:5", received, DefaultMaxFailures)
+	}
+	badUrl, _ := url.Parse(bad.URL)
+	if stat := pool.Stats()[0]; stat.URL != badUrl.Redacted() || stat.Bans != 1 {
+		t.Errorf("stat %s; want %s banned once", stat, bad.URL)
+	}
+}
@@ -0,0 +1,191 @@
+package publicsuffix
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/idna"
+)
+
+// 内置的公共后缀列表, 来自 https://publicsuffix.org/list/public_suffix_list.dat
+//
+//go:embed public_suffix_list.dat
+var embeddedList string
+
+// 规则类型
+const (
+	ruleNormal    byte = 1 // com
+	ruleWildcard  byte = 2 // *.ck
+	ruleException byte = 3 // !www.ck
+)
+
+type rule struct {
+	kind  byte
+	icann bool // 属于ICANN部分而不是PRIVATE部分
+}
+
+// 公共后缀列表
+type List struct {
+	normal    map[string]rule
+	wildcard  map[string]rule // key为去掉"*."的部分
+	exception map[string]rule // key为去掉"!"的部分
+}
+
+// 解析公共后缀列表, 格式见 https://publicsuffix.org/list/
+func Parse(r io.Reader) (*List, error) {
+	list := &List{
+		normal:    make(map[string]rule),
+		wildcard:  make(map[string]rule),
+		exception: make(map[string]rule),
+	}
+	icann := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.Contains(line, "===BEGIN ICANN DOMAINS===") {
+			icann = true
+			continue
+		}
+		if strings.Contains(line, "===END ICANN DOMAINS===") {
+			icann = false
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		// 规则以第一个空白结束
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			line = line[:i]
+		}
+		kind := ruleNormal
+		switch {
+		case strings.HasPrefix(line, "!"):
+			kind = ruleException
+			line = line[1:]
+		case strings.HasPrefix(line, "*."):
+			kind = ruleWildcard
+			line = line[2:]
+		}
+		name, err := toASCII(line)
+		if err != nil {
+			continue
+		}
+		r := rule{kind: kind, icann: icann}
+		switch kind {
+		case ruleNormal:
+			list.normal[name] = r
+		case ruleWildcard:
+			list.wildcard[name] = r
+		case ruleException:
+			list.exception[name] = r
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(list.normal) == 0 && len(list.wildcard) == 0 {
+		return nil, errors.New("The public suffix list is empty!")
+	}
+	return list, nil
+}
+
+// 从本地文件加载公共后缀列表, 用于更新内置的列表
+func LoadFile(path string) (*List, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(file)
+}
+
+var (
+	defaultList *List
+	defaultErr  error
+	defaultOnce sync.Once
+)
+
+// 内置的公共后缀列表
+func Default() *List {
+	defaultOnce.Do(func() {
+		defaultList, defaultErr = Parse(strings.NewReader(embeddedList))
+	})
+	if defaultErr != nil {
+		panic(defaultErr)
+	}
+	return defaultList
+}
+
+// 返回域名的公共后缀, 没有匹配的规则时使用最后一个标签
+func (s *List) PublicSuffix(domain string) (suffix string, icann bool) {
+	domain = normalize(domain)
+	labels := strings.Split(domain, ".")
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		if r, ok := s.exception[candidate]; ok {
+			return strings.Join(labels[i+1:], "."), r.icann
+		}
+		if r, ok := s.normal[candidate]; ok {
+			return candidate, r.icann
+		}
+		if i+1 < len(labels) {
+			if r, ok := s.wildcard[strings.Join(labels[i+1:], ".")]; ok {
+				return candidate, r.icann
+			}
+		}
+	}
+	return labels[len(labels)-1], false
+}
+
+// 返回可注册域名(eTLD+1), 如 www.example.co.uk -> example.co.uk
+func (s *List) EffectiveTLDPlusOne(domain string) (string, error) {
+	domain = normalize(domain)
+	if domain == "" || strings.HasPrefix(domain, ".") || strings.Contains(domain, "..") {
+		return "", errors.New(fmt.Sprintf("The domain %q is invalid!", domain))
+	}
+	if net.ParseIP(domain) != nil {
+		return "", errors.New(fmt.Sprintf("The domain %q is an ip address!", domain))
+	}
+	suffix, _ := s.PublicSuffix(domain)
+	if len(domain) <= len(suffix) {
+		return "", errors.New(fmt.Sprintf("The domain %q is a public suffix!", domain))
+	}
+	i := len(domain) - len(suffix) - 1
+	if domain[i] != '.' {
+		return "", errors.New(fmt.Sprintf("The domain %q is invalid!", domain))
+	}
+	return domain[1+strings.LastIndex(domain[:i], "."):], nil
+}
+
+// 使用内置列表
+func PublicSuffix(domain string) (string, bool) {
+	return Default().PublicSuffix(domain)
+}
+
+// 使用内置列表
+func EffectiveTLDPlusOne(domain string) (string, error) {
+	return Default().EffectiveTLDPlusOne(domain)
+}
+
+func normalize(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if ascii, err := toASCII(domain); err == nil {
+		return ascii
+	}
+	return domain
+}
+func toASCII(domain string) (string, error) {
+	for i := 0; i < len(domain); i++ {
+		if domain[i] >= 0x80 {
+			return idna.ToASCII(domain)
+		}
+	}
+	return domain, nil
+}
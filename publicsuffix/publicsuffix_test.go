@@ -0,0 +1,106 @@
+package publicsuffix
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPublicSuffix(t *testing.T) {
+	cases := []struct {
+		domain string
+		suffix string
+		icann  bool
+	}{
+		{"example.com", "com", true},
+		{"www.example.co.uk", "co.uk", true},
+		{"WWW.Example.COM.", "com", true},
+		{"foo.bar.ck", "bar.ck", true}, // *.ck
+		{"www.ck", "ck", true},         // !www.ck
+		{"a.b.kawasaki.jp", "b.kawasaki.jp", true},
+		{"city.kawasaki.jp", "kawasaki.jp", true},
+		{"user.github.io", "github.io", false},
+		{"example.unknowntld", "unknowntld", false},
+		{"例子.中国", "xn--fiqs8s", true},
+	}
+	for _, c := range cases {
+		suffix, icann := PublicSuffix(c.domain)
+		if suffix != c.suffix || icann != c.icann {
+			t.Errorf("PublicSuffix(%q) = %q, %v; want %q, %v", c.domain, suffix, icann, c.suffix, c.icann)
+		}
+	}
+}
+
+func TestEffectiveTLDPlusOne(t *testing.T) {
+	cases := []struct {
+		domain string
+		etld1  string // 为空时应该返回错误
+	}{
+		{"example.com", "example.com"},
+		{"www.example.com", "example.com"},
+		{"a.b.example.co.uk", "example.co.uk"},
+		{"foo.bar.ck", "foo.bar.ck"},
+		{"x.foo.bar.ck", "foo.bar.ck"},
+		{"www.ck", "www.ck"},
+		{"a.www.ck", "www.ck"},
+		{"city.kawasaki.jp", "city.kawasaki.jp"},
+		{"www.city.kawasaki.jp", "city.kawasaki.jp"},
+		{"user.github.io", "user.github.io"},
+		{"blog.user.github.io", "user.github.io"},
+		{"www.例子.中国", "xn--fsqu00a.xn--fiqs8s"},
+		{"com", ""},
+		{"co.uk", ""},
+		{"bar.ck", ""},
+		{"github.io", ""},
+		{"", ""},
+		{".example.com", ""},
+		{"a..example.com", ""},
+		{"127.0.0.1", ""},
+	}
+	for _, c := range cases {
+		etld1, err := EffectiveTLDPlusOne(c.domain)
+		if c.etld1 == "" {
+			if err == nil {
+				t.Errorf("EffectiveTLDPlusOne(%q) = %q; want error", c.domain, etld1)
+			}
+			continue
+		}
+		if err != nil || etld1 != c.etld1 {
+			t.Errorf("EffectiveTLDPlusOne(%q) = %q, %v; want %q", c.domain, etld1, err, c.etld1)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	list, err := Parse(strings.NewReader(`// comment
+// ===BEGIN ICANN DOMAINS===
+test
+*.wild.test
+!keep.wild.test
+// ===END ICANN DOMAINS===
+// ===BEGIN PRIVATE DOMAINS===
+private.test  trailing text is ignored
+// ===END PRIVATE DOMAINS===
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		domain string
+		suffix string
+		icann  bool
+	}{
+		{"a.test", "test", true},
+		{"a.b.wild.test", "b.wild.test", true},
+		{"a.keep.wild.test", "wild.test", true},
+		{"a.private.test", "private.test", false},
+	}
+	for _, c := range cases {
+		suffix, icann := list.PublicSuffix(c.domain)
+		if suffix != c.suffix || icann != c.icann {
+			t.Errorf("PublicSuffix(%q) = %q, %v; want %q, %v", c.domain, suffix, icann, c.suffix, c.icann)
+		}
+	}
+	if _, err := Parse(strings.NewReader("// only comments\n")); err == nil {
+		t.Error("Parse of an empty list should fail")
+	}
+}
@@ -0,0 +1,317 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 一次请求和它的响应, 存档中每行一个
+type Fixture struct {
+	Method        string        `json:"method"`
+	URL           string        `json:"url"`
+	RequestHeader http.Header   `json:"request_header"`
+	RequestBody   []byte        `json:"request_body,omitempty"`
+	StatusCode    int           `json:"status_code,omitempty"`
+	Header        http.Header   `json:"header,omitempty"`
+	Body          []byte        `json:"body,omitempty"`
+	Error         string        `json:"error,omitempty"` // 请求失败时的错误, 此时没有响应
+	Started       time.Time     `json:"started"`
+	Duration      time.Duration `json:"duration"` // 从发送请求到读完响应体
+}
+
+// 回放时匹配请求的key: 方法 url和请求体的哈希
+func (s *Fixture) key() string {
+	return fixtureKey(s.Method, s.URL, s.RequestBody)
+}
+
+func fixtureKey(method string, url string, body []byte) string {
+	if method == "" {
+		method = http.MethodGet
+	}
+	key := method + " " + url
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		key += " " + hex.EncodeToString(sum[:8])
+	}
+	return key
+}
+
+// 读出请求体并换成可以重复读取的副本
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// 记录经过的所有请求和响应, 写入存档文件 (并发安全)
+// 文件名以.gz结尾时用gzip压缩; 响应体会被完整读入内存后再交给调用者
+type Recorder interface {
+	// 包装base(为空时使用http.DefaultTransport), 经过它的请求都被记录
+	Wrap(base http.RoundTripper) http.RoundTripper
+	// 已经记录的数量
+	Count() uint64
+	Close() error
+}
+
+type myRecorder struct {
+	file   *os.File
+	gz     *gzip.Writer
+	writer *bufio.Writer
+	count  uint64
+	closed bool
+	m      sync.Mutex
+}
+
+// 创建存档文件, 已有的文件会被覆盖
+func NewRecorder(path string) (Recorder, error) {
+	if path == "" {
+		return nil, errors.New("The fixture archive path is empty!")
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Occur error when create fixture archive %s :%s", path, err))
+	}
+	s := &myRecorder{file: file}
+	if strings.HasSuffix(path, ".gz") {
+		s.gz = gzip.NewWriter(file)
+		s.writer = bufio.NewWriter(s.gz)
+	} else {
+		s.writer = bufio.NewWriter(file)
+	}
+	return s, nil
+}
+
+func (s *myRecorder) Wrap(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &recordingTransport{recorder: s, base: base}
+}
+func (s *myRecorder) Count() uint64 {
+	return atomic.LoadUint64(&s.count)
+}
+
+func (s *myRecorder) write(fixture *Fixture) error {
+	data, err := json.Marshal(fixture)
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return errors.New("The fixture recorder is closed!")
+	}
+	if _, err := s.writer.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.count, 1)
+	return nil
+}
+
+func (s *myRecorder) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.writer.Flush()
+	if s.gz != nil {
+		if gzErr := s.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type recordingTransport struct {
+	recorder *myRecorder
+	base     http.RoundTripper
+}
+
+// 请求被取消时不记录; 写存档失败时返回错误, 避免存档缺少请求
+func (s *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	fixture := &Fixture{
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		RequestHeader: req.Header.Clone(),
+		RequestBody:   reqBody,
+		Started:       time.Now(),
+	}
+	resp, err := s.base.RoundTrip(req)
+	if err != nil {
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+		fixture.Error = err.Error()
+		fixture.Duration = time.Since(fixture.Started)
+		if writeErr := s.recorder.write(fixture); writeErr != nil {
+			return nil, writeErr
+		}
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	fixture.Duration = time.Since(fixture.Started)
+	fixture.StatusCode = resp.StatusCode
+	fixture.Header = resp.Header.Clone()
+	fixture.Body = body
+	if err := s.recorder.write(fixture); err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp, nil
+}
+
+// 读取存档中的所有记录, 文件名以.gz结尾时先解压
+func LoadFixtures(path string) ([]Fixture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	fixtures := make([]Fixture, 0)
+	decoder := json.NewDecoder(reader)
+	for {
+		var fixture Fixture
+		err := decoder.Decode(&fixture)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("The fixture [%d] in %s is invalid: %s", len(fixtures), path, err))
+		}
+		fixtures = append(fixtures, fixture)
+	}
+	return fixtures, nil
+}
+
+// 存档中没有匹配的记录时返回, 可以用errors.Is判断
+var ErrNoFixture = errors.New("No fixture matches the request!")
+
+// 回放时的请求错误, 只保留错误信息
+type ReplayedError struct {
+	Msg string
+}
+
+func (s *ReplayedError) Error() string {
+	return s.Msg
+}
+
+// 从记录回放响应的http.RoundTripper, 不访问网络 (并发安全)
+// 同一个请求有多条记录时按记录的顺序返回, 用完后一直返回最后一条
+type Replayer struct {
+	keepTiming bool
+	fixtures   map[string][]*Fixture
+	next       map[string]int
+	misses     uint64
+	m          sync.Mutex
+}
+
+// keepTiming为true时按记录的时长等待后再返回响应
+func NewReplayer(fixtures []Fixture, keepTiming bool) *Replayer {
+	s := &Replayer{
+		keepTiming: keepTiming,
+		fixtures:   make(map[string][]*Fixture),
+		next:       make(map[string]int),
+	}
+	for i := range fixtures {
+		fixture := &fixtures[i]
+		s.fixtures[fixture.key()] = append(s.fixtures[fixture.key()], fixture)
+	}
+	return s
+}
+
+// 没有匹配记录的请求数
+func (s *Replayer) Misses() uint64 {
+	return atomic.LoadUint64(&s.misses)
+}
+
+func (s *Replayer) pick(key string) *Fixture {
+	s.m.Lock()
+	defer s.m.Unlock()
+	fixtures := s.fixtures[key]
+	if len(fixtures) == 0 {
+		return nil
+	}
+	i := s.next[key]
+	if i < len(fixtures)-1 {
+		s.next[key] = i + 1
+	}
+	return fixtures[i]
+}
+
+func (s *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	fixture := s.pick(fixtureKey(req.Method, req.URL.String(), reqBody))
+	if fixture == nil {
+		atomic.AddUint64(&s.misses, 1)
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL, ErrNoFixture)
+	}
+	if s.keepTiming && fixture.Duration > 0 {
+		timer := time.NewTimer(fixture.Duration)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	if fixture.Error != "" {
+		return nil, &ReplayedError{Msg: fixture.Error}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", fixture.StatusCode, http.StatusText(fixture.StatusCode)),
+		StatusCode:    fixture.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        fixture.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(fixture.Body)),
+		ContentLength: int64(len(fixture.Body)),
+		Request:       req,
+	}, nil
+}
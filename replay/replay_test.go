@@ -0,0 +1,194 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 测试用的源站, 回放时已经关闭
+func newOrigin(t *testing.T) *httptest.Server {
+	var m sync.Mutex
+	count := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("X-Test", "page")
+			fmt.Fprint(w, "page")
+		case "/echo":
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s", r.Method, body)
+		case "/count":
+			m.Lock()
+			count++
+			n := count
+			m.Unlock()
+			fmt.Fprint(w, n)
+		case "/close":
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+type exchange struct {
+	status int
+	header string // X-Test头
+	body   string
+	err    string // 请求失败时的错误, 不含url
+}
+
+func send(client *http.Client, method string, rawUrl string, body string) exchange {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, _ := http.NewRequest(method, rawUrl, reader)
+	resp, err := client.Do(req)
+	if err != nil {
+		return exchange{err: errors.Unwrap(err).Error()}
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return exchange{status: resp.StatusCode, header: resp.Header.Get("X-Test"), body: string(data)}
+}
+
+// 记录后关闭源站回放, 得到相同的响应
+func TestRecordReplay(t *testing.T) {
+	calls := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodGet, "/page", ""},
+		{http.MethodPost, "/echo", "a"},
+		{http.MethodPost, "/echo", "b"},
+		{http.MethodGet, "/count", ""},
+		{http.MethodGet, "/count", ""},
+		{http.MethodGet, "/missing", ""},
+		{http.MethodGet, "/close", ""},
+	}
+	for _, name := range []string{"fixtures.jsonl", "fixtures.jsonl.gz"} {
+		srv := newOrigin(t)
+		path := filepath.Join(t.TempDir(), name)
+		recorder, err := NewRecorder(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: recorder.Wrap(nil)}
+		recorded := make([]exchange, 0)
+		for _, c := range calls {
+			recorded = append(recorded, send(client, c.method, srv.URL+c.path, c.body))
+		}
+		if err := recorder.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if recorder.Count() != uint64(len(calls)) {
+			t.Errorf("%s: Count() = %d; want %d", name, recorder.Count(), len(calls))
+		}
+		if recorded[6].err == "" || recorded[4].body != "2" {
+			t.Fatalf("%s: unexpected origin responses %v", name, recorded)
+		}
+		srv.Close()
+
+		fixtures, err := LoadFixtures(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fixtures) != len(calls) {
+			t.Fatalf("%s: loaded %d fixtures; want %d", name, len(fixtures), len(calls))
+		}
+		replayer := NewReplayer(fixtures, false)
+		client = &http.Client{Transport: replayer}
+		for i, c := range calls {
+			if got := send(client, c.method, srv.URL+c.path, c.body); got != recorded[i] {
+				t.Errorf("%s: replay %s %s = %+v; want %+v", name, c.method, c.path, got, recorded[i])
+			}
+		}
+		// 同一个请求的记录用完后一直返回最后一条
+		if got := send(client, http.MethodGet, srv.URL+"/count", ""); got.body != "2" {
+			t.Errorf("%s: replay /count again = %+v; want the last fixture", name, got)
+		}
+		if replayer.Misses() != 0 {
+			t.Errorf("%s: Misses() = %d; want 0", name, replayer.Misses())
+		}
+	}
+}
+
+// 没有记录的请求不访问网络, 返回ErrNoFixture
+func TestReplayMiss(t *testing.T) {
+	var hits uint32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&hits, 1)
+	}))
+	defer srv.Close()
+	fixtures := []Fixture{
+		{Method: http.MethodGet, URL: srv.URL + "/page", StatusCode: http.StatusOK, Body: []byte("page")},
+		{Method: http.MethodPost, URL: srv.URL + "/form", RequestBody: []byte("a=1"), StatusCode: http.StatusOK},
+	}
+	replayer := NewReplayer(fixtures, false)
+	client := &http.Client{Transport: replayer}
+	cases := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodGet, "/other", ""},
+		{http.MethodHead, "/page", ""},
+		{http.MethodGet, "/page?x=1", ""},
+		{http.MethodPost, "/form", "a=2"},
+		{http.MethodPost, "/form", ""},
+	}
+	for i, c := range cases {
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, strings.NewReader(c.body))
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !errors.Is(err, ErrNoFixture) {
+			t.Errorf("%s %s (%q) error = %v; want ErrNoFixture", c.method, c.path, c.body, err)
+		}
+		if replayer.Misses() != uint64(i+1) {
+			t.Errorf("Misses() = %d after %d misses", replayer.Misses(), i+1)
+		}
+	}
+	if hits := atomic.LoadUint32(&hits); hits != 0 {
+		t.Errorf("the origin received %d requests while replaying", hits)
+	}
+	if got := send(client, http.MethodPost, srv.URL+"/form", "a=1"); got.status != http.StatusOK {
+		t.Errorf("replay of the recorded form = %+v", got)
+	}
+}
+
+// 按记录的时长等待, 等待时可以取消
+func TestReplayKeepTiming(t *testing.T) {
+	const duration = 100 * time.Millisecond
+	fixtures := []Fixture{{Method: http.MethodGet, URL: "http://example.com/", StatusCode: http.StatusOK, Duration: duration}}
+	client := &http.Client{Transport: NewReplayer(fixtures, true)}
+	start := time.Now()
+	if got := send(client, http.MethodGet, "http://example.com/", ""); got.status != http.StatusOK {
+		t.Fatalf("replay = %+v", got)
+	}
+	if d := time.Since(start); d < duration {
+		t.Errorf("replay took %s; want at least %s", d, duration)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/", nil)
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("canceled replay error = %v; want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,114 @@
+package robots
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTTL = 24 * time.Hour
+	// 无法访问时的缓存时间, 避免每个请求都重新获取
+	DefaultErrorTTL = time.Minute
+)
+
+// 获取robots.txt, 返回解析结果和响应的状态码
+type Fetch func(ctx context.Context) (*Robots, int, error)
+
+// 获取robots.txt时panic, 等待同一个站点的调用者得到这个错误
+var errFetchPanicked = errors.New("The robots.txt fetch panicked!")
+
+// 按站点缓存robots.txt (并发安全)
+// 同一个站点同时只获取一次, 其它调用者等待获取的结果
+type Cache struct {
+	ttl     time.Duration
+	errTTL  time.Duration
+	entries map[string]*entry
+	m       sync.Mutex
+}
+
+type entry struct {
+	ready   chan struct{} // 获取完成后关闭
+	robots  *Robots
+	err     error
+	expires time.Time
+}
+
+func (s *entry) done() bool {
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func NewCache(ttl time.Duration) *Cache {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	errTTL := DefaultErrorTTL
+	if errTTL > ttl {
+		errTTL = ttl
+	}
+	return &Cache{
+		ttl:     ttl,
+		errTTL:  errTTL,
+		entries: make(map[string]*entry),
+	}
+}
+
+// key一般为scheme://host, 缓存不存在或过期时调用fetch
+func (s *Cache) Get(ctx context.Context, key string, fetch Fetch) (*Robots, error) {
+	s.m.Lock()
+	e, ok := s.entries[key]
+	if ok && e.done() && time.Now().After(e.expires) {
+		ok = false
+	}
+	if !ok {
+		e = &entry{ready: make(chan struct{})}
+		s.entries[key] = e
+		s.m.Unlock()
+		return s.fetch(ctx, e, fetch)
+	}
+	s.m.Unlock()
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return e.robots, e.err
+}
+
+// fetch panic时也关闭ready, 这时的结果已经过期, 下次调用会重新获取
+func (s *Cache) fetch(ctx context.Context, e *entry, fetch Fetch) (*Robots, error) {
+	e.err = errFetchPanicked
+	defer close(e.ready)
+	robots, statusCode, err := fetch(ctx)
+	e.robots, e.err = robots, err
+	if err == nil && cacheable(statusCode) {
+		e.expires = time.Now().Add(s.ttl)
+	} else {
+		e.expires = time.Now().Add(s.errTTL)
+	}
+	return robots, err
+}
+
+// 无法访问时的缓存时间, 过期后才会重新获取
+func (s *Cache) ErrorTTL() time.Duration {
+	return s.errTTL
+}
+
+// 已缓存的站点数
+func (s *Cache) Len() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.entries)
+}
+
+// 只有2xx和4xx(429除外)的结果可以长期缓存
+func cacheable(statusCode int) bool {
+	return statusCode >= 200 && statusCode < 500 && statusCode != http.StatusTooManyRequests
+}
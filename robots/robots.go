@@ -0,0 +1,216 @@
+package robots
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// robots.txt最多读取的字节数, 见RFC 9309 2.5
+const MaxSize = 500 * 1024
+
+// 解析后的robots.txt, 见RFC 9309
+type Robots struct {
+	groups      []*group
+	sitemaps    []string
+	disallowAll bool
+}
+
+// 一组user-agent共用的规则
+type group struct {
+	agents     []string // 小写
+	rules      []rule
+	crawlDelay time.Duration
+	hasDelay   bool
+}
+
+type rule struct {
+	allow   bool
+	pattern string
+}
+
+// 允许所有路径, robots.txt不存在(4xx)时使用
+func AllowAll() *Robots {
+	return &Robots{}
+}
+
+// 禁止所有路径, robots.txt无法访问(5xx或网络错误)时使用
+func DisallowAll() *Robots {
+	return &Robots{disallowAll: true}
+}
+
+// robots.txt无法访问, 所有路径被暂时禁止
+func (s *Robots) Unreachable() bool {
+	return s.disallowAll
+}
+
+// 根据robots.txt的响应状态码解析, 429和5xx一样视为无法访问
+func FromResponse(statusCode int, body io.Reader) (*Robots, error) {
+	switch {
+	case statusCode >= 200 && statusCode < 300:
+		return Parse(body)
+	case statusCode >= 400 && statusCode < 500 && statusCode != http.StatusTooManyRequests:
+		return AllowAll(), nil
+	}
+	return DisallowAll(), nil
+}
+
+func Parse(r io.Reader) (*Robots, error) {
+	robots := &Robots{}
+	var current *group
+	scanner := bufio.NewScanner(io.LimitReader(r, MaxSize))
+	scanner.Buffer(make([]byte, 0, 4096), MaxSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		switch key {
+		case "user-agent":
+			// 连续的user-agent行属于同一组
+			if current == nil || len(current.rules) > 0 || current.hasDelay {
+				current = &group{}
+				robots.groups = append(robots.groups, current)
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			// 空的Disallow表示不禁止任何路径
+			if current == nil || value == "" {
+				continue
+			}
+			current.rules = append(current.rules, rule{allow: key == "allow", pattern: value})
+		case "crawl-delay":
+			if current == nil {
+				continue
+			}
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil || seconds < 0 {
+				continue
+			}
+			current.crawlDelay = time.Duration(seconds * float64(time.Second))
+			current.hasDelay = true
+		case "sitemap":
+			if value != "" {
+				robots.sitemaps = append(robots.sitemaps, value)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return robots, nil
+}
+
+// user-agent的产品名, 如 "MyBot/1.0 (+http://example.com)" -> "mybot"
+func ProductToken(userAgent string) string {
+	userAgent = strings.TrimSpace(userAgent)
+	end := strings.IndexFunc(userAgent, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' || r == '-')
+	})
+	if end >= 0 {
+		userAgent = userAgent[:end]
+	}
+	return strings.ToLower(userAgent)
+}
+
+// 适用于agent的组, 同名的组合并, 没有时使用*的组
+func (s *Robots) match(agent string) []*group {
+	token := ProductToken(agent)
+	matched := make([]*group, 0)
+	wildcard := make([]*group, 0)
+	for _, g := range s.groups {
+		for _, a := range g.agents {
+			if a == token && token != "" {
+				matched = append(matched, g)
+				break
+			}
+			if a == "*" {
+				wildcard = append(wildcard, g)
+				break
+			}
+		}
+	}
+	if len(matched) > 0 {
+		return matched
+	}
+	return wildcard
+}
+
+// path包括查询字符串, 应为编码后的形式; 匹配最长的规则, 长度相同时Allow优先
+func (s *Robots) Allowed(agent string, path string) bool {
+	if path == "" {
+		path = "/"
+	}
+	if path == "/robots.txt" {
+		return true
+	}
+	if s.disallowAll {
+		return false
+	}
+	allowed, longest := true, -1
+	for _, g := range s.match(agent) {
+		for _, r := range g.rules {
+			if !match(r.pattern, path) {
+				continue
+			}
+			if n := len(r.pattern); n > longest || (n == longest && r.allow) {
+				allowed, longest = r.allow, n
+			}
+		}
+	}
+	return allowed
+}
+
+// agent的Crawl-delay, 没有设置时返回false
+func (s *Robots) CrawlDelay(agent string) (time.Duration, bool) {
+	for _, g := range s.match(agent) {
+		if g.hasDelay {
+			return g.crawlDelay, true
+		}
+	}
+	return 0, false
+}
+
+// Sitemap行中的url
+func (s *Robots) Sitemaps() []string {
+	return s.sitemaps
+}
+
+// *匹配任意字符, 结尾的$匹配路径结束, 其它情况为前缀匹配
+func match(pattern string, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	pos := len(parts[0])
+	for i := 1; i < len(parts); i++ {
+		last := i == len(parts)-1
+		if last && anchored {
+			return len(path)-pos >= len(parts[i]) && strings.HasSuffix(path, parts[i])
+		}
+		j := strings.Index(path[pos:], parts[i])
+		if j < 0 {
+			return false
+		}
+		pos += j + len(parts[i])
+	}
+	return !anchored || pos == len(path)
+}
+
+// robots.txt的地址, 如 https://example.com/robots.txt
+func URL(scheme string, host string) string {
+	return scheme + "://" + host + "/robots.txt"
+}
@@ -0,0 +1,246 @@
+package robots
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRobots = `
+# comment
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+Disallow: /search*q=
+Allow: /page
+Disallow: /page
+Disallow:
+
+User-agent: MyBot
+User-agent: OtherBot
+Disallow: /mybot-only
+Crawl-delay: 2.5
+
+User-agent: mybot
+Allow: /private
+
+Sitemap: https://example.com/sitemap.xml
+`
+
+func TestAllowed(t *testing.T) {
+	rules, err := Parse(strings.NewReader(testRobots))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		agent   string
+		path    string
+		allowed bool
+	}{
+		{"SomeBot/1.0", "/", true},
+		{"SomeBot/1.0", "", true},
+		{"SomeBot/1.0", "/private", false},
+		{"SomeBot/1.0", "/private/secret", false},
+		{"SomeBot/1.0", "/private/public/a", true}, // 更长的Allow
+		{"SomeBot/1.0", "/privateer", false},       // 前缀匹配
+		{"SomeBot/1.0", "/doc.pdf", false},
+		{"SomeBot/1.0", "/dir/doc.pdf", false},
+		{"SomeBot/1.0", "/doc.pdf?download=1", true}, // $匹配结尾
+		{"SomeBot/1.0", "/doc.pdfx", true},
+		{"SomeBot/1.0", "/search?q=go", false},
+		{"SomeBot/1.0", "/search/all?lang=en&q=go", false},
+		{"SomeBot/1.0", "/search?lang=en", true},
+		{"SomeBot/1.0", "/page", true}, // 长度相同时Allow优先
+		{"SomeBot/1.0", "/robots.txt", true},
+		// 同名的组合并, 不再使用*的组
+		{"MyBot/2.0 (+http://example.com)", "/mybot-only", false},
+		{"MyBot/2.0 (+http://example.com)", "/private/x", true},
+		{"MyBot/2.0 (+http://example.com)", "/doc.pdf", true},
+		{"otherbot", "/private/x", true},
+		{"otherbot", "/mybot-only/a", false},
+	}
+	for _, c := range cases {
+		if allowed := rules.Allowed(c.agent, c.path); allowed != c.allowed {
+			t.Errorf("Allowed(%q, %q) = %v; want %v", c.agent, c.path, allowed, c.allowed)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		matched bool
+	}{
+		{"/", "/anything", true},
+		{"/a", "/a", true},
+		{"/a", "/ab", true},
+		{"/a", "/b", false},
+		{"/a$", "/a", true},
+		{"/a$", "/ab", false},
+		{"/*", "/x", true},
+		{"/*.php", "/index.php", true},
+		{"/*.php", "/index.php?x=1", true},
+		{"/*.php$", "/index.php?x=1", false},
+		{"/*.php$", "/a.php.php", true},
+		{"/a*b*c", "/axxbyyc", true},
+		{"/a*b*c", "/axxcyyb", false},
+		{"/a*b$", "/ab", true},
+		{"/a*bc$", "/abc", true},
+		{"/ab*b$", "/ab", false}, // 结尾的部分不能和前缀重叠
+		{"*", "/", true},
+		{"/$", "/", true},
+		{"/$", "/a", false},
+	}
+	for _, c := range cases {
+		if matched := match(c.pattern, c.path); matched != c.matched {
+			t.Errorf("match(%q, %q) = %v; want %v", c.pattern, c.path, matched, c.matched)
+		}
+	}
+}
+
+func TestCrawlDelayAndSitemaps(t *testing.T) {
+	rules, _ := Parse(strings.NewReader(testRobots))
+	if delay, ok := rules.CrawlDelay("mybot"); !ok || delay != 2500*time.Millisecond {
+		t.Errorf("CrawlDelay(mybot) = %v, %v; want 2.5s", delay, ok)
+	}
+	if _, ok := rules.CrawlDelay("somebot"); ok {
+		t.Error("CrawlDelay(somebot) should not be set")
+	}
+	if sitemaps := rules.Sitemaps(); len(sitemaps) != 1 || sitemaps[0] != "https://example.com/sitemap.xml" {
+		t.Errorf("Sitemaps() = %v", sitemaps)
+	}
+}
+
+func TestFromResponse(t *testing.T) {
+	cases := []struct {
+		statusCode  int
+		allowed     bool
+		unreachable bool
+	}{
+		{http.StatusOK, false, false},
+		{http.StatusNotFound, true, false},
+		{http.StatusForbidden, true, false},
+		{http.StatusTooManyRequests, false, true},
+		{http.StatusInternalServerError, false, true},
+		{http.StatusServiceUnavailable, false, true},
+	}
+	for _, c := range cases {
+		rules, err := FromResponse(c.statusCode, strings.NewReader("User-agent: *\nDisallow: /\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rules.Allowed("bot", "/a") != c.allowed || rules.Unreachable() != c.unreachable {
+			t.Errorf("FromResponse(%d): allowed %v, unreachable %v; want %v, %v",
+				c.statusCode, rules.Allowed("bot", "/a"), rules.Unreachable(), c.allowed, c.unreachable)
+		}
+	}
+}
+
+func TestProductToken(t *testing.T) {
+	cases := map[string]string{
+		"MyBot/1.0 (+http://example.com)": "mybot",
+		"  Google-Bot_x ":                 "google-bot_x",
+		"Mozilla/5.0":                     "mozilla",
+		"":                                "",
+	}
+	for agent, token := range cases {
+		if got := ProductToken(agent); got != token {
+			t.Errorf("ProductToken(%q) = %q; want %q", agent, got, token)
+		}
+	}
+}
+
+func TestCacheFetchesOnce(t *testing.T) {
+	cache := NewCache(time.Hour)
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (*Robots, int, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return AllowAll(), http.StatusOK, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.Get(context.Background(), "http://a.com", fetch); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("fetched %d times; want 1", n)
+	}
+	if cache.Len() != 1 {
+		t.Errorf("Len() = %d; want 1", cache.Len())
+	}
+}
+
+func TestCacheErrorTTL(t *testing.T) {
+	cache := NewCache(50 * time.Millisecond)
+	if cache.ErrorTTL() != 50*time.Millisecond {
+		t.Errorf("ErrorTTL() = %v; want it capped at the ttl", cache.ErrorTTL())
+	}
+	var fetches int32
+	fetch := func(ctx context.Context) (*Robots, int, error) {
+		atomic.AddInt32(&fetches, 1)
+		return nil, 0, errors.New("connection refused")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cache.Get(context.Background(), "http://a.com", fetch); err == nil {
+			t.Error("Get should return the fetch error")
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("fetched %d times before the error expired; want 1", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	cache.Get(context.Background(), "http://a.com", fetch)
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("fetched %d times after the error expired; want 2", n)
+	}
+}
+
+func TestCachePanicReleasesWaiters(t *testing.T) {
+	cache := NewCache(time.Hour)
+	started := make(chan struct{})
+	waiter := make(chan error, 1)
+	go func() {
+		<-started
+		_, err := cache.Get(context.Background(), "http://a.com", nil)
+		waiter <- err
+	}()
+	func() {
+		defer func() { recover() }()
+		cache.Get(context.Background(), "http://a.com", func(ctx context.Context) (*Robots, int, error) {
+			close(started)
+			time.Sleep(50 * time.Millisecond)
+			panic("boom")
+		})
+	}()
+	select {
+	case err := <-waiter:
+		if !errors.Is(err, errFetchPanicked) {
+			t.Errorf("waiter got %v; want errFetchPanicked", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiter is stuck after the fetch panicked")
+	}
+	rules, err := cache.Get(context.Background(), "http://a.com", func(ctx context.Context) (*Robots, int, error) {
+		return AllowAll(), http.StatusOK, nil
+	})
+	if err != nil || rules == nil {
+		t.Errorf("Get after a panic = %v, %v; want a new fetch", rules, err)
+	}
+}
@@ -0,0 +1,361 @@
+package scheduler
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"webcrawler/base"
+)
+
+// 请求缓存的状态
+var statusMap = map[byte]string{
+	0: "running",
+	1: "closed",
+}
+
+// 请求缓存(待爬取的url边界), 按策略决定出队顺序 (并发安全)
+type requestCache interface {
+	// key为规范化后的url, 关闭后仍然接受请求, 以便停止时保存到检查点
+	put(req *base.Request, key string) bool
+	// 按出队顺序取出第一个take返回true的请求, 其余的留在缓存中; take为空时取出第一个
+	get(take func(req *base.Request) bool) *base.Request
+	// 页面from已处理完, 发现了链接to, 只有opic策略使用; to为空时from的现金被丢弃
+	link(from string, to []string)
+	// 请求已处理完成(包括分析出的请求已经放进缓存), 只有共享队列使用
+	done(req *base.Request)
+	// 放回下载失败需要重试的请求, 在req.NotBefore()之前不会被取出
+	retry(req *base.Request, key string)
+	capacity() int
+	length() int
+	close()
+	summary() string
+	// 断点续爬: 按入队顺序导出所有请求和opic的现金, 导入时保留请求的分数
+	dump() ([]*frontierItem, map[string]float64)
+	load(items []*frontierItem, cash map[string]float64)
+}
+
+// 出队策略
+type FrontierStrategy string
+
+const (
+	FRONTIER_BFS        FrontierStrategy = "bfs"        // 深度小的先出队, 默认
+	FRONTIER_DFS        FrontierStrategy = "dfs"        // 深度大的先出队, 同深度后进先出
+	FRONTIER_BEST_FIRST FrontierStrategy = "best-first" // 分数高的先出队, 分数由ScoreFunc计算
+	FRONTIER_OPIC       FrontierStrategy = "opic"       // 从入链获得的现金多的先出队
+)
+
+func (s FrontierStrategy) valid() bool {
+	switch s {
+	case FRONTIER_BFS, FRONTIER_DFS, FRONTIER_BEST_FIRST, FRONTIER_OPIC:
+		return true
+	}
+	return false
+}
+
+// 给请求打分, 分数越高越先被下载
+type ScoreFunc func(req *base.Request) float64
+
+const (
+	opicSeedCash      = 1.0 // 种子的初始现金
+	frontierScanLimit = 256 // 一次取请求时最多跳过的请求数, 如主机都忙时不会扫描整个队列
+)
+
+type frontierItem struct {
+	req   *base.Request
+	key   string
+	score float64 // best-first为打分, opic为现金
+	seq   uint64  // 入队顺序
+	index int     // 在堆中的位置
+}
+
+// 基于堆的请求缓存
+// 除best-first外, 请求的优先级(base.Request.Priority)都先于策略本身比较
+type reqCacheByHeap struct {
+	strategy FrontierStrategy
+	score    ScoreFunc
+	items    []*frontierItem
+	pending  map[string]*frontierItem // opic: 在队列中的请求
+	cash     map[string]float64       // opic: 已取出还没有处理完的页面的现金
+	delayed  delayedItems             // 还没到重试时间的请求
+	retried  uint64
+	seq      uint64
+	m        sync.Mutex
+	status   byte // 0:运行中 1:已关闭
+}
+
+func newRequestCache(strategy FrontierStrategy, score ScoreFunc) requestCache {
+	if strategy == "" {
+		strategy = FRONTIER_BFS
+	}
+	if score == nil {
+		score = func(req *base.Request) float64 {
+			return float64(req.Priority())
+		}
+	}
+	s := &reqCacheByHeap{
+		strategy: strategy,
+		score:    score,
+		items:    make([]*frontierItem, 0),
+		delayed:  make(delayedItems, 0),
+	}
+	if strategy == FRONTIER_OPIC {
+		s.pending = make(map[string]*frontierItem)
+		s.cash = make(map[string]float64)
+	}
+	return s
+}
+
+func (s *reqCacheByHeap) put(req *base.Request, key string) bool {
+	if req == nil {
+		return false
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.seq++
+	item := &frontierItem{req: req, key: key, seq: s.seq}
+	if req.NotBefore().After(time.Now()) {
+		heap.Push(&s.delayed, item)
+		return true
+	}
+	s.push(item)
+	return true
+}
+
+// 调用时必须持有锁
+func (s *reqCacheByHeap) push(item *frontierItem) {
+	switch s.strategy {
+	case FRONTIER_BEST_FIRST:
+		item.score = s.score(item.req)
+	case FRONTIER_OPIC:
+		cash, ok := s.cash[item.key]
+		if !ok && item.req.Depth() == 0 {
+			cash = opicSeedCash
+		}
+		delete(s.cash, item.key)
+		item.score = cash
+		s.pending[item.key] = item
+	}
+	heap.Push(s, item)
+}
+
+// 把到了重试时间的请求放进队列, 调用时必须持有锁
+func (s *reqCacheByHeap) promote(now time.Time) {
+	for len(s.delayed) > 0 && !s.delayed[0].req.NotBefore().After(now) {
+		s.push(heap.Pop(&s.delayed).(*frontierItem))
+	}
+}
+func (s *reqCacheByHeap) retry(req *base.Request, key string) {
+	if s.put(req, key) {
+		s.m.Lock()
+		s.retried++
+		s.m.Unlock()
+	}
+}
+
+// 跳过的请求在返回前放回, 它们的顺序不变; take在持有锁时调用
+func (s *reqCacheByHeap) get(take func(req *base.Request) bool) *base.Request {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.status == 1 {
+		return nil
+	}
+	s.promote(time.Now())
+	skipped := make([]*frontierItem, 0)
+	defer func() {
+		for _, item := range skipped {
+			heap.Push(s, item)
+		}
+	}()
+	for len(s.items) > 0 && len(skipped) < frontierScanLimit {
+		item := heap.Pop(s).(*frontierItem)
+		if take != nil && !take(item.req) {
+			skipped = append(skipped, item)
+			continue
+		}
+		if s.strategy == FRONTIER_OPIC {
+			delete(s.pending, item.key)
+			// 留给link分给出链
+			s.cash[item.key] += item.score
+		}
+		return item.req
+	}
+	return nil
+}
+
+// OPIC: 把from的现金平分给to中还在队列中的请求并调整它们的位置
+// 已经爬取过或没有入队(被去重或范围排除)的链接不分现金, 避免现金留在不会再出队的url上
+func (s *reqCacheByHeap) link(from string, to []string) {
+	if s.strategy != FRONTIER_OPIC {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	cash := s.cash[from]
+	delete(s.cash, from)
+	if cash == 0 {
+		return
+	}
+	targets := make([]*frontierItem, 0, len(to))
+	for _, key := range to {
+		if item, ok := s.pending[key]; ok {
+			targets = append(targets, item)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	share := cash / float64(len(targets))
+	for _, item := range targets {
+		item.score += share
+		heap.Fix(s, item.index)
+	}
+}
+func (s *reqCacheByHeap) done(req *base.Request) {}
+func (s *reqCacheByHeap) capacity() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return cap(s.items)
+}
+func (s *reqCacheByHeap) length() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.items) + len(s.delayed)
+}
+func (s *reqCacheByHeap) close() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.status = 1
+}
+func (s *reqCacheByHeap) summary() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return fmt.Sprintf("status:%s,strategy:%s,length:%d,capacity:%d,delayed:%d,retried:%d",
+		statusMap[s.status], s.strategy, len(s.items), cap(s.items), len(s.delayed), s.retried)
+}
+
+func (s *reqCacheByHeap) dump() ([]*frontierItem, map[string]float64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	items := make([]*frontierItem, 0, len(s.items)+len(s.delayed))
+	for _, item := range s.items {
+		copied := *item
+		items = append(items, &copied)
+	}
+	for _, item := range s.delayed {
+		copied := *item
+		items = append(items, &copied)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].seq < items[j].seq
+	})
+	cash := make(map[string]float64, len(s.cash))
+	for key, value := range s.cash {
+		cash[key] = value
+	}
+	return items, cash
+}
+func (s *reqCacheByHeap) load(items []*frontierItem, cash map[string]float64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	now := time.Now()
+	for _, item := range items {
+		s.seq++
+		item.seq = s.seq
+		if item.req.NotBefore().After(now) {
+			heap.Push(&s.delayed, item)
+			continue
+		}
+		if s.strategy == FRONTIER_OPIC {
+			s.pending[item.key] = item
+		}
+		heap.Push(s, item)
+	}
+	if s.strategy == FRONTIER_OPIC {
+		for key, value := range cash {
+			s.cash[key] += value
+		}
+	}
+}
+
+// heap.Interface, 调用时必须持有锁
+func (s *reqCacheByHeap) Len() int {
+	return len(s.items)
+}
+func (s *reqCacheByHeap) Less(i, j int) bool {
+	a, b := s.items[i], s.items[j]
+	if s.strategy == FRONTIER_BEST_FIRST {
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		return a.seq < b.seq
+	}
+	if pa, pb := a.req.Priority(), b.req.Priority(); pa != pb {
+		return pa > pb
+	}
+	switch s.strategy {
+	case FRONTIER_DFS:
+		if da, db := a.req.Depth(), b.req.Depth(); da != db {
+			return da > db
+		}
+		return a.seq > b.seq
+	case FRONTIER_OPIC:
+		if a.score != b.score {
+			return a.score > b.score
+		}
+	default:
+		if da, db := a.req.Depth(), b.req.Depth(); da != db {
+			return da < db
+		}
+	}
+	return a.seq < b.seq
+}
+func (s *reqCacheByHeap) Swap(i, j int) {
+	s.items[i], s.items[j] = s.items[j], s.items[i]
+	s.items[i].index = i
+	s.items[j].index = j
+}
+func (s *reqCacheByHeap) Push(x interface{}) {
+	item := x.(*frontierItem)
+	item.index = len(s.items)
+	s.items = append(s.items, item)
+}
+func (s *reqCacheByHeap) Pop() interface{} {
+	n := len(s.items)
+	item := s.items[n-1]
+	s.items[n-1] = nil
+	s.items = s.items[:n-1]
+	return item
+}
+
+// 按重试时间排序的堆
+type delayedItems []*frontierItem
+
+func (s delayedItems) Len() int {
+	return len(s)
+}
+func (s delayedItems) Less(i, j int) bool {
+	if ti, tj := s[i].req.NotBefore(), s[j].req.NotBefore(); !ti.Equal(tj) {
+		return ti.Before(tj)
+	}
+	return s[i].seq < s[j].seq
+}
+func (s delayedItems) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+	s[i].index = i
+	s[j].index = j
+}
+func (s *delayedItems) Push(x interface{}) {
+	item := x.(*frontierItem)
+	item.index = len(*s)
+	*s = append(*s, item)
+}
+func (s *delayedItems) Pop() interface{} {
+	old := *s
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*s = old[:n-1]
+	return item
+}
@@ -0,0 +1,359 @@
+package scheduler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+	"webcrawler/base"
+	"webcrawler/dedup"
+
+	"github.com/bugfan/logrus"
+)
+
+const (
+	defaultCheckpointInterval = 5 * time.Minute
+	checkpointVersion         = 1
+	checkpointName            = "checkpoint" // 目录下最新的检查点, 写入时先写到.tmp再替换
+	checkpointStateFile       = "state.gob"
+	checkpointDedupFile       = "dedup.dat"
+)
+
+// 附加信息中的time.Time(如站点地图的lastmod)需要注册才能保存, 其它自定义类型需要调用者注册
+func init() {
+	gob.Register(time.Time{})
+}
+
+// 断点续爬配置
+type CheckpointConfig struct {
+	// 检查点目录, 为空时不保存
+	Dir string `json:"dir" yaml:"dir" toml:"dir"`
+	// 保存间隔, 0表示使用默认值, 停止时总会保存一次
+	Interval Duration `json:"interval" yaml:"interval" toml:"interval"`
+}
+
+func (s CheckpointConfig) interval() time.Duration {
+	if s.Interval <= 0 {
+		return defaultCheckpointInterval
+	}
+	return time.Duration(s.Interval)
+}
+
+// 检查点的内容
+type checkpointState struct {
+	Version    int
+	Time       time.Time
+	Requests   []savedRequest // 正在处理的 等待主机空闲的 请求缓存中的请求, 按此顺序
+	Cash       map[string]float64
+	Rejects    map[RejectReason]uint64
+	ItemCounts []uint64
+	Dedup      bool // 是否保存了去重器的快照
+	// 自身持久化的去重器(如磁盘去重器)不保存快照, 只记录路径和标记, 恢复时回滚到标记
+	DedupPath   string
+	DedupMarker uint64
+	dir         string
+}
+
+type savedRequest struct {
+	Method    string
+	URL       string
+	Header    http.Header
+	Body      []byte
+	Depth     uint32
+	Seed      string
+	Priority  int
+	Meta      map[string]interface{}
+	Key       string
+	Score     float64
+	Attempts  uint32
+	NotBefore time.Time
+}
+
+func newSavedRequest(req *base.Request, key string, score float64) (savedRequest, error) {
+	httpReq := req.HttpReq()
+	saved := savedRequest{
+		Method:    httpReq.Method,
+		URL:       httpReq.URL.String(),
+		Header:    httpReq.Header,
+		Depth:     req.Depth(),
+		Seed:      req.Seed(),
+		Priority:  req.Priority(),
+		Meta:      req.Metadata(),
+		Key:       key,
+		Score:     score,
+		Attempts:  req.Attempts(),
+		NotBefore: req.NotBefore(),
+	}
+	if httpReq.GetBody != nil {
+		body, err := httpReq.GetBody()
+		if err != nil {
+			return saved, err
+		}
+		defer body.Close()
+		if saved.Body, err = io.ReadAll(body); err != nil {
+			return saved, err
+		}
+	}
+	return saved, nil
+}
+func (s savedRequest) request() (*base.Request, error) {
+	var body io.Reader
+	if s.Body != nil {
+		body = bytes.NewReader(s.Body)
+	}
+	httpReq, err := http.NewRequest(s.Method, s.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	if s.Header != nil {
+		httpReq.Header = s.Header
+	}
+	req := base.NewRequest(httpReq, s.Depth)
+	req.SetSeed(s.Seed)
+	req.SetPriority(s.Priority)
+	req.SetAttempts(s.Attempts)
+	req.SetNotBefore(s.NotBefore)
+	for key, value := range s.Meta {
+		req.SetMeta(key, value)
+	}
+	return req, nil
+}
+
+// 正在处理的请求: 从发往请求通道到分析完成, 保存检查点时和缓存中的请求一起保存
+// 使用共享队列时完成后还要向共享队列确认
+func (s *myScheduler) trackInflight() bool {
+	return s.cfg.Checkpoint.Dir != "" || s.cfg.SharedFrontier != nil
+}
+func (s *myScheduler) startInflight(req *base.Request) {
+	if !s.trackInflight() {
+		return
+	}
+	key := s.canonicalizer.Key(req.HttpReq().URL)
+	s.inflightM.Lock()
+	defer s.inflightM.Unlock()
+	s.inflight[key] = req
+}
+
+// 请求处理完成, 不会再重试; opic策略丢弃它没有分给出链的现金
+// 停止时分析完的请求也已完成: 它的条目和出链在停止时仍会被处理, 恢复后不会重新下载
+func (s *myScheduler) finishInflight(req *base.Request) {
+	if req == nil || !req.Valid() {
+		return
+	}
+	key := s.canonicalizer.Key(req.HttpReq().URL)
+	s.reqCache.link(key, nil)
+	if !s.trackInflight() {
+		return
+	}
+	s.inflightM.Lock()
+	delete(s.inflight, key)
+	s.inflightM.Unlock()
+	s.reqCache.done(req)
+}
+
+// 暂停调度, 等待所有下载 分析和条目处理结束, 开始停止时返回false
+func (s *myScheduler) waitQuiet() bool {
+	for {
+		s.inflightM.Lock()
+		inflight := len(s.inflight)
+		s.inflightM.Unlock()
+		if inflight == 0 && atomic.LoadInt32(&s.downloading) == 0 && s.workers.count() == 0 && s.items.count() == 0 &&
+			s.itemPipeLine.ProcessingNumber() == 0 && len(s.getRespChan()) == 0 && len(s.getItemChan()) == 0 {
+			return true
+		}
+		select {
+		case <-s.stopping:
+			return false
+		case <-time.After(s.scheduleInterval):
+		}
+	}
+}
+
+// 保存检查点, 调用时不能有正在进行的分析和条目处理
+func (s *myScheduler) saveCheckpoint() error {
+	start := time.Now()
+	state := &checkpointState{
+		Version:    checkpointVersion,
+		Time:       start,
+		Rejects:    s.rejects.snapshot(),
+		ItemCounts: s.itemPipeLine.Count(),
+	}
+	s.inflightM.Lock()
+	for key, req := range s.inflight {
+		saved, err := newSavedRequest(req, key, 0)
+		if err != nil {
+			s.inflightM.Unlock()
+			return err
+		}
+		state.Requests = append(state.Requests, saved)
+	}
+	s.inflightM.Unlock()
+	items, cash := s.reqCache.dump()
+	for _, item := range items {
+		saved, err := newSavedRequest(item.req, item.key, item.score)
+		if err != nil {
+			return err
+		}
+		state.Requests = append(state.Requests, saved)
+	}
+	state.Cash = cash
+	// 不能保存的自定义去重器由使用者负责持久化
+	var snapshotter dedup.Snapshotter
+	switch d := s.dedup.(type) {
+	case dedup.Persistent:
+		marker, err := d.Sync()
+		if err != nil {
+			return errors.New(fmt.Sprintf("Occur error when sync deduplicator :%s", err))
+		}
+		state.DedupPath, state.DedupMarker = d.Path(), marker
+	case dedup.Snapshotter:
+		snapshotter = d
+		state.Dedup = true
+	}
+	if err := writeCheckpoint(s.cfg.Checkpoint.Dir, state, snapshotter); err != nil {
+		return errors.New(fmt.Sprintf("Occur error when save checkpoint to %s :%s", s.cfg.Checkpoint.Dir, err))
+	}
+	logrus.Infof("Checkpoint saved: requests:%d,urls:%d,cost:%s\n", len(state.Requests), s.dedup.Len(), time.Since(start))
+	return nil
+}
+
+// 恢复去重器 请求缓存和统计, 在开始调度之前调用
+func (s *myScheduler) restoreCheckpoint(state *checkpointState) error {
+	if state.DedupPath != "" {
+		persistent, ok := s.dedup.(dedup.Persistent)
+		if !ok || !samePath(persistent.Path(), state.DedupPath) {
+			return errors.New(fmt.Sprintf("The checkpoint needs the dedup database %s!", state.DedupPath))
+		}
+		if err := persistent.Rollback(state.DedupMarker); err != nil {
+			return errors.New(fmt.Sprintf("Occur error when restore deduplicator :%s", err))
+		}
+	}
+	if state.Dedup {
+		snapshotter, ok := s.dedup.(dedup.Snapshotter)
+		if !ok {
+			return errors.New(fmt.Sprintf("The deduplicator %T can not restore the checkpoint!", s.dedup))
+		}
+		file, err := os.Open(filepath.Join(state.dir, checkpointDedupFile))
+		if err != nil {
+			return err
+		}
+		err = snapshotter.Restore(bufio.NewReader(file))
+		file.Close()
+		if err != nil {
+			return errors.New(fmt.Sprintf("Occur error when restore deduplicator :%s", err))
+		}
+	}
+	items := make([]*frontierItem, 0, len(state.Requests))
+	for _, saved := range state.Requests {
+		req, err := saved.request()
+		if err != nil {
+			return err
+		}
+		if _, ok := s.seeds[req.Seed()]; !ok {
+			s.reject(req, REJECT_UNKNOWN_SEED, "not in the config anymore", SCHEDULER_CODE)
+			continue
+		}
+		items = append(items, &frontierItem{req: req, key: saved.Key, score: saved.Score})
+	}
+	s.reqCache.load(items, state.Cash)
+	s.rejects.restore(state.Rejects)
+	s.itemPipeLine.SetCount(state.ItemCounts)
+	logrus.Infof("Checkpoint restored from %s (%s): requests:%d,urls:%d\n",
+		state.dir, state.Time.Format(time.RFC3339), len(items), s.dedup.Len())
+	return nil
+}
+
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// 先写到临时目录, 再替换旧的检查点, 中途崩溃时保留旧的检查点
+func writeCheckpoint(dir string, state *checkpointState, snapshotter dedup.Snapshotter) error {
+	current := filepath.Join(dir, checkpointName)
+	tmp := current + ".tmp"
+	old := current + ".old"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	err := writeCheckpointFile(filepath.Join(tmp, checkpointStateFile), func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(state)
+	})
+	if err != nil {
+		return err
+	}
+	if snapshotter != nil {
+		if err := writeCheckpointFile(filepath.Join(tmp, checkpointDedupFile), snapshotter.Snapshot); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if _, err := os.Stat(current); err == nil {
+		if err := os.Rename(current, old); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, current); err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
+func writeCheckpointFile(path string, write func(w io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(file)
+	if err := write(bw); err != nil {
+		file.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// 读取目录下最新的检查点, 替换中途崩溃时使用旧的检查点
+func loadCheckpoint(dir string) (*checkpointState, error) {
+	var lastErr error
+	for _, name := range []string{checkpointName, checkpointName + ".old"} {
+		path := filepath.Join(dir, name)
+		file, err := os.Open(filepath.Join(path, checkpointStateFile))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		state := &checkpointState{}
+		err = gob.NewDecoder(bufio.NewReader(file)).Decode(state)
+		file.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if state.Version != checkpointVersion {
+			return nil, errors.New(fmt.Sprintf("The checkpoint version %d is not supported!", state.Version))
+		}
+		state.dir = path
+		return state, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Occur error when load checkpoint from %s :%s", dir, lastErr))
+}
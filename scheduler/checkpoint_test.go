@@ -0,0 +1,131 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+	anlz "webcrawler/analyzer"
+	"webcrawler/base"
+	ipl "webcrawler/itempipeline"
+)
+
+// 停止时分析完的请求不再保存到检查点, 它的出链保存下来, 恢复后不会重新下载
+// 磁盘去重器只记录路径和标记, 不复制key
+func TestStopRecordsCompletedRequests(t *testing.T) {
+	testStopAndResume(t, DedupConfig{})
+	testStopAndResume(t, DedupConfig{Type: DEDUP_DISK, Path: filepath.Join(t.TempDir(), "dedup.db")})
+}
+
+func testStopAndResume(t *testing.T, dedupCfg DedupConfig) {
+	t.Helper()
+	var m sync.Mutex
+	hits := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		hits[r.URL.Path]++
+		m.Unlock()
+	}))
+	defer srv.Close()
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	parse := func(ctx context.Context, httpResp *http.Response, respDepth uint32) ([]base.Data, []error) {
+		path := httpResp.Request.URL.Path
+		dataList := []base.Data{base.Item{"path": path}}
+		if path != "/" {
+			return dataList, nil
+		}
+		// 首页的分析在停止开始后才结束
+		once.Do(func() { close(entered) })
+		<-release
+		for _, link := range []string{"/a", "/b"} {
+			httpReq, _ := http.NewRequest(http.MethodGet, srv.URL+link, nil)
+			dataList = append(dataList, base.NewRequest(httpReq, respDepth))
+		}
+		return dataList, nil
+	}
+	items := make([]string, 0)
+	process := func(ctx context.Context, item base.Item) (base.Item, error) {
+		m.Lock()
+		defer m.Unlock()
+		items = append(items, item["path"].(string))
+		return item, nil
+	}
+	dir := t.TempDir()
+	cfg := testConfig(CrawlConfig{
+		CrawlDepth:     1,
+		Dedup:          dedupCfg,
+		Seeds:          []Seed{{URL: srv.URL + "/"}},
+		Checkpoint:     CheckpointConfig{Dir: dir, Interval: Duration(time.Hour)},
+		RespParsers:    []anlz.ParseResponse{parse},
+		ItemProcessors: []ipl.ProcessItem{process},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sched := NewScheduler()
+	if err := sched.Start(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+	errs := drainErrors(sched)
+	<-entered
+	stopped := make(chan bool)
+	go func() {
+		stopped <- sched.Stop()
+	}()
+	for sched.Running() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if !<-stopped {
+		t.Fatal("Stop() = false")
+	}
+	if errs := errs(); len(errs) > 0 {
+		t.Errorf("%s: crawl errors: %v", dedupCfg.Type, errs)
+	}
+	state, err := loadCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := make([]string, 0)
+	for _, req := range state.Requests {
+		saved = append(saved, req.URL)
+	}
+	sort.Strings(saved)
+	if want := fmt.Sprint([]string{srv.URL + "/a", srv.URL + "/b"}); fmt.Sprint(saved) != want {
+		t.Errorf("%s: saved requests %v; want %s", dedupCfg.Type, saved, want)
+	}
+	_, err = os.Stat(filepath.Join(state.dir, checkpointDedupFile))
+	if snapshot := dedupCfg.Type != DEDUP_DISK; snapshot != (err == nil) || state.Dedup != snapshot || (state.DedupPath != "") == snapshot {
+		t.Errorf("%s: dedup snapshot %v (%v), path %q", dedupCfg.Type, state.Dedup, err, state.DedupPath)
+	}
+
+	resumed := NewScheduler()
+	if err := resumed.Resume(ctx, cfg, dir); err != nil {
+		t.Fatal(err)
+	}
+	errs = drainErrors(resumed)
+	if err := resumed.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if errs := errs(); len(errs) > 0 {
+		t.Errorf("%s: crawl errors after resume: %v", dedupCfg.Type, errs)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if hits["/"] != 1 || hits["/a"] != 1 || hits["/b"] != 1 {
+		t.Errorf("%s: origin hits %v; want every page once", dedupCfg.Type, hits)
+	}
+	sort.Strings(items)
+	if fmt.Sprint(items) != "[/ /a /b]" {
+		t.Errorf("%s: processed items %v; want [/ /a /b]", dedupCfg.Type, items)
+	}
+}
@@ -0,0 +1,387 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	anlz "webcrawler/analyzer"
+	"webcrawler/canonical"
+	"webcrawler/dedup"
+	dl "webcrawler/downloader"
+	ipl "webcrawler/itempipeline"
+	mdw "webcrawler/middleware"
+	"webcrawler/proxy"
+	"webcrawler/publicsuffix"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// 爬取配置, 可以从yaml/json/toml文件加载
+// 函数类型的字段无法写进文件, 需要在代码中设置
+type CrawlConfig struct {
+	DownloaderPoolSize uint32               `json:"downloader_pool_size" yaml:"downloader_pool_size" toml:"downloader_pool_size"`
+	AnalyzerPoolSize   uint32               `json:"analyzer_pool_size" yaml:"analyzer_pool_size" toml:"analyzer_pool_size"`
+	Channels           ChannelConfig        `json:"channels" yaml:"channels" toml:"channels"`
+	CrawlDepth         uint32               `json:"crawl_depth" yaml:"crawl_depth" toml:"crawl_depth"`
+	Scope              ScopeConfig          `json:"scope" yaml:"scope" toml:"scope"`
+	Dedup              DedupConfig          `json:"dedup" yaml:"dedup" toml:"dedup"`
+	Frontier           FrontierConfig       `json:"frontier" yaml:"frontier" toml:"frontier"`
+	Politeness         PolitenessConfig     `json:"politeness" yaml:"politeness" toml:"politeness"`
+	UserAgent          string               `json:"user_agent" yaml:"user_agent" toml:"user_agent"` // 请求没有设置User-Agent时使用, 为空时使用默认值
+	Robots             RobotsConfig         `json:"robots" yaml:"robots" toml:"robots"`
+	Retry              RetryConfig          `json:"retry" yaml:"retry" toml:"retry"`
+	Proxy              ProxyConfig          `json:"proxy" yaml:"proxy" toml:"proxy"`
+	ResponseLimits     ResponseLimitsConfig `json:"response_limits" yaml:"response_limits" toml:"response_limits"`
+	BodyBuffer         BodyBufferConfig     `json:"body_buffer" yaml:"body_buffer" toml:"body_buffer"`
+	HttpCache          HttpCacheConfig      `json:"http_cache" yaml:"http_cache" toml:"http_cache"`
+	Warc               WarcConfig           `json:"warc" yaml:"warc" toml:"warc"`
+	Sitemap            SitemapConfig        `json:"sitemap" yaml:"sitemap" toml:"sitemap"`
+	Checkpoint         CheckpointConfig     `json:"checkpoint" yaml:"checkpoint" toml:"checkpoint"`
+	Canonical          *canonical.Rules     `json:"canonical" yaml:"canonical" toml:"canonical"` // url规范化规则, 为空时使用canonical.DefaultRules
+	Seeds              []Seed               `json:"seeds" yaml:"seeds" toml:"seeds"`
+	SeedFiles          []string             `json:"seed_files" yaml:"seed_files" toml:"seed_files"`                      // 见LoadSeeds
+	ScheduleInterval   Duration             `json:"schedule_interval" yaml:"schedule_interval" toml:"schedule_interval"` // 0表示使用默认值
+	RequestTimeout     Duration             `json:"request_timeout" yaml:"request_timeout" toml:"request_timeout"`       // 单个请求的超时, 只用于没有设置超时的客户端, 0表示不限制
+	CrawlTimeout       Duration             `json:"crawl_timeout" yaml:"crawl_timeout" toml:"crawl_timeout"`             // 整个爬取的时间预算, 0表示不限制
+
+	HttpClientGenerator GenHttpClient        `json:"-" yaml:"-" toml:"-"`
+	RespParsers         []anlz.ParseResponse `json:"-" yaml:"-" toml:"-"`
+	ItemProcessors      []ipl.ProcessItem    `json:"-" yaml:"-" toml:"-"`
+	// 下载器中间件, 按顺序包在http请求外面, 见dl.DownloaderMiddleware
+	DownloaderMiddlewares []dl.DownloaderMiddleware `json:"-" yaml:"-" toml:"-"`
+	// 自定义的去重器, 设置后Dedup配置被忽略, 调度器停止时不会关闭它
+	Deduplicator dedup.Deduplicator `json:"-" yaml:"-" toml:"-"`
+	// 多个进程共享的待爬取队列, 见SharedFrontier, 不能和检查点一起使用
+	SharedFrontier SharedFrontier `json:"-" yaml:"-" toml:"-"`
+	// 自定义的代理池, 设置后Proxy配置被忽略, 可以用它读取每个代理的统计
+	ProxyPool proxy.Pool `json:"-" yaml:"-" toml:"-"`
+	// best-first策略的打分函数, 为空时使用请求的优先级
+	ScoreFunc ScoreFunc `json:"-" yaml:"-" toml:"-"`
+	// 请求被忽略时调用, 可以为空
+	OnReject func(event RejectEvent) `json:"-" yaml:"-" toml:"-"`
+
+	seeds []Seed // Validate加载的Seeds和SeedFiles, 启动时使用, 不会再次读取种子文件
+}
+
+// 各通道的缓冲长度, 0表示使用默认值
+type ChannelConfig struct {
+	ReqChanLen   uint `json:"req_chan_len" yaml:"req_chan_len" toml:"req_chan_len"`
+	RespChanLen  uint `json:"resp_chan_len" yaml:"resp_chan_len" toml:"resp_chan_len"`
+	ItemChanLen  uint `json:"item_chan_len" yaml:"item_chan_len" toml:"item_chan_len"`
+	ErrorChanLen uint `json:"error_chan_len" yaml:"error_chan_len" toml:"error_chan_len"`
+}
+
+func (s ChannelConfig) args() mdw.ChannelArgs {
+	return mdw.ChannelArgs{
+		ReqChanLen:   s.ReqChanLen,
+		RespChanLen:  s.RespChanLen,
+		ItemChanLen:  s.ItemChanLen,
+		ErrorChanLen: s.ErrorChanLen,
+	}
+}
+
+// 去重器类型
+const (
+	DEDUP_MEMORY = "memory" // 默认
+	DEDUP_BLOOM  = "bloom"
+	DEDUP_DISK   = "disk"
+)
+
+const (
+	defaultBloomCapacity = 1 << 20
+	defaultBloomFpRate   = 0.001
+)
+
+// url去重配置
+type DedupConfig struct {
+	Type string `json:"type" yaml:"type" toml:"type"`
+	// bloom: 第一个过滤器的容量和总的误判率
+	Capacity          uint64  `json:"capacity" yaml:"capacity" toml:"capacity"`
+	FalsePositiveRate float64 `json:"false_positive_rate" yaml:"false_positive_rate" toml:"false_positive_rate"`
+	// disk: 数据库文件
+	Path string `json:"path" yaml:"path" toml:"path"`
+}
+
+func (s DedupConfig) check() []error {
+	errs := make([]error, 0)
+	switch s.Type {
+	case "", DEDUP_MEMORY:
+	case DEDUP_BLOOM:
+		if s.FalsePositiveRate < 0 || s.FalsePositiveRate >= 1 {
+			errs = append(errs, errors.New(fmt.Sprintf("The dedup false positive rate %v is invalid!", s.FalsePositiveRate)))
+		}
+	case DEDUP_DISK:
+		if s.Path == "" {
+			errs = append(errs, errors.New("The dedup database path is empty!"))
+		}
+	default:
+		errs = append(errs, errors.New(fmt.Sprintf("The dedup type %q is invalid!", s.Type)))
+	}
+	return errs
+}
+
+func (s *CrawlConfig) newDeduplicator() (dedup.Deduplicator, error) {
+	if s.Deduplicator != nil {
+		return s.Deduplicator, nil
+	}
+	switch s.Dedup.Type {
+	case DEDUP_BLOOM:
+		capacity, fpRate := s.Dedup.Capacity, s.Dedup.FalsePositiveRate
+		if capacity == 0 {
+			capacity = defaultBloomCapacity
+		}
+		if fpRate == 0 {
+			fpRate = defaultBloomFpRate
+		}
+		return dedup.NewBloomDeduplicator(capacity, fpRate)
+	case DEDUP_DISK:
+		return dedup.NewDiskDeduplicator(s.Dedup.Path)
+	}
+	return dedup.NewMemoryDeduplicator(), nil
+}
+
+// 待爬取队列配置
+type FrontierConfig struct {
+	// 出队策略, 为空时为bfs
+	Strategy FrontierStrategy `json:"strategy" yaml:"strategy" toml:"strategy"`
+}
+
+// 爬取范围
+type ScopeConfig struct {
+	// 所有种子都额外允许的域名(包括其子域名)
+	AllowedDomains []string `json:"allowed_domains" yaml:"allowed_domains" toml:"allowed_domains"`
+	// 允许的协议, 为空时为http和https
+	AllowedSchemes []string `json:"allowed_schemes" yaml:"allowed_schemes" toml:"allowed_schemes"`
+	// 爬取范围模式, 为空时为domain
+	Mode ScopeMode `json:"mode" yaml:"mode" toml:"mode"`
+	// 公共后缀列表文件, 为空时使用内置的列表
+	PublicSuffixFile string `json:"public_suffix_file" yaml:"public_suffix_file" toml:"public_suffix_file"`
+}
+
+func (s ScopeConfig) mode() ScopeMode {
+	if s.Mode == "" {
+		return SCOPE_SAME_DOMAIN
+	}
+	return s.Mode
+}
+
+// 公共后缀列表
+func (s ScopeConfig) publicSuffixList() (*publicsuffix.List, error) {
+	if s.PublicSuffixFile == "" {
+		return publicsuffix.Default(), nil
+	}
+	return publicsuffix.LoadFile(s.PublicSuffixFile)
+}
+
+var defaultSchemes = []string{"http", "https"}
+
+func (s ScopeConfig) schemes() []string {
+	if len(s.AllowedSchemes) == 0 {
+		return defaultSchemes
+	}
+	return s.AllowedSchemes
+}
+
+// 检查配置, 一次返回所有的问题; 同时加载种子文件, 启动时使用这次加载的种子
+func (s *CrawlConfig) Validate() []error {
+	errs := make([]error, 0)
+	if s.DownloaderPoolSize == 0 {
+		errs = append(errs, errors.New("The downloader pool size can not be 0!"))
+	}
+	if s.AnalyzerPoolSize == 0 {
+		errs = append(errs, errors.New("The analyzer pool size can not be 0!"))
+	}
+	if s.ScheduleInterval < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("The schedule interval %s is invalid!", s.ScheduleInterval)))
+	}
+	if s.RequestTimeout < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("The request timeout %s is invalid!", s.RequestTimeout)))
+	}
+	if s.CrawlTimeout < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("The crawl timeout %s is invalid!", s.CrawlTimeout)))
+	}
+	for i, domain := range s.Scope.AllowedDomains {
+		if strings.TrimSpace(domain) == "" || strings.ContainsAny(domain, "/:") {
+			errs = append(errs, errors.New(fmt.Sprintf("The allowed domain [%d] %q is invalid!", i, domain)))
+		}
+	}
+	for i, scheme := range s.Scope.AllowedSchemes {
+		if strings.TrimSpace(scheme) == "" || strings.ContainsAny(scheme, ":/") {
+			errs = append(errs, errors.New(fmt.Sprintf("The allowed scheme [%d] %q is invalid!", i, scheme)))
+		}
+	}
+	if s.Deduplicator == nil {
+		errs = append(errs, s.Dedup.check()...)
+	}
+	errs = append(errs, s.Politeness.check()...)
+	errs = append(errs, s.Retry.check()...)
+	errs = append(errs, s.ResponseLimits.check()...)
+	errs = append(errs, s.BodyBuffer.check()...)
+	errs = append(errs, s.HttpCache.check()...)
+	errs = append(errs, s.Warc.check()...)
+	if s.ProxyPool == nil {
+		errs = append(errs, s.Proxy.check()...)
+	}
+	for i, loc := range s.Sitemap.URLs {
+		if u, err := url.Parse(loc); err != nil || !u.IsAbs() {
+			errs = append(errs, errors.New(fmt.Sprintf("The sitemap [%d] %q is invalid!", i, loc)))
+		}
+	}
+	if s.Checkpoint.Interval < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("The checkpoint interval %s is invalid!", s.Checkpoint.Interval)))
+	}
+	if s.Checkpoint.Dir != "" && s.SharedFrontier != nil {
+		errs = append(errs, errors.New("The checkpoint is not supported with a shared frontier!"))
+	}
+	if s.Robots.TTL < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("The robots.txt ttl %s is invalid!", s.Robots.TTL)))
+	}
+	if s.Frontier.Strategy != "" && !s.Frontier.Strategy.valid() {
+		errs = append(errs, errors.New(fmt.Sprintf("The frontier strategy %q is invalid!", s.Frontier.Strategy)))
+	}
+	if s.Scope.Mode != "" && !s.Scope.Mode.valid() {
+		errs = append(errs, errors.New(fmt.Sprintf("The scope mode %q is invalid!", s.Scope.Mode)))
+	}
+	if s.Scope.PublicSuffixFile != "" {
+		if _, err := s.Scope.publicSuffixList(); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("Occur error when load public suffix list %s :%s", s.Scope.PublicSuffixFile, err)))
+		}
+	}
+	schemes := make(map[string]bool)
+	for _, scheme := range s.Scope.schemes() {
+		schemes[strings.ToLower(scheme)] = true
+	}
+	seeds, seedErrs := s.loadSeeds()
+	s.seeds = seeds
+	errs = append(errs, seedErrs...)
+	if len(seeds) == 0 && len(seedErrs) == 0 {
+		errs = append(errs, errors.New("The seed list is empty!"))
+	}
+	for i, seed := range seeds {
+		if u, err := url.Parse(seed.URL); err == nil && u.Scheme != "" && !schemes[strings.ToLower(u.Scheme)] {
+			errs = append(errs, errors.New(fmt.Sprintf("The seed [%d] %q scheme is not allowed!", i, seed.URL)))
+		}
+		allowlist := seed.Scope == SCOPE_ALLOWLIST || (seed.Scope == "" && s.Scope.mode() == SCOPE_ALLOWLIST)
+		if allowlist && len(seed.AllowedDomains) == 0 && len(s.Scope.AllowedDomains) == 0 {
+			errs = append(errs, errors.New(fmt.Sprintf("The seed [%d] %q has no allowed domains!", i, seed.URL)))
+		}
+	}
+	if s.HttpClientGenerator == nil {
+		errs = append(errs, errors.New("The http client generator is invalid!"))
+	}
+	if len(s.RespParsers) == 0 {
+		errs = append(errs, errors.New("The response parser list is invalid!"))
+	}
+	for i, parser := range s.RespParsers {
+		if parser == nil {
+			errs = append(errs, errors.New(fmt.Sprintf("The response parser [%d] is invalid!", i)))
+		}
+	}
+	for i, mw := range s.DownloaderMiddlewares {
+		if mw == nil {
+			errs = append(errs, errors.New(fmt.Sprintf("The downloader middleware [%d] is invalid!", i)))
+		}
+	}
+	if len(s.ItemProcessors) == 0 {
+		errs = append(errs, errors.New("The item processor list is invalid!"))
+	}
+	for i, ip := range s.ItemProcessors {
+		if ip == nil {
+			errs = append(errs, errors.New(fmt.Sprintf("The item processor [%d] is invalid!", i)))
+		}
+	}
+	return errs
+}
+
+func (s *CrawlConfig) canonicalRules() canonical.Rules {
+	if s.Canonical == nil {
+		return canonical.DefaultRules()
+	}
+	return *s.Canonical
+}
+
+// 配置中的种子和种子文件中的种子
+func (s *CrawlConfig) loadSeeds() ([]Seed, []error) {
+	errs := make([]error, 0)
+	seeds := make([]Seed, 0, len(s.Seeds))
+	seeds = append(seeds, s.Seeds...)
+	for _, path := range s.SeedFiles {
+		fileSeeds, err := LoadSeeds(path)
+		if err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("Occur error when load seed file %s :%s", path, err)))
+			continue
+		}
+		seeds = append(seeds, fileSeeds...)
+	}
+	for i, seed := range seeds {
+		if err := seed.check(); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("The seed [%d] %q is invalid: %s", i, seed.URL, err)))
+		}
+	}
+	return seeds, errs
+}
+
+// 根据扩展名(.yaml/.yml/.json/.toml)从文件加载配置, 不认识的字段会报错
+func LoadCrawlConfig(path string) (*CrawlConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &CrawlConfig{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, cfg)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cfg)
+	case ".toml":
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(data), cfg)
+		if err == nil && len(meta.Undecoded()) > 0 {
+			err = errors.New(fmt.Sprintf("unknown fields %v", meta.Undecoded()))
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported config file type %q!", ext))
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Occur error when load config %s :%s", path, err))
+	}
+	return cfg, nil
+}
+
+// 可以用"10s"这样的字符串表示的时间段
+type Duration time.Duration
+
+func (s Duration) String() string {
+	return time.Duration(s).String()
+}
+func (s Duration) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+func (s *Duration) UnmarshalText(text []byte) error {
+	d, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*s = Duration(d)
+	return nil
+}
+
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
@@ -0,0 +1,47 @@
+package scheduler
+
+import (
+	"errors"
+	"webcrawler/canonical"
+	dl "webcrawler/downloader"
+	"webcrawler/httpcache"
+)
+
+// 磁盘上的http缓存配置, Dir为空时不使用缓存
+type HttpCacheConfig struct {
+	Dir string `json:"dir" yaml:"dir" toml:"dir"`
+	// 只从缓存读取, 没有缓存的请求被丢弃, 记为REJECT_DROPPED
+	Offline bool `json:"offline" yaml:"offline" toml:"offline"`
+}
+
+func (s HttpCacheConfig) check() []error {
+	errs := make([]error, 0)
+	if s.Offline && s.Dir == "" {
+		errs = append(errs, errors.New("The http cache directory is empty in offline mode!"))
+	}
+	return errs
+}
+
+// 没有配置缓存时返回nil
+func (s *CrawlConfig) newHttpCache() (httpcache.Cache, error) {
+	if s.HttpCache.Dir == "" {
+		return nil, nil
+	}
+	return httpcache.NewCache(httpcache.Config{
+		Dir:           s.HttpCache.Dir,
+		Offline:       s.HttpCache.Offline,
+		Canonicalizer: canonical.NewCanonicalizer(s.canonicalRules()),
+	})
+}
+
+// 缓存和WARC写入器依次放在中间件的最后: 其它中间件看到的缓存响应和下载的一样, 缓存命中不会写入WARC
+func (s *myScheduler) downloaderMiddlewares() []dl.DownloaderMiddleware {
+	middlewares := append([]dl.DownloaderMiddleware{}, s.cfg.DownloaderMiddlewares...)
+	if s.httpCache != nil {
+		middlewares = append(middlewares, s.httpCache)
+	}
+	if s.warcWriter != nil {
+		middlewares = append(middlewares, s.warcWriter)
+	}
+	return middlewares
+}
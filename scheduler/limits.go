@@ -0,0 +1,114 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"webcrawler/base"
+	dl "webcrawler/downloader"
+)
+
+// 响应的限制, 被跳过的响应不会交给解析函数, 记为REJECT_SKIPPED
+type ResponseLimitsConfig struct {
+	// 响应体的最大字节数, 0表示不限制
+	MaxBodyBytes int64 `json:"max_body_bytes" yaml:"max_body_bytes" toml:"max_body_bytes"`
+	// 超过时截断响应体, 否则跳过响应或读取时出错
+	TruncateBody bool `json:"truncate_body" yaml:"truncate_body" toml:"truncate_body"`
+	// 响应头的最大字节数, 0表示不限制; 设置为http.Transport.MaxResponseHeaderBytes,
+	// 超过时下载出错, 生成器返回的客户端的Transport不是*http.Transport时不生效
+	MaxHeaderBytes int64 `json:"max_header_bytes" yaml:"max_header_bytes" toml:"max_header_bytes"`
+	// 允许的MIME类型, 如text/html text/*, 为空时允许所有类型
+	AllowedTypes []string `json:"allowed_types" yaml:"allowed_types" toml:"allowed_types"`
+	// 禁止的MIME类型, 优先于AllowedTypes
+	DeniedTypes []string `json:"denied_types" yaml:"denied_types" toml:"denied_types"`
+}
+
+func (s ResponseLimitsConfig) check() []error {
+	errs := make([]error, 0)
+	if s.MaxBodyBytes < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("The max body bytes %d is invalid!", s.MaxBodyBytes)))
+	}
+	if s.MaxHeaderBytes < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("The max header bytes %d is invalid!", s.MaxHeaderBytes)))
+	}
+	for _, pattern := range append(append([]string{}, s.AllowedTypes...), s.DeniedTypes...) {
+		if err := dl.CheckMimePattern(pattern); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// 没有任何限制时返回nil
+func (s ResponseLimitsConfig) limits() *dl.ResponseLimits {
+	if s.MaxBodyBytes == 0 && len(s.AllowedTypes) == 0 && len(s.DeniedTypes) == 0 {
+		return nil
+	}
+	return &dl.ResponseLimits{
+		MaxBodyBytes: s.MaxBodyBytes,
+		TruncateBody: s.TruncateBody,
+		AllowedTypes: s.AllowedTypes,
+		DeniedTypes:  s.DeniedTypes,
+	}
+}
+
+// 返回设置了响应头上限的Transport, 同一个*http.Transport只复制一次; 没有上限时不修改
+func (s ResponseLimitsConfig) headerLimiter() func(base http.RoundTripper) http.RoundTripper {
+	clones := make(map[*http.Transport]*http.Transport)
+	var m sync.Mutex
+	return func(base http.RoundTripper) http.RoundTripper {
+		if s.MaxHeaderBytes == 0 {
+			return base
+		}
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		transport, ok := base.(*http.Transport)
+		if !ok {
+			return base
+		}
+		m.Lock()
+		defer m.Unlock()
+		clone, ok := clones[transport]
+		if !ok {
+			clone = transport.Clone()
+			clone.MaxResponseHeaderBytes = s.MaxHeaderBytes
+			clones[transport] = clone
+		}
+		return clone
+	}
+}
+
+// 解析前响应体的缓冲配置, 所有解析函数共享同一份缓冲
+type BodyBufferConfig struct {
+	// 最多缓冲的字节数, 超过时不解析并报告错误, 0表示不限制
+	MaxBytes int64 `json:"max_bytes" yaml:"max_bytes" toml:"max_bytes"`
+	// 内存中最多保存的字节数, 超过时写入临时文件, 0表示只使用内存
+	MemoryBytes int64 `json:"memory_bytes" yaml:"memory_bytes" toml:"memory_bytes"`
+	// 临时文件的目录, 为空时使用系统的临时目录
+	SpillDir string `json:"spill_dir" yaml:"spill_dir" toml:"spill_dir"`
+	// 检测字符集并把解析函数读取的响应体转换为utf-8
+	Transcode bool `json:"transcode" yaml:"transcode" toml:"transcode"`
+}
+
+func (s BodyBufferConfig) check() []error {
+	errs := make([]error, 0)
+	if s.MaxBytes < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("The body buffer max bytes %d is invalid!", s.MaxBytes)))
+	}
+	if s.MemoryBytes < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("The body buffer memory bytes %d is invalid!", s.MemoryBytes)))
+	}
+	if s.SpillDir != "" {
+		if info, err := os.Stat(s.SpillDir); err != nil || !info.IsDir() {
+			errs = append(errs, errors.New(fmt.Sprintf("The body buffer spill directory %s is invalid!", s.SpillDir)))
+		}
+	}
+	return errs
+}
+
+func (s BodyBufferConfig) options() base.BufferOptions {
+	return base.BufferOptions{MaxBytes: s.MaxBytes, MemoryBytes: s.MemoryBytes, SpillDir: s.SpillDir, Transcode: s.Transcode}
+}
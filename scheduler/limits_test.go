@@ -0,0 +1,121 @@
+package scheduler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	anlz "webcrawler/analyzer"
+	"webcrawler/base"
+	ipl "webcrawler/itempipeline"
+)
+
+// 补全测试用的配置: 默认的池大小 条目处理函数和客户端, 不遵守robots.txt
+func testConfig(cfg CrawlConfig) CrawlConfig {
+	if cfg.DownloaderPoolSize == 0 {
+		cfg.DownloaderPoolSize = 2
+	}
+	if cfg.AnalyzerPoolSize == 0 {
+		cfg.AnalyzerPoolSize = 2
+	}
+	if cfg.ItemProcessors == nil {
+		cfg.ItemProcessors = []ipl.ProcessItem{func(ctx context.Context, item base.Item) (base.Item, error) {
+			return item, nil
+		}}
+	}
+	if cfg.HttpClientGenerator == nil {
+		cfg.HttpClientGenerator = func() *http.Client { return &http.Client{} }
+	}
+	cfg.Robots.Ignore = true
+	return cfg
+}
+
+// 读完错误通道, 返回等待读完的函数
+func drainErrors(sched Scheduler) func() []error {
+	errs := make([]error, 0)
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for err := range sched.ErrorChan() {
+			errs = append(errs, err)
+		}
+	}()
+	return func() []error {
+		<-drained
+		return errs
+	}
+}
+
+// 运行一次爬取直到结束, 返回爬取过程中的错误
+func crawl(t *testing.T, cfg CrawlConfig) []error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	sched := NewScheduler()
+	if err := sched.Start(ctx, testConfig(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	errs := drainErrors(sched)
+	if err := sched.Wait(ctx); err != nil {
+		t.Fatalf("the crawl is not done: %s", err)
+	}
+	return errs()
+}
+
+// 解析函数通过analyzer.ResponseFrom看到的截断标记
+func TestTruncatedInParser(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, strings.Repeat("a", size))
+	}))
+	defer srv.Close()
+	cases := []struct {
+		path      string
+		size      int
+		truncated bool
+	}{
+		{"/50", 40, true},
+		{"/41", 40, true},
+		{"/40", 40, false},
+		{"/20", 20, false},
+	}
+	type parsed struct {
+		size      int
+		truncated bool
+	}
+	var m sync.Mutex
+	got := make(map[string]parsed)
+	parse := func(ctx context.Context, httpResp *http.Response, respDepth uint32) ([]base.Data, []error) {
+		body, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			return nil, []error{err}
+		}
+		resp, ok := anlz.ResponseFrom(ctx)
+		m.Lock()
+		defer m.Unlock()
+		got[httpResp.Request.URL.Path] = parsed{len(body), ok && resp.Truncated()}
+		return nil, nil
+	}
+	cfg := CrawlConfig{
+		CrawlDepth:     1,
+		ResponseLimits: ResponseLimitsConfig{MaxBodyBytes: 40, TruncateBody: true},
+		RespParsers:    []anlz.ParseResponse{parse},
+	}
+	for _, c := range cases {
+		cfg.Seeds = append(cfg.Seeds, Seed{URL: srv.URL + c.path})
+	}
+	if errs := crawl(t, cfg); len(errs) > 0 {
+		t.Errorf("crawl errors: %v", errs)
+	}
+	for _, c := range cases {
+		if p := got[c.path]; p.size != c.size || p.truncated != c.truncated {
+			t.Errorf("%s: parser saw %d bytes, truncated %v; want %d bytes, truncated %v", c.path, p.size, p.truncated, c.size, c.truncated)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"webcrawler/base"
+	dl "webcrawler/downloader"
+)
+
+// 礼貌策略的分组方式
+const (
+	POLITENESS_BY_HOST = "host" // 按主机名分组, 默认
+	POLITENESS_BY_IP   = "ip"   // 按解析出的ip分组, 同一台服务器上的多个站点共享限制
+)
+
+const (
+	defaultMaxConnsPerHost = 2
+	defaultMaxDelay        = time.Minute
+	backoffDelay           = time.Second     // 第一次被限流时的间隔
+	lookupTimeout          = 5 * time.Second // 按ip分组时解析域名的超时
+	latencyWeight          = 0.3             // 响应时间的指数移动平均权重
+)
+
+// 按主机限制并发和访问间隔
+type PolitenessConfig struct {
+	// 分组方式, host或ip, 为空时为host
+	KeyBy string `json:"key_by" yaml:"key_by" toml:"key_by"`
+	// 每个主机的最大并发连接数, 0表示使用默认值
+	MaxConnsPerHost uint32 `json:"max_conns_per_host" yaml:"max_conns_per_host" toml:"max_conns_per_host"`
+	// 同一主机两次请求的最小间隔
+	MinDelay Duration `json:"min_delay" yaml:"min_delay" toml:"min_delay"`
+	// 自动调整的间隔上限, 也是Retry-After的上限, 0表示使用默认值
+	MaxDelay Duration `json:"max_delay" yaml:"max_delay" toml:"max_delay"`
+	// 不根据响应时间和429/503自动调整间隔
+	DisableAutoThrottle bool `json:"disable_auto_throttle" yaml:"disable_auto_throttle" toml:"disable_auto_throttle"`
+}
+
+func (s PolitenessConfig) check() []error {
+	errs := make([]error, 0)
+	switch s.KeyBy {
+	case "", POLITENESS_BY_HOST, POLITENESS_BY_IP:
+	default:
+		errs = append(errs, errors.New(fmt.Sprintf("The politeness key %q is invalid!", s.KeyBy)))
+	}
+	if s.MinDelay < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("The politeness min delay %s is invalid!", s.MinDelay)))
+	}
+	if s.MaxDelay < 0 || (s.MaxDelay > 0 && s.MaxDelay < s.MinDelay) {
+		errs = append(errs, errors.New(fmt.Sprintf("The politeness max delay %s is invalid!", s.MaxDelay)))
+	}
+	return errs
+}
+
+// 单个主机的状态
+type hostState struct {
+	active   uint32        // 正在下载的请求数
+	minDelay time.Duration // 配置的间隔或robots的Crawl-delay
+	delay    time.Duration // 当前的间隔
+	latency  time.Duration // 响应时间的移动平均
+	next     time.Time     // 下一次允许请求的时间
+}
+
+// 按主机记录并发和间隔 (并发安全), 主机忙时请求留在请求缓存中, 出队顺序仍由缓存的策略决定
+type politeness struct {
+	keyBy     string
+	maxConns  uint32
+	minDelay  time.Duration
+	maxDelay  time.Duration
+	throttle  bool
+	hosts     map[string]*hostState
+	ips       map[string]string // 主机名到ip的缓存, 正在解析时为空字符串
+	throttled uint64            // 收到429/503的次数
+	// 解析域名, 默认为net.DefaultResolver
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+	m      sync.Mutex
+}
+
+func newPoliteness(cfg PolitenessConfig) *politeness {
+	s := &politeness{
+		keyBy:    cfg.KeyBy,
+		maxConns: cfg.MaxConnsPerHost,
+		minDelay: time.Duration(cfg.MinDelay),
+		maxDelay: time.Duration(cfg.MaxDelay),
+		throttle: !cfg.DisableAutoThrottle,
+		hosts:    make(map[string]*hostState),
+		ips:      make(map[string]string),
+		lookup:   net.DefaultResolver.LookupIPAddr,
+	}
+	if s.keyBy == "" {
+		s.keyBy = POLITENESS_BY_HOST
+	}
+	if s.maxConns == 0 {
+		s.maxConns = defaultMaxConnsPerHost
+	}
+	if s.maxDelay == 0 {
+		s.maxDelay = defaultMaxDelay
+	}
+	if s.maxDelay < s.minDelay {
+		s.maxDelay = s.minDelay
+	}
+	return s
+}
+
+// 请求所属的分组, 按ip分组时域名在后台解析, 解析完成前ok为false; 解析失败时使用主机名
+// 不会阻塞, 请求缓存在持有锁时通过tryStart调用它
+func (s *politeness) key(req *base.Request) (string, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.lockedKey(req)
+}
+
+// 调用时必须持有锁
+func (s *politeness) lockedKey(req *base.Request) (string, bool) {
+	host := hostname(req.HttpReq().URL.Host)
+	if s.keyBy != POLITENESS_BY_IP || net.ParseIP(host) != nil {
+		return host, true
+	}
+	if ip, ok := s.ips[host]; ok {
+		return ip, ip != ""
+	}
+	// 空字符串表示正在解析
+	s.ips[host] = ""
+	go s.resolve(host)
+	return host, false
+}
+func (s *politeness) resolve(host string) {
+	ip := host
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	if addrs, err := s.lookup(ctx, host); err == nil && len(addrs) > 0 {
+		ip = addrs[0].IP.String()
+	}
+	s.m.Lock()
+	s.ips[host] = ip
+	s.m.Unlock()
+}
+
+// 调用时必须持有锁
+func (s *politeness) host(key string) *hostState {
+	state, ok := s.hosts[key]
+	if !ok {
+		state = &hostState{minDelay: s.minDelay, delay: s.minDelay}
+		s.hosts[key] = state
+	}
+	return state
+}
+func (s *politeness) ready(state *hostState, now time.Time) bool {
+	return state.active < s.maxConns && !now.Before(state.next)
+}
+func (s *politeness) start(state *hostState, now time.Time) {
+	state.active++
+	state.next = now.Add(state.delay)
+}
+
+// 主机空闲时占用它并返回true, 否则返回false; 按ip分组时域名还没有解析完也返回false
+func (s *politeness) tryStart(req *base.Request, now time.Time) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	key, ok := s.lockedKey(req)
+	if !ok {
+		return false
+	}
+	state := s.host(key)
+	if !s.ready(state, now) {
+		return false
+	}
+	s.start(state, now)
+	return true
+}
+
+// 下载结束, 根据响应时间和状态码调整该主机的间隔
+// 请求开始前分组已经确定, 这里的key和tryStart的相同
+func (s *politeness) finish(req *base.Request, latency time.Duration, httpResp *http.Response) {
+	now := time.Now()
+	s.m.Lock()
+	defer s.m.Unlock()
+	key, _ := s.lockedKey(req)
+	state := s.host(key)
+	if state.active > 0 {
+		state.active--
+	}
+	if !s.throttle || httpResp == nil {
+		return
+	}
+	if httpResp.StatusCode == http.StatusTooManyRequests || httpResp.StatusCode == http.StatusServiceUnavailable {
+		s.throttled++
+		state.delay = s.clamp(state, state.delay*2, backoffDelay)
+		wait := state.delay
+		if retryAfter, ok := dl.ParseRetryAfter(httpResp.Header.Get("Retry-After"), now); ok {
+			wait = retryAfter
+			if wait > s.maxDelay {
+				wait = s.maxDelay
+			}
+		}
+		if next := now.Add(wait); next.After(state.next) {
+			state.next = next
+		}
+		return
+	}
+	if state.latency == 0 {
+		state.latency = latency
+	} else {
+		state.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(state.latency))
+	}
+	// 间隔逐渐向平均响应时间靠拢, 响应越慢请求越少
+	state.delay = s.clamp(state, (state.delay+state.latency)/2, 0)
+}
+
+// 把间隔限制在[max(minDelay,floor), maxDelay]内
+func (s *politeness) clamp(state *hostState, delay time.Duration, floor time.Duration) time.Duration {
+	if floor < state.minDelay {
+		floor = state.minDelay
+	}
+	if delay < floor {
+		delay = floor
+	}
+	if delay > s.maxDelay {
+		delay = s.maxDelay
+	}
+	return delay
+}
+
+// 设置主机的最小间隔, 如robots.txt的Crawl-delay
+func (s *politeness) setMinDelay(key string, delay time.Duration) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	state := s.host(key)
+	if delay > s.maxDelay {
+		delay = s.maxDelay
+	}
+	state.minDelay = delay
+	if state.delay < delay {
+		state.delay = delay
+	}
+}
+func (s *politeness) summary() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var active uint32
+	for _, state := range s.hosts {
+		active += state.active
+	}
+	return fmt.Sprintf("key:%s,hosts:%d,active:%d,throttled:%d", s.keyBy, len(s.hosts), active, s.throttled)
+}
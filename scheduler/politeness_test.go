@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+	"webcrawler/base"
+)
+
+func newTestRequest(t *testing.T, rawUrl string) *base.Request {
+	t.Helper()
+	httpReq, err := http.NewRequest(http.MethodGet, rawUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base.NewRequest(httpReq, 0)
+}
+
+// 按ip分组时解析域名不会阻塞请求缓存
+func TestPolitenessLookupDoesNotBlockFrontier(t *testing.T) {
+	release := make(chan struct{})
+	p := newPoliteness(PolitenessConfig{KeyBy: POLITENESS_BY_IP, MaxConnsPerHost: 1})
+	p.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "slow.example":
+			<-release
+			return nil, errors.New("no such host")
+		case "a.example", "b.example":
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+		}
+		return []net.IPAddr{{IP: net.ParseIP("10.0.0.2")}}, nil
+	}
+	cache := newRequestCache(FRONTIER_BFS, nil)
+	take := func(req *base.Request) bool {
+		return p.tryStart(req, time.Now())
+	}
+	// 等待后台解析完成后取出请求
+	getWithin := func(d time.Duration) *base.Request {
+		deadline := time.Now().Add(d)
+		for {
+			if req := cache.get(take); req != nil || time.Now().After(deadline) {
+				return req
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	slow := newTestRequest(t, "http://slow.example/")
+	cache.put(slow, "slow")
+	start := time.Now()
+	if req := cache.get(take); req != nil {
+		t.Fatalf("got %s before the host is resolved", req.HttpReq().URL)
+	}
+	// 解析时请求缓存仍然可用
+	cache.put(newTestRequest(t, "http://a.example/"), "a")
+	cache.put(newTestRequest(t, "http://b.example/"), "b")
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("the frontier was blocked for %s", d)
+	}
+	a := getWithin(time.Second)
+	if a == nil || a.HttpReq().URL.Host != "a.example" {
+		t.Fatalf("got %v; want a.example", a)
+	}
+	// b.example和a.example解析到同一个ip, 共享连接数限制
+	if req := getWithin(100 * time.Millisecond); req != nil {
+		t.Fatalf("got %s while its ip is busy", req.HttpReq().URL)
+	}
+	p.finish(a, 0, nil)
+	if b := getWithin(time.Second); b == nil || b.HttpReq().URL.Host != "b.example" {
+		t.Fatalf("got %v; want b.example", b)
+	}
+	// 解析失败时按主机名分组
+	close(release)
+	if req := getWithin(time.Second); req != slow {
+		t.Fatalf("got %v; want slow.example", req)
+	}
+	if key, ok := p.key(slow); key != "slow.example" || !ok {
+		t.Errorf("key(slow.example) = %s, %v", key, ok)
+	}
+}
@@ -0,0 +1,70 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"webcrawler/proxy"
+)
+
+// 代理配置, URLs和File都为空时不使用代理
+type ProxyConfig struct {
+	// 代理地址, 支持http https和socks5
+	URLs []string `json:"urls" yaml:"urls" toml:"urls"`
+	// 代理列表文件, 每行一个, 和URLs合并
+	File string `json:"file" yaml:"file" toml:"file"`
+	// 轮换方式, round-robin或sticky, 为空时为round-robin
+	Rotation string `json:"rotation" yaml:"rotation" toml:"rotation"`
+	// 连续失败多少次后暂时禁用, 0表示使用默认值
+	MaxFailures uint32 `json:"max_failures" yaml:"max_failures" toml:"max_failures"`
+	// 禁用的时间, 0表示使用默认值
+	BanTime Duration `json:"ban_time" yaml:"ban_time" toml:"ban_time"`
+	// 视为代理失败的状态码, 为空时为407
+	FailureStatusCodes []int `json:"failure_status_codes" yaml:"failure_status_codes" toml:"failure_status_codes"`
+}
+
+func (s ProxyConfig) enabled() bool {
+	return len(s.URLs) > 0 || s.File != ""
+}
+func (s ProxyConfig) check() []error {
+	errs := make([]error, 0)
+	if !s.enabled() {
+		return errs
+	}
+	if s.BanTime < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("The proxy ban time %s is invalid!", s.BanTime)))
+	}
+	if _, err := s.newPool(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// 没有配置代理时返回nil
+func (s ProxyConfig) newPool() (proxy.Pool, error) {
+	if !s.enabled() {
+		return nil, nil
+	}
+	urls := append([]string{}, s.URLs...)
+	if s.File != "" {
+		fileUrls, err := proxy.LoadFile(s.File)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Occur error when load proxy file %s :%s", s.File, err))
+		}
+		urls = append(urls, fileUrls...)
+	}
+	return proxy.NewPool(proxy.Config{
+		URLs:               urls,
+		Rotation:           s.Rotation,
+		MaxFailures:        s.MaxFailures,
+		BanTime:            time.Duration(s.BanTime),
+		FailureStatusCodes: s.FailureStatusCodes,
+	})
+}
+
+func (s *CrawlConfig) newProxyPool() (proxy.Pool, error) {
+	if s.ProxyPool != nil {
+		return s.ProxyPool, nil
+	}
+	return s.Proxy.newPool()
+}
@@ -0,0 +1,108 @@
+package scheduler
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"webcrawler/base"
+
+	"github.com/bugfan/logrus"
+)
+
+// 请求被忽略的原因
+type RejectReason string
+
+const (
+	REJECT_INVALID_REQUEST RejectReason = "invalid request"
+	REJECT_SCHEME          RejectReason = "scheme not allowed"
+	REJECT_REPEATED        RejectReason = "repeated url"
+	REJECT_UNKNOWN_SEED    RejectReason = "unknown seed"
+	REJECT_OUT_OF_SCOPE    RejectReason = "out of scope"
+	REJECT_TOO_DEEP        RejectReason = "too deep"
+	REJECT_ROBOTS          RejectReason = "disallowed by robots"
+	REJECT_DROPPED         RejectReason = "dropped by middleware"
+	REJECT_SKIPPED         RejectReason = "response skipped"
+)
+
+// 请求被忽略的事件
+type RejectEvent struct {
+	Url    string
+	Seed   string
+	Depth  uint32
+	Reason RejectReason
+	Detail string
+	Code   string // 产生该请求的组件
+}
+
+func (s RejectEvent) String() string {
+	return fmt.Sprintf("reason:%s,url:%s,seed:%s,depth:%d,code:%s,detail:%s",
+		s.Reason, s.Url, s.Seed, s.Depth, s.Code, s.Detail)
+}
+
+// 按原因统计被忽略的请求
+type rejectCounter struct {
+	counts map[RejectReason]uint64
+	m      sync.Mutex
+}
+
+func newRejectCounter() *rejectCounter {
+	return &rejectCounter{counts: make(map[RejectReason]uint64)}
+}
+func (s *rejectCounter) add(reason RejectReason) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.counts[reason]++
+}
+func (s *rejectCounter) snapshot() map[RejectReason]uint64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	counts := make(map[RejectReason]uint64, len(s.counts))
+	for reason, count := range s.counts {
+		counts[reason] = count
+	}
+	return counts
+}
+func (s *rejectCounter) restore(counts map[RejectReason]uint64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for reason, count := range counts {
+		s.counts[reason] = count
+	}
+}
+func (s *rejectCounter) summary() string {
+	counts := s.snapshot()
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, string(reason))
+	}
+	sort.Strings(reasons)
+	var buf bytes.Buffer
+	for i, reason := range reasons {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString(fmt.Sprintf("%s:%d", reason, counts[RejectReason(reason)]))
+	}
+	return buf.String()
+}
+
+// 记录并通知被忽略的请求
+func (s *myScheduler) reject(req *base.Request, reason RejectReason, detail string, code string) bool {
+	event := RejectEvent{
+		Seed:   req.Seed(),
+		Depth:  req.Depth(),
+		Reason: reason,
+		Detail: detail,
+		Code:   code,
+	}
+	if httpReq := req.HttpReq(); httpReq != nil && httpReq.URL != nil {
+		event.Url = httpReq.URL.String()
+	}
+	s.rejects.add(reason)
+	logrus.Debugf("Ignore the request ! %s\n", event)
+	if s.cfg.OnReject != nil {
+		s.cfg.OnReject(event)
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"webcrawler/proxy"
+	"webcrawler/replay"
+)
+
+// 包装客户端生成器, 把爬取中所有的请求和响应记录到recorder的存档, 调度器不会关闭recorder
+// 客户端的Transport是*http.Transport(或为空)时复制一份并使用代理池选择的代理
+func RecordHttpClient(hcg GenHttpClient, recorder replay.Recorder) GenHttpClient {
+	return func() *http.Client {
+		client := hcg()
+		if client == nil {
+			client = &http.Client{}
+		}
+		copied := *client
+		transport := copied.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		if t, ok := transport.(*http.Transport); ok {
+			cloned := t.Clone()
+			cloned.Proxy = proxy.ProxyFunc(t.Proxy)
+			transport = cloned
+		}
+		copied.Transport = recorder.Wrap(transport)
+		return &copied
+	}
+}
+
+// 返回从存档回放响应的客户端生成器, 不访问网络; 所有客户端共享同一个replay.Replayer
+func ReplayHttpClient(path string, keepTiming bool) (GenHttpClient, *replay.Replayer, error) {
+	fixtures, err := replay.LoadFixtures(path)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Occur error when load fixtures %s :%s", path, err))
+	}
+	replayer := replay.NewReplayer(fixtures, keepTiming)
+	hcg := func() *http.Client {
+		return &http.Client{Transport: replayer}
+	}
+	return hcg, replayer, nil
+}
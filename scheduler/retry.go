@@ -0,0 +1,77 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"webcrawler/base"
+	dl "webcrawler/downloader"
+
+	"github.com/bugfan/logrus"
+)
+
+// 下载失败时的重试配置, 需要重试的请求经过请求缓存重新调度, 不会占用下载器等待
+type RetryConfig struct {
+	// 最多重试的次数, 0表示不重试
+	MaxRetries uint32 `json:"max_retries" yaml:"max_retries" toml:"max_retries"`
+	// 第一次重试的间隔, 之后每次翻倍, 0表示使用默认值
+	BaseDelay Duration `json:"base_delay" yaml:"base_delay" toml:"base_delay"`
+	// 间隔的上限, 也是Retry-After的上限, 0表示使用默认值
+	MaxDelay Duration `json:"max_delay" yaml:"max_delay" toml:"max_delay"`
+	// 需要重试的状态码, 为空时为429和5xx(501除外)
+	StatusCodes []int `json:"status_codes" yaml:"status_codes" toml:"status_codes"`
+	// 不在间隔上加随机抖动
+	DisableJitter bool `json:"disable_jitter" yaml:"disable_jitter" toml:"disable_jitter"`
+}
+
+func (s RetryConfig) check() []error {
+	errs := make([]error, 0)
+	if s.BaseDelay < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("The retry base delay %s is invalid!", s.BaseDelay)))
+	}
+	if s.MaxDelay < 0 || (s.MaxDelay > 0 && s.MaxDelay < s.BaseDelay) {
+		errs = append(errs, errors.New(fmt.Sprintf("The retry max delay %s is invalid!", s.MaxDelay)))
+	}
+	for i, code := range s.StatusCodes {
+		if code < 100 || code > 999 {
+			errs = append(errs, errors.New(fmt.Sprintf("The retry status code [%d] %d is invalid!", i, code)))
+		}
+	}
+	return errs
+}
+
+// 不重试时返回nil
+func (s RetryConfig) policy() *dl.RetryPolicy {
+	if s.MaxRetries == 0 {
+		return nil
+	}
+	return &dl.RetryPolicy{
+		MaxRetries:    s.MaxRetries,
+		BaseDelay:     time.Duration(s.BaseDelay),
+		MaxDelay:      time.Duration(s.MaxDelay),
+		StatusCodes:   s.StatusCodes,
+		DisableJitter: s.DisableJitter,
+	}
+}
+
+// 把请求放回请求缓存, 间隔后重新下载
+func (s *myScheduler) retry(req *base.Request, retryErr *dl.RetryError, code string) {
+	logrus.Debugf("Retry %s: %s\n", req.HttpReq().URL, retryErr)
+	s.requeue(req, retryErr.Delay)
+}
+
+// 请求还没有完成, 放回请求缓存, delay后再取出; 使用共享队列时不会确认
+func (s *myScheduler) requeue(req *base.Request, delay time.Duration) {
+	if s.ctx.Err() != nil || s.stopSign.Signed() {
+		// 留在正在处理的请求中, 保存检查点时一起保存
+		return
+	}
+	req.SetNotBefore(time.Now().Add(delay))
+	key := s.canonicalizer.Key(req.HttpReq().URL)
+	s.reqCache.retry(req, key)
+	if s.trackInflight() {
+		s.inflightM.Lock()
+		delete(s.inflight, key)
+		s.inflightM.Unlock()
+	}
+}
@@ -0,0 +1,134 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"webcrawler/base"
+	dl "webcrawler/downloader"
+	"webcrawler/robots"
+
+	"github.com/bugfan/logrus"
+)
+
+const defaultUserAgent = "webcrawler/1.0"
+
+const (
+	META_ROBOTS_DEFERS = "robots_defers" // 请求因robots.txt无法访问被推迟的次数
+	robotsMaxDefers    = 10              // 超过后忽略请求
+)
+
+// robots.txt配置
+type RobotsConfig struct {
+	// 不遵守robots.txt
+	Ignore bool `json:"ignore" yaml:"ignore" toml:"ignore"`
+	// 缓存时间, 0表示使用默认值
+	TTL Duration `json:"ttl" yaml:"ttl" toml:"ttl"`
+	// 匹配robots.txt中User-agent的名字, 为空时使用UserAgent的产品名
+	Agent string `json:"agent" yaml:"agent" toml:"agent"`
+}
+
+func (s *CrawlConfig) userAgent() string {
+	if s.UserAgent == "" {
+		return defaultUserAgent
+	}
+	return s.UserAgent
+}
+func (s *CrawlConfig) robotsAgent() string {
+	if s.Robots.Agent != "" {
+		return s.Robots.Agent
+	}
+	return robots.ProductToken(s.userAgent())
+}
+
+// 请求没有设置User-Agent时使用配置的
+func (s *myScheduler) setUserAgent(httpReq *http.Request) {
+	if httpReq.Header == nil {
+		httpReq.Header = make(http.Header)
+	}
+	if httpReq.Header.Get("User-Agent") == "" {
+		httpReq.Header.Set("User-Agent", s.cfg.userAgent())
+	}
+}
+
+// 主机第一次被访问前用同一个下载器获取robots.txt, 被禁止的请求记为REJECT_ROBOTS
+// robots.txt无法访问(网络错误 429或5xx)时按RFC 9309暂时禁止访问该主机: 请求放回缓存,
+// 在robots.txt的缓存过期后再试, 推迟robotsMaxDefers次后才忽略
+// 返回false时请求已经被忽略或推迟
+func (s *myScheduler) allowedByRobots(downloader dl.PageDownloader, req *base.Request, code string) bool {
+	if s.cfg.Robots.Ignore {
+		return true
+	}
+	reqUrl := req.HttpReq().URL
+	origin := reqUrl.Scheme + "://" + reqUrl.Host
+	rules, err := s.robotsCache.Get(s.ctx, origin, func(ctx context.Context) (*robots.Robots, int, error) {
+		return s.fetchRobots(ctx, downloader, req)
+	})
+	if err == nil && !rules.Unreachable() {
+		if !rules.Allowed(s.cfg.robotsAgent(), reqUrl.RequestURI()) {
+			s.reject(req, REJECT_ROBOTS, "", code)
+			s.finishInflight(req)
+			return false
+		}
+		return true
+	}
+	if s.ctx.Err() != nil {
+		return false
+	}
+	detail := "robots.txt is unreachable"
+	if err != nil {
+		detail = fmt.Sprintf("robots.txt is unreachable: %s", err)
+	}
+	defers, _ := req.Meta(META_ROBOTS_DEFERS)
+	count, _ := defers.(uint32)
+	if count >= robotsMaxDefers {
+		s.reject(req, REJECT_ROBOTS, detail, code)
+		s.finishInflight(req)
+		return false
+	}
+	req.SetMeta(META_ROBOTS_DEFERS, count+1)
+	logrus.Debugf("Defer %s: %s\n", reqUrl, detail)
+	s.requeue(req, s.robotsCache.ErrorTTL())
+	return false
+}
+
+func (s *myScheduler) fetchRobots(ctx context.Context, downloader dl.PageDownloader, req *base.Request) (*robots.Robots, int, error) {
+	reqUrl := req.HttpReq().URL
+	httpReq, err := http.NewRequest(http.MethodGet, robots.URL(reqUrl.Scheme, reqUrl.Host), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.setUserAgent(httpReq)
+	robotsReq := base.NewRequest(httpReq, req.Depth())
+	robotsReq.SetSeed(req.Seed())
+	// 响应限制只针对交给解析函数的页面, robots.txt通常是text/plain
+	resp, err := downloader.Download(dl.WithoutLimits(ctx), robotsReq)
+	var retryErr *dl.RetryError
+	if errors.As(err, &retryErr) && retryErr.Response != nil {
+		// robots.txt不单独重试, 按状态码处理, 缓存过期后重新获取
+		rules, err := robots.FromResponse(retryErr.StatusCode, http.NoBody)
+		return rules, retryErr.StatusCode, err
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp == nil || !resp.Valid() {
+		return nil, 0, errors.New("The robots.txt response is invalid!")
+	}
+	httpResp := resp.HttpResp()
+	defer httpResp.Body.Close()
+	// 被中间件跳过的响应体为空, 不能当作允许所有
+	if resp.Skipped() {
+		return nil, httpResp.StatusCode, errors.New(fmt.Sprintf("The robots.txt response is skipped: %s", resp.SkipReason()))
+	}
+	rules, err := robots.FromResponse(httpResp.StatusCode, httpResp.Body)
+	if err != nil {
+		return nil, httpResp.StatusCode, err
+	}
+	if delay, ok := rules.CrawlDelay(s.cfg.robotsAgent()); ok {
+		key, _ := s.politeness.key(req)
+		s.politeness.setMinDelay(key, delay)
+	}
+	return rules, httpResp.StatusCode, nil
+}
@@ -1,35 +1,48 @@
 package scheduler
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 	anlz "webcrawler/analyzer"
 	"webcrawler/base"
+	"webcrawler/canonical"
+	"webcrawler/dedup"
 	dl "webcrawler/downloader"
+	"webcrawler/httpcache"
 	ipl "webcrawler/itempipeline"
 	mdw "webcrawler/middleware"
+	"webcrawler/proxy"
+	"webcrawler/robots"
+	"webcrawler/warc"
 
 	"github.com/bugfan/logrus"
 )
 
+// 每个下载器调用一次, 可以返回共享Transport的不同客户端
 type GenHttpClient func() *http.Client
 
 type Scheduler interface {
-	//
-	Start(channelLen uint,
-		poolSize uint32,
-		crawlDepth uint32,
-		httpClientGenerator GenHttpClient,
-		respParses []anlz.ParseResponse,
-		itemProcessors []ipl.ProcessItem,
-		firstHttpRsp *http.Request) (err error)
+	// ctx被取消或超时会中断下载和分析, 并处理完条目管道中剩余的条目
+	Start(ctx context.Context, cfg CrawlConfig) (err error)
+	// 从dir中的检查点继续爬取, cfg.Checkpoint.Dir为空时继续保存到dir
+	// 种子仍会被加入, 已经爬取过的会被去重
+	Resume(ctx context.Context, cfg CrawlConfig, dir string) (err error)
 	Stop() bool
 	Running() bool
 	ErrorChan() <-chan error
 	Idle() bool
+	// 按原因统计的被忽略的请求数量
+	RejectCounts() map[RejectReason]uint64
+	// 爬取结束(自行结束或被停止)时关闭
+	Done() <-chan struct{}
+	// 阻塞直到爬取结束或ctx结束
+	Wait(ctx context.Context) error
 	Summary(prefix string) SchedSummary
 }
 type SchedSummary interface {
@@ -39,28 +52,71 @@ type SchedSummary interface {
 }
 
 func NewScheduler() Scheduler {
-	return &myScheduler{}
+	return &myScheduler{done: make(chan struct{})}
 }
 
+const (
+	defaultScheduleInterval = 10 * time.Millisecond
+	idleCheckInterval       = 100 * time.Millisecond
+	idleConfirmTimes        = 3 // 连续空闲多少次才认为爬取已完成
+)
+
 type myScheduler struct {
-	poolSize      uint32
-	channelLen    uint
-	crawlDepth    uint32
-	primaryDomain string
-	chanman       mdw.ChannelManager
-	stopSign      mdw.StopSign
-	dlpool        dl.PageDownloaderPool
-	analyzerPool  anlz.AnalyzerPool
-	itemPipeLine  ipl.ItemPipeline
-	running       uint32 //运行 bool值
+	cfg              CrawlConfig
+	crawlDepth       uint32
+	scheduleInterval time.Duration
+	seeds            map[string]*seedScope // 种子 -> 爬取范围
+	schemes          map[string]bool       // 允许的协议
+	rejects          *rejectCounter        // 被忽略的请求
+	chanman          mdw.ChannelManager
+	stopSign         mdw.StopSign
+	dlpool           dl.PageDownloaderPool
+	analyzerPool     anlz.AnalyzerPool
+	itemPipeLine     ipl.ItemPipeline
+	running          uint32 //运行状态 0:未运行 1:运行中 2:已停止 3:正在停止
+	done             chan struct{}
+	ctx              context.Context    // 下载和分析使用
+	cancel           context.CancelFunc //
+	itemCtx          context.Context    // 条目处理使用, 不随ctx取消, 保证剩余条目能被处理完
 	// 辅助
-	reqCache requestCache
-	urlMap   map[string]bool
+	reqCache      requestCache
+	politeness    *politeness        // 从缓存中取出后等待主机空闲的请求
+	robotsCache   *robots.Cache      // key为scheme://host
+	proxyPool     proxy.Pool         // 没有配置代理时为空
+	httpCache     httpcache.Cache    // 没有配置缓存时为空
+	warcWriter    warc.Writer        // 没有配置WARC输出时为空
+	dedup         dedup.Deduplicator // key为规范化后的url
+	ownDedup      bool               // 去重器由调度器创建, 停止时关闭
+	canonicalizer canonical.Canonicalizer
+	workers       *taskCounter             // 正在进行的下载和分析
+	items         *taskCounter             // 正在处理的条目
+	errSenders    *taskCounter             // 正在发送的错误
+	dispatching   int32                    // 已从缓存取出还没有发往请求通道的请求
+	downloading   int32                    // 已发往请求通道还没有下载完的请求
+	stopping      chan struct{}            // 开始停止时关闭
+	scheduleDone  chan struct{}            // 调度循环已退出
+	itemLoopDone  chan struct{}            // 条目通道已读完
+	inflight      map[string]*base.Request // 正在处理的请求, 只在保存检查点或使用共享队列时记录
+	inflightM     sync.Mutex
+	m             sync.Mutex
+}
+
+func (s *myScheduler) Start(ctx context.Context, cfg CrawlConfig) (err error) {
+	return s.start(ctx, cfg, nil)
+}
+func (s *myScheduler) Resume(ctx context.Context, cfg CrawlConfig, dir string) (err error) {
+	state, err := loadCheckpoint(dir)
+	if err != nil {
+		return err
+	}
+	if cfg.Checkpoint.Dir == "" {
+		cfg.Checkpoint.Dir = dir
+	}
+	return s.start(ctx, cfg, state)
 }
 
-func (s *myScheduler) Start(channelLen uint, poolSize uint32, crawlDepth uint32, httpClientGenerator GenHttpClient, respParses []anlz.ParseResponse,
-	itemProcessors []ipl.ProcessItem,
-	firstHttpReq *http.Request) (err error) {
+// state不为空时从检查点恢复
+func (s *myScheduler) start(ctx context.Context, cfg CrawlConfig, state *checkpointState) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			errMsg := fmt.Sprintf("Schduler Error is :%s\n", r)
@@ -68,80 +124,400 @@ func (s *myScheduler) Start(channelLen uint, poolSize uint32, crawlDepth uint32,
 			err = errors.New(errMsg)
 		}
 	}()
-	if atomic.LoadUint32(&s.running) == 1 {
+	if ctx == nil {
+		return errors.New("The context is invalid!")
+	}
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return errors.New(fmt.Sprintf("The crawl config is invalid: %s", joinErrors(errs)))
+	}
+	// 停止完成(done已关闭)后才能再次启动
+	if !atomic.CompareAndSwapUint32(&s.running, 0, 1) && !atomic.CompareAndSwapUint32(&s.running, 2, 1) {
+		if atomic.LoadUint32(&s.running) == 3 {
+			return errors.New("The scheduler is stopping!")
+		}
 		return errors.New("The scheduler is started!")
 	}
-	atomic.StoreUint32(&s.running, 1)
-	if s.channelLen == 0 {
-		return errors.New(fmt.Sprintf("The channel max length (cap) can not be 0!\n"))
+	defer func() {
+		if err != nil {
+			atomic.StoreUint32(&s.running, 0)
+			s.closeWarc()
+		}
+	}()
+	s.cfg = cfg
+	s.crawlDepth = cfg.CrawlDepth
+	s.scheduleInterval = time.Duration(cfg.ScheduleInterval)
+	if s.scheduleInterval <= 0 {
+		s.scheduleInterval = defaultScheduleInterval
+	}
+	s.chanman = generateChannelManager(cfg.Channels.args())
+	if s.proxyPool, err = cfg.newProxyPool(); err != nil {
+		return err
 	}
-	s.channelLen = channelLen
-	if poolSize == 0 {
-		return errors.New(fmt.Sprintf("The pool size can not be 0!\n"))
+	if s.httpCache, err = cfg.newHttpCache(); err != nil {
+		return err
 	}
-	s.poolSize = poolSize
-	s.crawlDepth = crawlDepth
-	s.chanman = generateChannelManager(s.channelLen)
-	if httpClientGenerator == nil {
-		return errors.New(fmt.Sprintf("The http generate list is invalid!"))
+	if s.warcWriter, err = cfg.Warc.newWriter(); err != nil {
+		return err
 	}
-	dlpool, err := generatePageDownloaderPool(s.poolSize, httpClientGenerator)
+	dlpool, err := generatePageDownloaderPool(cfg.DownloaderPoolSize, cfg.HttpClientGenerator, time.Duration(cfg.RequestTimeout),
+		cfg.Retry.policy(), cfg.ResponseLimits.limits(), cfg.ResponseLimits.headerLimiter(), s.downloaderMiddlewares(), s.proxyPool)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Occur error when gen page downloader pool :%s\n", err))
 	}
 	s.dlpool = dlpool
-	analyzerPool, err := generateAnalyzerPool(s.poolSize)
+	analyzerPool, err := generateAnalyzerPool(cfg.AnalyzerPoolSize, cfg.BodyBuffer.options())
 	if err != nil {
-		if err != nil {
-			return errors.New(fmt.Sprintf("Occur error when gen analyzer pool :%s\n", err))
-		}
+		return errors.New(fmt.Sprintf("Occur error when gen analyzer pool :%s\n", err))
 	}
 	s.analyzerPool = analyzerPool
-	if itemProcessors == nil {
-		return errors.New(fmt.Sprintf("The item processor list is invalid!"))
-	}
-	for i, ip := range itemProcessors {
-		if ip == nil {
-			return errors.New(fmt.Sprintf("The item %d processor list is invalid!", i))
-		}
-	}
-	s.itemPipeLine = generateItemPipeLine(itemProcessors)
+	s.itemPipeLine = generateItemPipeLine(cfg.ItemProcessors)
 	if s.stopSign == nil {
 		s.stopSign = mdw.NewStopSign()
 	} else {
 		s.stopSign.Reset()
 	}
-	s.urlMap = make(map[string]bool)
+	s.canonicalizer = canonical.NewCanonicalizer(cfg.canonicalRules())
+	s.schemes = make(map[string]bool)
+	for _, scheme := range cfg.Scope.schemes() {
+		s.schemes[strings.ToLower(scheme)] = true
+	}
+	s.rejects = newRejectCounter()
+	if cfg.SharedFrontier != nil {
+		s.reqCache = newSharedRequestCache(cfg.SharedFrontier, func(err error) {
+			s.sendError(err, SCHEDULER_CODE)
+		})
+	} else {
+		s.reqCache = newRequestCache(cfg.Frontier.Strategy, cfg.ScoreFunc)
+	}
+	s.politeness = newPoliteness(cfg.Politeness)
+	s.robotsCache = robots.NewCache(time.Duration(cfg.Robots.TTL))
+	s.workers = newTaskCounter()
+	s.items = newTaskCounter()
+	s.errSenders = newTaskCounter()
+	atomic.StoreInt32(&s.dispatching, 0)
+	atomic.StoreInt32(&s.downloading, 0)
+	s.stopping = make(chan struct{})
+	s.scheduleDone = make(chan struct{})
+	s.itemLoopDone = make(chan struct{})
+	s.m.Lock()
+	select {
+	case <-s.done:
+		s.done = make(chan struct{})
+	default:
+	}
+	s.m.Unlock()
 
+	psl, err := cfg.Scope.publicSuffixList()
+	if err != nil {
+		return err
+	}
+	seedReqs := make([]*base.Request, 0, len(cfg.seeds))
+	s.seeds = make(map[string]*seedScope)
+	for _, seed := range cfg.seeds {
+		if _, ok := s.seeds[seed.URL]; ok {
+			continue
+		}
+		httpReq, err := http.NewRequest(http.MethodGet, seed.URL, nil)
+		if err != nil {
+			return err
+		}
+		s.seeds[seed.URL] = newSeedScope(seed, httpReq.Host, &s.cfg, psl)
+		req := base.NewRequest(httpReq, 0)
+		req.SetSeed(seed.URL)
+		seedReqs = append(seedReqs, req)
+	}
+	if s.dedup, err = cfg.newDeduplicator(); err != nil {
+		return errors.New(fmt.Sprintf("Occur error when gen deduplicator :%s\n", err))
+	}
+	s.ownDedup = cfg.Deduplicator == nil
+	s.inflight = make(map[string]*base.Request)
+	if state != nil {
+		if err = s.restoreCheckpoint(state); err != nil {
+			if s.ownDedup {
+				s.dedup.Close()
+			}
+			return err
+		}
+	}
+
+	if cfg.CrawlTimeout > 0 {
+		s.ctx, s.cancel = context.WithTimeout(ctx, time.Duration(cfg.CrawlTimeout))
+	} else {
+		s.ctx, s.cancel = context.WithCancel(ctx)
+	}
+	s.itemCtx = context.WithoutCancel(ctx)
 	s.startDownloading()
-	s.activateAnalyzers(respParses)
-	// s.openItemPipeLine()
-	// s.schedule(10 * time.Millisecond)
+	s.activateAnalyzers(cfg.RespParsers)
+	s.openItemPipeLine()
+	s.schedule(s.scheduleInterval)
 
-	if firstHttpReq == nil {
-		return errors.New(fmt.Sprintf("The firstHttpReq is invalid!"))
+	for _, req := range seedReqs {
+		key := s.canonicalizer.Key(req.HttpReq().URL)
+		added, err := s.dedup.Add(key)
+		if err != nil {
+			s.sendError(err, SCHEDULER_CODE)
+			continue
+		}
+		if added {
+			s.reqCache.put(req, key)
+		}
 	}
-	pd, err := getPrimaryDomain(firstHttpReq.Host)
-	if err != nil {
-		return err
+	if state == nil {
+		s.discoverSitemaps(seedReqs)
 	}
-	s.primaryDomain = pd
-	fristReq := base.NewRequest(firstHttpReq, 0)
-	s.reqCache.put(fristReq)
+	s.monitor()
+	s.watchContext()
 	return nil
 }
-func (s *myScheduler) activateAnalyzers(respParses []anlz.ParseResponse) {
+
+// 停止调度器: 等待正在进行的下载和分析结束, 处理完条目通道中剩余的条目, 然后关闭通道管理器
+func (s *myScheduler) Stop() bool {
+	if !atomic.CompareAndSwapUint32(&s.running, 1, 3) {
+		return false
+	}
+	s.stopSign.Sign()
+	close(s.stopping)
+	s.reqCache.close()
+	<-s.scheduleDone
+	s.workers.closeAndWait()
+	s.errSenders.closeAndWait()
+	s.chanman.Close()
+	<-s.itemLoopDone
+	s.items.closeAndWait()
+	if s.cfg.Checkpoint.Dir != "" {
+		if err := s.saveCheckpoint(); err != nil {
+			logrus.Errorln(err)
+		}
+	}
+	if s.ownDedup {
+		if err := s.dedup.Close(); err != nil {
+			logrus.Errorln("Occur error when close deduplicator :", err)
+		}
+	}
+	s.closeWarc()
+	// 设置为已停止后可能马上再次启动, 之后不能再读取本次运行的字段
+	summary := s.stopSign.Summary()
+	// 和关闭done一起持有锁, 再次启动时一定能看到done已关闭; 先关闭done再取消ctx, 见watchContext
+	s.m.Lock()
+	atomic.StoreUint32(&s.running, 2)
+	close(s.done)
+	s.cancel()
+	s.m.Unlock()
+	logrus.Infof("Scheduler stopped: %s\n", summary)
+	return true
+}
+func (s *myScheduler) Running() bool {
+	return atomic.LoadUint32(&s.running) == 1
+}
+
+// 下载器池和分析器池都未被使用, 没有正在调度或下载的请求, 请求缓存为空, 各通道均已读完
+func (s *myScheduler) Idle() bool {
+	if !s.Running() {
+		return true
+	}
+	if atomic.LoadInt32(&s.dispatching) > 0 || atomic.LoadInt32(&s.downloading) > 0 {
+		return false
+	}
+	if s.dlpool.Used() > 0 || s.analyzerPool.Used() > 0 || s.itemPipeLine.ProcessingNumber() > 0 {
+		return false
+	}
+	if s.workers.count() > 0 || s.items.count() > 0 || s.reqCache.length() > 0 {
+		return false
+	}
+	reqChan, err := s.chanman.ReqChan()
+	if err != nil {
+		return true
+	}
+	respChan, err := s.chanman.RespChan()
+	if err != nil {
+		return true
+	}
+	itemChan, err := s.chanman.ItemChan()
+	if err != nil {
+		return true
+	}
+	return len(reqChan) == 0 && len(respChan) == 0 && len(itemChan) == 0
+}
+func (s *myScheduler) RejectCounts() map[RejectReason]uint64 {
+	if s.rejects == nil {
+		return map[RejectReason]uint64{}
+	}
+	return s.rejects.snapshot()
+}
+func (s *myScheduler) Done() <-chan struct{} {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.done
+}
+func (s *myScheduler) Wait(ctx context.Context) error {
+	select {
+	case <-s.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ctx结束时停止调度器
+// Stop关闭done后才取消ctx, 这时调度器可能已再次启动, 不能停止新的运行
+func (s *myScheduler) watchContext() {
+	ctx, done := s.ctx, s.Done()
 	go func() {
+		select {
+		case <-ctx.Done():
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if s.Running() {
+				logrus.Infof("The context is done (%s), stop crawling\n", ctx.Err())
+				s.Stop()
+			}
+		case <-done:
+		}
+	}()
+}
+func (s *myScheduler) Summary(prefix string) SchedSummary {
+	return newSchedSummary(s, prefix)
+}
+
+// 监控调度器, 连续空闲时自动停止
+// 只监控本次运行: 停止后马上再次启动时, 睡眠中的上一个监控看到done已关闭就退出
+func (s *myScheduler) monitor() {
+	done := s.Done()
+	go func() {
+		idleCount := 0
+		for s.Running() {
+			time.Sleep(idleCheckInterval)
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if !s.Idle() {
+				idleCount = 0
+				continue
+			}
+			idleCount++
+			if idleCount >= idleConfirmTimes {
+				logrus.Infoln("The scheduler is idle, stop crawling")
+				s.Stop()
+				return
+			}
+		}
+	}()
+}
+func (s *myScheduler) ErrorChan() <-chan error {
+	if s.chanman == nil || s.chanman.Status() != mdw.CHANNEL_MANAGER_STATUS_INITIALIZED {
+		return nil
+	}
+	return s.getErrorChan()
+}
+
+// 把请求缓存中的请求按间隔调度到请求通道
+func (s *myScheduler) schedule(interval time.Duration) {
+	go func() {
+		defer close(s.scheduleDone)
+		lastCheckpoint := time.Now()
 		for {
-			resp, ok := <-s.getRespChan()
-			if !ok {
-				break
+			if s.stopSign.Signed() {
+				s.stopSign.Deal(SCHEDULER_CODE)
+				return
+			}
+			if s.cfg.Checkpoint.Dir != "" && time.Since(lastCheckpoint) >= s.cfg.Checkpoint.interval() {
+				if s.waitQuiet() {
+					if err := s.saveCheckpoint(); err != nil {
+						s.sendError(err, SCHEDULER_CODE)
+					}
+				}
+				lastCheckpoint = time.Now()
+				continue
+			}
+			reqChan := s.getReqChan()
+			remainder := cap(reqChan) - len(reqChan)
+			// 只取出空闲的下载器能处理的数量, 其余的留在缓存中按策略排序
+			if free := int(s.dlpool.Total()) - int(atomic.LoadInt32(&s.downloading)); free < remainder {
+				remainder = free
+			}
+			for remainder > 0 {
+				// 从取出到发往请求通道之间的请求也不是空闲的
+				atomic.AddInt32(&s.dispatching, 1)
+				// 按策略的顺序取出第一个主机空闲的请求, 主机忙的请求留在缓存中
+				req := s.reqCache.get(func(req *base.Request) bool {
+					return s.politeness.tryStart(req, time.Now())
+				})
+				if req == nil {
+					atomic.AddInt32(&s.dispatching, -1)
+					break
+				}
+				// 先记为正在处理, 停止时没有发出的请求会保存在检查点中
+				s.startInflight(req)
+				if s.stopSign.Signed() {
+					atomic.AddInt32(&s.dispatching, -1)
+					s.stopSign.Deal(SCHEDULER_CODE)
+					return
+				}
+				atomic.AddInt32(&s.downloading, 1)
+				atomic.AddInt32(&s.dispatching, -1)
+				reqChan <- *req
+				remainder--
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// 打开条目处理管道
+func (s *myScheduler) openItemPipeLine() {
+	itemChan := s.getItemChan()
+	go func() {
+		defer close(s.itemLoopDone)
+		s.itemPipeLine.SetFailFast(true)
+		code := ITEMPIPELINE_CODE
+		for item := range itemChan {
+			if !s.items.add() {
+				s.stopSign.Deal(code)
+				continue
+			}
+			go func(item base.Item) {
+				defer s.items.done()
+				defer func() {
+					if r := recover(); r != nil {
+						logrus.Fatal("Fatal item processing error :", r)
+					}
+				}()
+				errs := s.itemPipeLine.Send(s.itemCtx, item)
+				for _, err := range errs {
+					s.sendError(err, code)
+				}
+			}(item)
+		}
+	}()
+}
+func (s *myScheduler) activateAnalyzers(respParses []anlz.ParseResponse) {
+	respChan := s.getRespChan()
+	go func() {
+		for resp := range respChan {
+			if !s.workers.add() {
+				s.stopSign.Deal(ANALYZER_CODE)
+				continue
 			}
-			go s.analyze(respParses, resp)
+			go func(resp base.Response) {
+				defer s.workers.done()
+				s.analyze(respParses, resp)
+			}(resp)
 		}
 	}()
 }
 func (s *myScheduler) analyze(respParses []anlz.ParseResponse, resp base.Response) {
+	// 被ctx打断的分析结果不完整, 请求留在正在处理的请求中, 保存检查点后恢复时重新下载; 其它情况(包括出错)都完成请求
+	interrupted := false
+	defer func() {
+		if !interrupted {
+			s.finishInflight(resp.Request())
+		}
+	}()
 	defer func() {
 		if r := recover(); r != nil {
 			logrus.Fatal("Fatal analyze error :", r)
@@ -159,7 +535,7 @@ func (s *myScheduler) analyze(respParses []anlz.ParseResponse, resp base.Respons
 		}
 	}()
 	code := generateCode(ANALYZER_CODE, anlyzer.Id())
-	dataList, errs := anlyzer.Analyze(respParses, resp)
+	dataList, errs := anlyzer.Analyze(s.ctx, respParses, resp)
 	if dataList != nil {
 		for _, data := range dataList {
 			if data == nil {
@@ -168,6 +544,8 @@ func (s *myScheduler) analyze(respParses []anlz.ParseResponse, resp base.Respons
 			switch d := data.(type) {
 			case *base.Request:
 				s.saveReqToCache(*d, code)
+			case base.Item:
+				s.sendItem(d, code)
 			case *base.Item:
 				s.sendItem(*d, code)
 			default:
@@ -175,17 +553,54 @@ func (s *myScheduler) analyze(respParses []anlz.ParseResponse, resp base.Respons
 			}
 		}
 	}
+	// 出链已经放进缓存, 现金只分给其中还在队列中的请求
+	if s.cfg.Frontier.Strategy == FRONTIER_OPIC {
+		s.linkResp(resp, dataList)
+	}
+	for _, err := range errs {
+		if s.interruptedBy(err) {
+			interrupted = true
+		}
+		s.sendError(err, code)
+	}
+}
+
+// 错误是否因为爬取的ctx结束
+func (s *myScheduler) interruptedBy(err error) bool {
+	ctxErr := s.ctx.Err()
+	return ctxErr != nil && errors.Is(err, ctxErr)
+}
+
+// 把响应页面的现金分给它的出链; 现金记在请求(而不是重定向后)的url上
+func (s *myScheduler) linkResp(resp base.Response, dataList []base.Data) {
+	req := resp.Request()
+	if req == nil || !req.Valid() {
+		return
+	}
+	links := make([]string, 0)
+	for _, data := range dataList {
+		if link, ok := data.(*base.Request); ok && link.Valid() {
+			links = append(links, s.canonicalizer.Key(link.HttpReq().URL))
+		}
+	}
+	s.reqCache.link(s.canonicalizer.Key(req.HttpReq().URL), links)
 }
 
 // method step 1
 func (s *myScheduler) startDownloading() {
+	reqChan := s.getReqChan()
 	go func() {
-		for {
-			req, ok := <-s.getReqChan()
-			if !ok {
-				break
+		for req := range reqChan {
+			if !s.workers.add() {
+				atomic.AddInt32(&s.downloading, -1)
+				s.stopSign.Deal(DOWNLOADER_CODE)
+				continue
 			}
-			go s.download(req)
+			go func(req base.Request) {
+				defer s.workers.done()
+				defer atomic.AddInt32(&s.downloading, -1)
+				s.download(req)
+			}(req)
 		}
 	}()
 }
@@ -218,6 +633,13 @@ func (s *myScheduler) getItemChan() chan base.Item {
 	return itemChan
 }
 func (s *myScheduler) download(req base.Request) {
+	// 响应交给分析器 请求被推迟或放回缓存后由它们负责, 其它情况(包括出错)都在返回时完成请求
+	finish := true
+	defer func() {
+		if finish {
+			s.finishInflight(&req)
+		}
+	}()
 	defer func() {
 		if r := recover(); r != nil {
 			logrus.Fatal("Fatal download error :", r)
@@ -235,16 +657,50 @@ func (s *myScheduler) download(req base.Request) {
 		}
 	}()
 	code := generateCode(DOWNLOADER_CODE, downloader.Id())
-	resp, err := downloader.Download(&req)
+	s.setUserAgent(req.HttpReq())
+	if !s.allowedByRobots(downloader, &req, code) {
+		finish = false
+		s.politeness.finish(&req, 0, nil)
+		return
+	}
+	start := time.Now()
+	resp, err := downloader.Download(s.ctx, &req)
+	var httpResp *http.Response
+	var retryErr *dl.RetryError
+	if errors.As(err, &retryErr) {
+		httpResp = retryErr.Response
+	} else if resp != nil {
+		httpResp = resp.HttpResp()
+	}
+	s.politeness.finish(&req, time.Since(start), httpResp)
+	if retryErr != nil {
+		finish = false
+		s.retry(&req, retryErr, code)
+		return
+	}
+	if errors.Is(err, dl.ErrDropRequest) {
+		s.reject(&req, REJECT_DROPPED, err.Error(), code)
+		return
+	}
+	if resp != nil && resp.Skipped() {
+		s.reject(&req, REJECT_SKIPPED, resp.SkipReason(), code)
+		return
+	}
 	if resp != nil {
+		// 停止时响应被丢弃, 请求留给检查点
+		finish = false
 		s.sendResp(*resp, code)
 	}
 	if err != nil {
+		// 停止时被打断的下载留给检查点
+		if s.interruptedBy(err) {
+			finish = false
+		}
 		s.sendError(err, code)
 	}
 }
 func (s *myScheduler) sendError(err error, code string) bool {
-	if err != nil {
+	if err == nil {
 		return false
 	}
 	codePrefix := parseCode(code)[0]
@@ -262,8 +718,15 @@ func (s *myScheduler) sendError(err error, code string) bool {
 		s.stopSign.Deal(code)
 		return false
 	}
+	if !s.errSenders.add() {
+		return false
+	}
 	go func() {
-		s.getErrorChan() <- cError
+		defer s.errSenders.done()
+		select {
+		case s.getErrorChan() <- cError:
+		case <-s.stopping:
+		}
 	}()
 
 	return true
@@ -276,39 +739,46 @@ func (s *myScheduler) sendResp(resp base.Response, code string) bool {
 	s.getRespChan() <- resp
 	return true
 }
+
+// 停止时正在进行的分析产生的条目也会被处理, 停止时等分析结束后才关闭条目通道
+func (s *myScheduler) sendItem(item base.Item, code string) bool {
+	s.getItemChan() <- item
+	return true
+}
 func (s *myScheduler) saveReqToCache(req base.Request, code string) bool {
 	httpReq := req.HttpReq()
 	if httpReq == nil {
-		logrus.Warnln("Ignore the request !it is nil http")
-		return false
+		return s.reject(&req, REJECT_INVALID_REQUEST, "the http request is nil", code)
 	}
-	reqUrl := httpReq.URL
-	if reqUrl == nil {
-		logrus.Warnln("Ignore the request ! it url is invalid")
-		return false
+	if httpReq.URL == nil {
+		return s.reject(&req, REJECT_INVALID_REQUEST, "the url is nil", code)
 	}
-	if strings.ToLower(reqUrl.Scheme) != "http" {
-		logrus.Warnln("Ignore the request ! it scheme is not http")
-		return false
+	// 去重和范围判断都使用规范化后的url
+	reqUrl := s.canonicalizer.Canonicalize(httpReq.URL)
+	if !s.schemes[reqUrl.Scheme] {
+		return s.reject(&req, REJECT_SCHEME, reqUrl.Scheme, code)
 	}
-	if _, ok := s.urlMap[reqUrl.String()]; ok {
-		logrus.Warnln("Ignore the request ! it url is repeated :", reqUrl)
-		return false
+	scope, ok := s.seeds[req.Seed()]
+	if !ok {
+		return s.reject(&req, REJECT_UNKNOWN_SEED, "", code)
 	}
-	if pd, _ := getPrimaryDomain(httpReq.Host); pd != s.primaryDomain {
-		logrus.Warnln("Ignore the request ! it host is not promaryDomain repeated :",
-			httpReq.Host, s.primaryDomain, reqUrl)
-		return false
+	if !scope.contains(reqUrl.Host) {
+		return s.reject(&req, REJECT_OUT_OF_SCOPE, reqUrl.Host, code)
 	}
-	if req.Depth() > s.crawlDepth {
-		logrus.Warnln("Ignore the request ! it depth is greater than :", req.Depth(), s.crawlDepth, reqUrl)
-		return false
+	if req.Depth() > scope.maxDepth {
+		return s.reject(&req, REJECT_TOO_DEEP, fmt.Sprintf("max depth %d", scope.maxDepth), code)
 	}
-	if s.stopSign.Signed() {
-		s.stopSign.Deal(code)
+	// 停止时仍然放进缓存(不会再被取出), 已完成请求的出链和去重器一起保存到检查点
+	key := reqUrl.String()
+	added, err := s.dedup.Add(key)
+	if err != nil {
+		s.sendError(err, SCHEDULER_CODE)
 		return false
 	}
-	s.reqCache.put(&req)
+	if !added {
+		return s.reject(&req, REJECT_REPEATED, "", code)
+	}
+	return s.reqCache.put(&req, key)
 }
 
 const (
@@ -321,7 +791,7 @@ const (
 // 辅助方法
 func generateCode(code string, id uint32) string {
 	//生成唯一的标识
-	return fmt.Sprintf("%s:%s", code, string(id))
+	return fmt.Sprintf("%s:%d", code, id)
 }
 func parseCode(code string) []string {
 	tokens := strings.Split(code, ":")
@@ -330,28 +800,81 @@ func parseCode(code string) []string {
 	}
 	return []string{"NONE", "0"}
 }
-func generateChannelManager(l uint) mdw.ChannelManager {
-	return mdw.NewChannelManager(l)
+func generateChannelManager(args mdw.ChannelArgs) mdw.ChannelManager {
+	return mdw.NewChannelManager(args)
 }
-func generatePageDownloaderPool(l uint32, hcg GenHttpClient) (dl.PageDownloaderPool, error) {
-	return dl.NewPageDownloaderPool(l, nil)
+
+// 每个下载器使用生成器创建的客户端, 客户端没有设置超时时使用RequestTimeout
+// 限制响应头和使用代理时包装客户端的Transport, 不会修改生成器返回的客户端
+func generatePageDownloaderPool(l uint32, hcg GenHttpClient, timeout time.Duration, retry *dl.RetryPolicy, limits *dl.ResponseLimits,
+	limitHeader func(base http.RoundTripper) http.RoundTripper, middlewares []dl.DownloaderMiddleware, proxies proxy.Pool) (dl.PageDownloaderPool, error) {
+	gen := func() dl.PageDownloader {
+		client := hcg()
+		if client == nil {
+			client = &http.Client{}
+		}
+		copied := *client
+		if copied.Timeout == 0 {
+			copied.Timeout = timeout
+		}
+		copied.Transport = limitHeader(copied.Transport)
+		if proxies != nil {
+			copied.Transport = proxies.Transport(copied.Transport)
+		}
+		return dl.NewPageDownloader(&copied, retry, limits, middlewares...)
+	}
+	return dl.NewPageDownloaderPool(l, gen)
 }
-func generateAnalyzerPool(l uint32) (anlz.AnalyzerPool, error) {
-	return anlz.NewAnalyzerPool(l, nil)
+func generateAnalyzerPool(l uint32, buffer base.BufferOptions) (anlz.AnalyzerPool, error) {
+	gen := func() anlz.Analyzer {
+		return anlz.NewAnalyzer(buffer)
+	}
+	return anlz.NewAnalyzerPool(l, gen)
 }
 func generateItemPipeLine(itemProcessors []ipl.ProcessItem) ipl.ItemPipeline {
 	return ipl.NewItemPipeline(itemProcessors)
 }
-func getPrimaryDomain(host string) (string, error) {
-	tmp := ""
-	tokens := strings.Split(host, ".")
-	l := len(tokens)
-	if l < 2 {
-		return "", errors.New("not a domain!")
+
+// 计数器, 关闭后不再接受新的任务
+type taskCounter struct {
+	n      int
+	closed bool
+	m      sync.Mutex
+	cond   *sync.Cond
+}
+
+func newTaskCounter() *taskCounter {
+	tc := &taskCounter{}
+	tc.cond = sync.NewCond(&tc.m)
+	return tc
+}
+func (s *taskCounter) add() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return false
 	}
-	if tokens[l-1] == "cn" {
-		tmp = tokens[l-3] + "." + tokens[l-1]
+	s.n++
+	return true
+}
+func (s *taskCounter) done() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.n--
+	if s.n <= 0 {
+		s.cond.Broadcast()
+	}
+}
+func (s *taskCounter) count() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.n
+}
+func (s *taskCounter) closeAndWait() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.closed = true
+	for s.n > 0 {
+		s.cond.Wait()
 	}
-	tmp = tokens[l-2] + "." + tokens[l-1]
-	return tmp, nil
 }
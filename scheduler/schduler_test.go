@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	anlz "webcrawler/analyzer"
+	"webcrawler/base"
+	ipl "webcrawler/itempipeline"
+)
+
+// 停止还没有完成时不能再次启动, done关闭后可以
+func TestRestartAfterStop(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+	}))
+	defer srv.Close()
+	blocked := make(chan struct{}, 1)
+	release := make(chan struct{})
+	cfg := testConfig(CrawlConfig{
+		CrawlDepth: 1,
+		Seeds:      []Seed{{URL: srv.URL + "/"}},
+		RespParsers: []anlz.ParseResponse{func(ctx context.Context, httpResp *http.Response, respDepth uint32) ([]base.Data, []error) {
+			return []base.Data{base.Item{"url": httpResp.Request.URL.String()}}, nil
+		}},
+		// 第一次爬取时条目处理被卡住, 停止要等它结束
+		ItemProcessors: []ipl.ProcessItem{func(ctx context.Context, item base.Item) (base.Item, error) {
+			select {
+			case blocked <- struct{}{}:
+			default:
+			}
+			<-release
+			return item, nil
+		}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	sched := NewScheduler()
+	if err := sched.Start(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+	errs := drainErrors(sched)
+	<-blocked
+	done := sched.Done()
+	stopped := make(chan bool)
+	go func() {
+		stopped <- sched.Stop()
+	}()
+	for sched.Running() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := sched.Start(ctx, cfg); err == nil {
+		t.Fatal("Start() succeeded while the scheduler is stopping")
+	}
+	select {
+	case <-done:
+		t.Fatal("the scheduler is done before the item is processed")
+	default:
+	}
+	close(release)
+	if !<-stopped {
+		t.Error("Stop() = false")
+	}
+	<-done
+	if errs := errs(); len(errs) > 0 {
+		t.Errorf("crawl errors: %v", errs)
+	}
+
+	if err := sched.Start(ctx, cfg); err != nil {
+		t.Fatalf("Start() after Stop() = %v", err)
+	}
+	errs = drainErrors(sched)
+	if err := sched.Wait(ctx); err != nil {
+		t.Fatalf("the second crawl is not done: %s", err)
+	}
+	if errs := errs(); len(errs) > 0 {
+		t.Errorf("crawl errors: %v", errs)
+	}
+}
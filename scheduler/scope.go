@@ -0,0 +1,111 @@
+package scheduler
+
+import (
+	"net"
+	"strings"
+	"webcrawler/publicsuffix"
+)
+
+// 爬取范围模式
+type ScopeMode string
+
+const (
+	SCOPE_SAME_HOST   ScopeMode = "host"      // 与种子的主机名相同
+	SCOPE_SAME_DOMAIN ScopeMode = "domain"    // 与种子的可注册域名(eTLD+1)相同
+	SCOPE_SUBDOMAIN   ScopeMode = "subdomain" // 种子的主机名及其子域名
+	SCOPE_ALLOWLIST   ScopeMode = "allowlist" // 只允许指定的域名
+)
+
+func (s ScopeMode) valid() bool {
+	switch s {
+	case SCOPE_SAME_HOST, SCOPE_SAME_DOMAIN, SCOPE_SUBDOMAIN, SCOPE_ALLOWLIST:
+		return true
+	}
+	return false
+}
+
+// 种子的爬取范围
+type seedScope struct {
+	seed           string
+	mode           ScopeMode
+	host           string   // 种子的主机名
+	domain         string   // 种子的可注册域名
+	allowedDomains []string // 种子指定的和全局允许的域名
+	maxDepth       uint32
+	psl            *publicsuffix.List
+}
+
+func newSeedScope(seed Seed, host string, cfg *CrawlConfig, psl *publicsuffix.List) *seedScope {
+	scope := &seedScope{
+		seed:     seed.URL,
+		mode:     seed.Scope,
+		host:     hostname(host),
+		maxDepth: cfg.CrawlDepth,
+		psl:      psl,
+	}
+	if scope.mode == "" {
+		if len(seed.AllowedDomains) > 0 {
+			scope.mode = SCOPE_ALLOWLIST
+		} else {
+			scope.mode = cfg.Scope.mode()
+		}
+	}
+	scope.domain = registrableDomain(psl, scope.host)
+	if seed.MaxDepth != nil {
+		scope.maxDepth = *seed.MaxDepth
+	}
+	domains := make([]string, 0, len(seed.AllowedDomains)+len(cfg.Scope.AllowedDomains))
+	domains = append(domains, seed.AllowedDomains...)
+	domains = append(domains, cfg.Scope.AllowedDomains...)
+	for _, domain := range domains {
+		scope.allowedDomains = append(scope.allowedDomains, strings.ToLower(strings.TrimPrefix(domain, ".")))
+	}
+	return scope
+}
+
+// 按模式判断主机是否在范围内, 允许的域名在任何模式下都在范围内
+func (s *seedScope) contains(host string) bool {
+	name := hostname(host)
+	switch s.mode {
+	case SCOPE_SAME_HOST:
+		if name == s.host {
+			return true
+		}
+	case SCOPE_SUBDOMAIN:
+		if isSubdomain(name, s.host) {
+			return true
+		}
+	case SCOPE_SAME_DOMAIN:
+		if registrableDomain(s.psl, name) == s.domain {
+			return true
+		}
+	}
+	for _, domain := range s.allowedDomains {
+		if isSubdomain(name, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// 去掉端口并转为小写
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
+
+// name与domain相同或是其子域名
+func isSubdomain(name string, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// 可注册域名, ip地址和公共后缀本身返回主机名
+func registrableDomain(psl *publicsuffix.List, name string) string {
+	domain, err := psl.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return name
+	}
+	return domain
+}
@@ -0,0 +1,159 @@
+package scheduler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 种子, 每个种子有自己的爬取范围和深度
+type Seed struct {
+	URL string `json:"url" yaml:"url" toml:"url"`
+	// 允许的域名(包括其子域名), 为空时使用种子所在的主域名
+	AllowedDomains []string `json:"allowed_domains,omitempty" yaml:"allowed_domains,omitempty" toml:"allowed_domains,omitempty"`
+	// 从该种子出发的最大深度, 为空时使用CrawlConfig.CrawlDepth
+	MaxDepth *uint32 `json:"max_depth,omitempty" yaml:"max_depth,omitempty" toml:"max_depth,omitempty"`
+	// 爬取范围模式, 为空时: 指定了允许的域名则为allowlist, 否则使用ScopeConfig.Mode
+	Scope ScopeMode `json:"scope,omitempty" yaml:"scope,omitempty" toml:"scope,omitempty"`
+}
+
+// 种子在配置文件中可以直接写成url字符串
+func (s *Seed) UnmarshalJSON(data []byte) error {
+	var rawUrl string
+	if err := json.Unmarshal(data, &rawUrl); err == nil {
+		*s = Seed{URL: rawUrl}
+		return nil
+	}
+	type plain Seed
+	var seed plain
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&seed); err != nil {
+		return err
+	}
+	*s = Seed(seed)
+	return nil
+}
+func (s *Seed) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var rawUrl string
+	if err := unmarshal(&rawUrl); err == nil {
+		*s = Seed{URL: rawUrl}
+		return nil
+	}
+	type plain Seed
+	var seed plain
+	if err := unmarshal(&seed); err != nil {
+		return err
+	}
+	*s = Seed(seed)
+	return nil
+}
+func (s *Seed) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		*s = Seed{URL: v}
+	case map[string]interface{}:
+		*s = Seed{}
+		for key, value := range v {
+			switch key {
+			case "url":
+				rawUrl, ok := value.(string)
+				if !ok {
+					return errors.New(fmt.Sprintf("The seed url %v is not a string!", value))
+				}
+				s.URL = rawUrl
+			case "allowed_domains":
+				domains, ok := value.([]interface{})
+				if !ok {
+					return errors.New(fmt.Sprintf("The seed allowed_domains %v is not a list!", value))
+				}
+				for _, d := range domains {
+					domain, ok := d.(string)
+					if !ok {
+						return errors.New(fmt.Sprintf("The seed allowed domain %v is not a string!", d))
+					}
+					s.AllowedDomains = append(s.AllowedDomains, domain)
+				}
+			case "max_depth":
+				depth, ok := value.(int64)
+				if !ok || depth < 0 {
+					return errors.New(fmt.Sprintf("The seed max_depth %v is invalid!", value))
+				}
+				maxDepth := uint32(depth)
+				s.MaxDepth = &maxDepth
+			case "scope":
+				mode, ok := value.(string)
+				if !ok {
+					return errors.New(fmt.Sprintf("The seed scope %v is not a string!", value))
+				}
+				s.Scope = ScopeMode(mode)
+			default:
+				return errors.New(fmt.Sprintf("Unknown seed field %q!", key))
+			}
+		}
+	default:
+		return errors.New(fmt.Sprintf("Unsupported seed %v!", data))
+	}
+	return nil
+}
+
+// 检查种子
+func (s Seed) check() error {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return errors.New("not an absolute url")
+	}
+	for i, domain := range s.AllowedDomains {
+		if strings.TrimSpace(domain) == "" || strings.ContainsAny(domain, "/:") {
+			return errors.New(fmt.Sprintf("the allowed domain [%d] %q is invalid", i, domain))
+		}
+	}
+	if s.Scope != "" && !s.Scope.valid() {
+		return errors.New(fmt.Sprintf("the scope mode %q is invalid", s.Scope))
+	}
+	return nil
+}
+
+// 从文件读取种子
+// .jsonl文件每行一个json对象(或url字符串), 其它文件每行一个url, 空行和#开头的行会被忽略
+func LoadSeeds(path string) ([]Seed, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	jsonl := strings.ToLower(filepath.Ext(path)) == ".jsonl"
+	seeds := make([]Seed, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !jsonl {
+			seeds = append(seeds, Seed{URL: line})
+			continue
+		}
+		var seed Seed
+		if err := json.Unmarshal([]byte(line), &seed); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s:%d: %s", path, lineNo, err))
+		}
+		seeds = append(seeds, seed)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return seeds, nil
+}
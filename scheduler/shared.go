@@ -0,0 +1,213 @@
+package scheduler
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+	"time"
+	"webcrawler/base"
+)
+
+const (
+	sharedPollBatch    = 16                     // 每次从共享队列取出的最大请求数
+	sharedPollInterval = 200 * time.Millisecond // 共享队列为空时两次取请求的最小间隔
+)
+
+// 多个爬虫进程共享的待爬取队列, 如distributed.Worker (并发安全)
+// 设置后由它负责全局去重和分配请求, 本地的去重器只用于减少重复提交, Frontier配置被忽略
+type SharedFrontier interface {
+	// 提交新发现的请求
+	Submit(reqs []SharedRequest) error
+	// 取出最多max个分配给本进程的请求
+	Poll(max int) ([]*base.Request, error)
+	// req已处理完成, 同时提交它产生的请求; 没有完成的请求会被重新分配给其它进程
+	Complete(req *base.Request, reqs []SharedRequest) error
+	// 所有进程的请求是否都已处理完
+	Finished() bool
+	// 本地还没有完成的请求(等待重试或主机空闲), 每次变化时传入全部
+	// 实现应在它们超时前续期, 避免重新分配给其它进程后重复爬取
+	Hold(reqs []*base.Request)
+}
+
+// 提交到共享队列的请求, Key为规范化后的url
+type SharedRequest struct {
+	Req *base.Request
+	Key string
+}
+
+// 基于共享队列的请求缓存
+// 新请求先在本地攒着, 请求完成时和确认一起提交, 取请求时也会提交
+// 需要重试的请求还没有确认, 留在本地重试并由共享队列续期, 本进程离开时由协调者重新分配
+type reqCacheByShared struct {
+	frontier SharedFrontier
+	onError  func(err error)
+	polled   []*base.Request // 已取出还没有发出的请求
+	pending  []SharedRequest // 还没有提交的请求
+	delayed  delayedItems    // 还没到重试时间的请求
+	retried  uint64
+	seq      uint64
+	lastPoll time.Time // 上一次取到空的时间
+	changed  bool      // polled或delayed变化后还没有调用Hold
+	m        sync.Mutex
+	status   byte // 0:运行中 1:已关闭
+}
+
+func newSharedRequestCache(frontier SharedFrontier, onError func(err error)) requestCache {
+	return &reqCacheByShared{
+		frontier: frontier,
+		onError:  onError,
+		polled:   make([]*base.Request, 0),
+		pending:  make([]SharedRequest, 0),
+		delayed:  make(delayedItems, 0),
+	}
+}
+
+func (s *reqCacheByShared) put(req *base.Request, key string) bool {
+	if req == nil {
+		return false
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.pending = append(s.pending, SharedRequest{Req: req, Key: key})
+	return true
+}
+
+// 只在调度循环中调用, 网络请求时不持有锁; 已取出的请求按取出的顺序尝试
+func (s *reqCacheByShared) get(take func(req *base.Request) bool) *base.Request {
+	s.flush()
+	s.hold()
+	s.m.Lock()
+	if s.status == 1 {
+		s.m.Unlock()
+		return nil
+	}
+	if len(s.delayed) > 0 && !s.delayed[0].req.NotBefore().After(time.Now()) && (take == nil || take(s.delayed[0].req)) {
+		req := heap.Pop(&s.delayed).(*frontierItem).req
+		s.changed = true
+		s.m.Unlock()
+		return req
+	}
+	if len(s.polled) == 0 && time.Since(s.lastPoll) < sharedPollInterval {
+		s.m.Unlock()
+		return nil
+	}
+	if len(s.polled) == 0 {
+		s.m.Unlock()
+		reqs, err := s.frontier.Poll(sharedPollBatch)
+		if err != nil {
+			s.onError(err)
+		}
+		s.m.Lock()
+		s.polled = append(s.polled, reqs...)
+		s.changed = true
+		if len(s.polled) == 0 {
+			s.lastPoll = time.Now()
+			s.m.Unlock()
+			return nil
+		}
+	}
+	for i, req := range s.polled {
+		if take != nil && !take(req) {
+			continue
+		}
+		s.polled = append(s.polled[:i], s.polled[i+1:]...)
+		s.changed = true
+		s.m.Unlock()
+		return req
+	}
+	s.m.Unlock()
+	return nil
+}
+
+// 提交攒着的请求, 失败时留到下次
+func (s *reqCacheByShared) flush() {
+	reqs := s.takePending()
+	if len(reqs) == 0 {
+		return
+	}
+	if err := s.frontier.Submit(reqs); err != nil {
+		s.restorePending(reqs)
+		s.onError(err)
+	}
+}
+
+// 把本地持有的请求告诉共享队列, 只在调度循环中调用, 保证按顺序
+func (s *reqCacheByShared) hold() {
+	s.m.Lock()
+	if !s.changed {
+		s.m.Unlock()
+		return
+	}
+	s.changed = false
+	reqs := make([]*base.Request, 0, len(s.polled)+len(s.delayed))
+	reqs = append(reqs, s.polled...)
+	for _, item := range s.delayed {
+		reqs = append(reqs, item.req)
+	}
+	s.m.Unlock()
+	s.frontier.Hold(reqs)
+}
+func (s *reqCacheByShared) takePending() []SharedRequest {
+	s.m.Lock()
+	defer s.m.Unlock()
+	reqs := s.pending
+	s.pending = make([]SharedRequest, 0)
+	return reqs
+}
+func (s *reqCacheByShared) restorePending(reqs []SharedRequest) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.pending = append(reqs, s.pending...)
+}
+
+// 确认请求完成, 先于确认提交它产生的请求, 保证不会在所有进程都空闲时丢失
+func (s *reqCacheByShared) done(req *base.Request) {
+	reqs := s.takePending()
+	if err := s.frontier.Complete(req, reqs); err != nil {
+		s.restorePending(reqs)
+		s.onError(err)
+	}
+}
+func (s *reqCacheByShared) retry(req *base.Request, key string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.seq++
+	s.retried++
+	s.changed = true
+	heap.Push(&s.delayed, &frontierItem{req: req, key: key, seq: s.seq})
+}
+func (s *reqCacheByShared) link(from string, to []string) {}
+func (s *reqCacheByShared) capacity() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return cap(s.polled)
+}
+
+// 其它进程还在工作时不为0, 避免调度器因空闲而停止
+func (s *reqCacheByShared) length() int {
+	s.m.Lock()
+	n := len(s.polled) + len(s.pending) + len(s.delayed)
+	s.m.Unlock()
+	if !s.frontier.Finished() {
+		n++
+	}
+	return n
+}
+func (s *reqCacheByShared) close() {
+	s.m.Lock()
+	s.status = 1
+	s.m.Unlock()
+	s.flush()
+}
+func (s *reqCacheByShared) summary() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return fmt.Sprintf("status:%s,strategy:shared,length:%d,pending:%d,delayed:%d,retried:%d,finished:%v",
+		statusMap[s.status], len(s.polled), len(s.pending), len(s.delayed), s.retried, s.frontier.Finished())
+}
+
+// 共享队列由协调者保存, 不支持检查点
+func (s *reqCacheByShared) dump() ([]*frontierItem, map[string]float64) {
+	return nil, nil
+}
+func (s *reqCacheByShared) load(items []*frontierItem, cash map[string]float64) {}
@@ -0,0 +1,269 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"webcrawler/base"
+	dl "webcrawler/downloader"
+	"webcrawler/robots"
+	"webcrawler/sitemap"
+
+	"github.com/bugfan/logrus"
+)
+
+// 站点地图索引最多嵌套的层数
+const maxSitemapNesting = 3
+
+// 站点地图配置
+type SitemapConfig struct {
+	// 从种子主机的robots.txt的Sitemap行发现站点地图, 没有时使用/sitemap.xml
+	Discover bool `json:"discover" yaml:"discover" toml:"discover"`
+	// 明确指定的站点地图, 属于同一主机的第一个种子
+	URLs []string `json:"urls" yaml:"urls" toml:"urls"`
+	// 每个种子最多从站点地图得到的url数, 0表示不限制
+	MaxURLs uint32 `json:"max_urls" yaml:"max_urls" toml:"max_urls"`
+}
+
+type sitemapTask struct {
+	url      string
+	nesting  uint32
+	optional bool // 猜测的地址, 获取失败时不报告错误
+}
+
+// 站点地图中的url作为深度为0的请求加入缓存, 和种子一样受范围和去重的限制
+// 每个主机只处理一次, 站点地图本身也要在种子的范围内, 下载时和页面共用礼貌策略
+func (s *myScheduler) discoverSitemaps(seedReqs []*base.Request) {
+	cfg := s.cfg.Sitemap
+	if !cfg.Discover && len(cfg.URLs) == 0 {
+		return
+	}
+	hosts := make(map[string]*base.Request)
+	order := make([]string, 0)
+	for _, req := range seedReqs {
+		reqUrl := req.HttpReq().URL
+		origin := reqUrl.Scheme + "://" + reqUrl.Host
+		if _, ok := hosts[origin]; !ok {
+			hosts[origin] = req
+			order = append(order, origin)
+		}
+	}
+	explicit := make(map[string][]string)
+	for _, loc := range cfg.URLs {
+		httpReq, err := http.NewRequest(http.MethodGet, loc, nil)
+		if err != nil {
+			s.sendError(err, SCHEDULER_CODE)
+			continue
+		}
+		origin := httpReq.URL.Scheme + "://" + httpReq.URL.Host
+		if _, ok := hosts[origin]; !ok {
+			s.sendError(errors.New(fmt.Sprintf("The sitemap %s does not belong to any seed!", loc)), SCHEDULER_CODE)
+			continue
+		}
+		explicit[origin] = append(explicit[origin], loc)
+	}
+	for _, origin := range order {
+		tasks := make([]sitemapTask, 0)
+		for _, loc := range explicit[origin] {
+			tasks = append(tasks, sitemapTask{url: loc})
+		}
+		if cfg.Discover || len(tasks) > 0 {
+			if !s.workers.add() {
+				return
+			}
+			go func(seedReq *base.Request, tasks []sitemapTask) {
+				defer s.workers.done()
+				s.crawlSitemaps(seedReq, tasks)
+			}(hosts[origin], tasks)
+		}
+	}
+}
+
+func (s *myScheduler) crawlSitemaps(seedReq *base.Request, tasks []sitemapTask) {
+	reqUrl := seedReq.HttpReq().URL
+	if s.cfg.Sitemap.Discover {
+		locs := s.robotsSitemaps(seedReq)
+		for _, loc := range locs {
+			tasks = append(tasks, sitemapTask{url: loc})
+		}
+		if len(locs) == 0 {
+			tasks = append(tasks, sitemapTask{url: sitemap.DefaultURL(reqUrl.Scheme, reqUrl.Host), optional: true})
+		}
+	}
+	visited := make(map[string]bool)
+	var count uint32
+	maxURLs := s.cfg.Sitemap.MaxURLs
+	for len(tasks) > 0 {
+		if s.stopSign.Signed() {
+			s.stopSign.Deal(SCHEDULER_CODE)
+			return
+		}
+		task := tasks[0]
+		tasks = tasks[1:]
+		if visited[task.url] {
+			continue
+		}
+		visited[task.url] = true
+		req, err := s.newSitemapRequest(seedReq, task.url)
+		if err != nil {
+			s.sendError(err, SCHEDULER_CODE)
+			continue
+		}
+		if !s.sitemapInScope(req) {
+			continue
+		}
+		// 停止时在下一轮循环中处理停止信号
+		if !s.waitPoliteness(req) {
+			continue
+		}
+		sm, code, err := s.fetchSitemap(req)
+		if err != nil {
+			if task.optional {
+				logrus.Debugf("Skip sitemap %s :%s\n", task.url, err)
+			} else {
+				s.sendError(err, code)
+			}
+			continue
+		}
+		if task.nesting < maxSitemapNesting {
+			for _, child := range sm.Sitemaps {
+				tasks = append(tasks, sitemapTask{url: child.Loc, nesting: task.nesting + 1})
+			}
+		}
+		for _, entry := range sm.URLs {
+			if maxURLs > 0 && count >= maxURLs {
+				return
+			}
+			req, err := entry.NewRequest(task.url, 0)
+			if err != nil {
+				s.sendError(err, code)
+				continue
+			}
+			req.SetSeed(seedReq.Seed())
+			s.saveReqToCache(*req, code)
+			count++
+		}
+	}
+}
+
+// robots.txt中的Sitemap行, 和下载时的检查共用缓存
+func (s *myScheduler) robotsSitemaps(seedReq *base.Request) []string {
+	if s.cfg.Robots.Ignore {
+		return nil
+	}
+	downloader, err := s.dlpool.Take()
+	if err != nil {
+		s.sendError(err, SCHEDULER_CODE)
+		return nil
+	}
+	defer func() {
+		if err := s.dlpool.Return(downloader); err != nil {
+			s.sendError(err, SCHEDULER_CODE)
+		}
+	}()
+	reqUrl := seedReq.HttpReq().URL
+	rules, err := s.robotsCache.Get(s.ctx, reqUrl.Scheme+"://"+reqUrl.Host, func(ctx context.Context) (*robots.Robots, int, error) {
+		return s.fetchRobots(ctx, downloader, seedReq)
+	})
+	if err != nil {
+		return nil
+	}
+	// 按规范应该是绝对地址, 相对地址按robots.txt的地址解析
+	locs := make([]string, 0)
+	for _, loc := range rules.Sitemaps() {
+		if u, err := reqUrl.Parse(loc); err == nil {
+			locs = append(locs, u.String())
+		}
+	}
+	return locs
+}
+
+func (s *myScheduler) newSitemapRequest(seedReq *base.Request, loc string) (*base.Request, error) {
+	httpReq, err := http.NewRequest(http.MethodGet, loc, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.setUserAgent(httpReq)
+	req := base.NewRequest(httpReq, 0)
+	req.SetSeed(seedReq.Seed())
+	return req, nil
+}
+
+// 站点地图索引和robots.txt可能指向其它主机, 和页面一样检查协议和范围, 不在范围内时记为被忽略的请求
+func (s *myScheduler) sitemapInScope(req *base.Request) bool {
+	reqUrl := s.canonicalizer.Canonicalize(req.HttpReq().URL)
+	if !s.schemes[reqUrl.Scheme] {
+		return s.reject(req, REJECT_SCHEME, reqUrl.Scheme, SCHEDULER_CODE)
+	}
+	scope, ok := s.seeds[req.Seed()]
+	if !ok {
+		return s.reject(req, REJECT_UNKNOWN_SEED, "", SCHEDULER_CODE)
+	}
+	if !scope.contains(reqUrl.Host) {
+		return s.reject(req, REJECT_OUT_OF_SCOPE, reqUrl.Host, SCHEDULER_CODE)
+	}
+	return true
+}
+
+// 等到主机空闲并占用它, 调度器停止时返回false
+func (s *myScheduler) waitPoliteness(req *base.Request) bool {
+	for !s.politeness.tryStart(req, time.Now()) {
+		if s.stopSign.Signed() {
+			return false
+		}
+		select {
+		case <-s.ctx.Done():
+			return false
+		case <-time.After(s.scheduleInterval):
+		}
+	}
+	return true
+}
+
+// 调用前需要通过waitPoliteness占用主机, 返回时释放
+func (s *myScheduler) fetchSitemap(req *base.Request) (*sitemap.Sitemap, string, error) {
+	var latency time.Duration
+	var httpResp *http.Response
+	defer func() {
+		s.politeness.finish(req, latency, httpResp)
+	}()
+	loc := req.HttpReq().URL.String()
+	downloader, err := s.dlpool.Take()
+	if err != nil {
+		return nil, SCHEDULER_CODE, err
+	}
+	defer func() {
+		if err := s.dlpool.Return(downloader); err != nil {
+			s.sendError(err, SCHEDULER_CODE)
+		}
+	}()
+	code := generateCode(DOWNLOADER_CODE, downloader.Id())
+	start := time.Now()
+	resp, err := downloader.Download(dl.WithoutLimits(s.ctx), req)
+	latency = time.Since(start)
+	var retryErr *dl.RetryError
+	if errors.As(err, &retryErr) {
+		httpResp = retryErr.Response
+	}
+	if err != nil {
+		return nil, code, err
+	}
+	if resp == nil || !resp.Valid() {
+		return nil, code, errors.New(fmt.Sprintf("The sitemap %s response is invalid!", loc))
+	}
+	httpResp = resp.HttpResp()
+	defer httpResp.Body.Close()
+	if resp.Skipped() {
+		return nil, code, errors.New(fmt.Sprintf("The sitemap %s response is skipped: %s", loc, resp.SkipReason()))
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, code, errors.New(fmt.Sprintf("Occur error when get sitemap %s :%s", loc, httpResp.Status))
+	}
+	sm, err := sitemap.Parse(httpResp.Body)
+	if err != nil {
+		return nil, code, errors.New(fmt.Sprintf("Occur error when parse sitemap %s :%s", loc, err))
+	}
+	return sm, code, nil
+}
@@ -0,0 +1,92 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	anlz "webcrawler/analyzer"
+	"webcrawler/base"
+)
+
+// 站点地图索引指向范围外的主机时不下载, 站点地图和页面的下载共用主机的间隔
+func TestSitemapScopeAndPoliteness(t *testing.T) {
+	const minDelay = 150 * time.Millisecond
+	var m sync.Mutex
+	times := make([]time.Time, 0)
+	paths := make([]string, 0)
+	// 和站点同一台机器, 但主机名是localhost, 不在种子的范围内
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("the out of scope host received %s", r.URL)
+	}))
+	defer other.Close()
+	otherUrl := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		times = append(times, time.Now())
+		paths = append(paths, r.URL.Path)
+		m.Unlock()
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			fmt.Fprintf(w, `<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+<sitemap><loc>%s/child.xml</loc></sitemap>
+<sitemap><loc>%s/other.xml</loc></sitemap>
+</sitemapindex>`, srv.URL, otherUrl)
+		case "/child.xml":
+			fmt.Fprintf(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+<url><loc>%s/a</loc></url>
+<url><loc>%s/b</loc></url>
+</urlset>`, srv.URL, srv.URL)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html></html>")
+		}
+	}))
+	defer srv.Close()
+	var rm sync.Mutex
+	rejected := make([]RejectEvent, 0)
+	cfg := CrawlConfig{
+		CrawlDepth: 1,
+		Politeness: PolitenessConfig{MinDelay: Duration(minDelay), DisableAutoThrottle: true},
+		Sitemap:    SitemapConfig{URLs: []string{srv.URL + "/sitemap.xml"}},
+		Seeds:      []Seed{{URL: srv.URL + "/"}},
+		RespParsers: []anlz.ParseResponse{func(ctx context.Context, httpResp *http.Response, respDepth uint32) ([]base.Data, []error) {
+			return nil, nil
+		}},
+		OnReject: func(event RejectEvent) {
+			rm.Lock()
+			defer rm.Unlock()
+			rejected = append(rejected, event)
+		},
+	}
+	if errs := crawl(t, cfg); len(errs) > 0 {
+		t.Errorf("crawl errors: %v", errs)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if len(paths) != 5 {
+		t.Errorf("the site received %v; want the seed, 2 sitemaps and 2 pages", paths)
+	}
+	// 留一点误差给请求到达服务器的时间
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < minDelay-20*time.Millisecond {
+			t.Errorf("%s came %s after %s; want at least %s", paths[i], gap, paths[i-1], minDelay)
+		}
+	}
+	rm.Lock()
+	defer rm.Unlock()
+	found := false
+	for _, event := range rejected {
+		if event.Reason == REJECT_OUT_OF_SCOPE && event.Url == otherUrl+"/other.xml" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("rejected %v; want %s/other.xml out of scope", rejected, otherUrl)
+	}
+}
@@ -0,0 +1,164 @@
+package scheduler
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"webcrawler/dedup"
+)
+
+// 调度器摘要信息
+type mySchedSummary struct {
+	prefix              string
+	running             bool
+	crawlDepth          uint32
+	chanmanSummary      string
+	reqCacheSummary     string
+	politenessSummary   string
+	proxySummary        string // 没有使用代理时为空
+	httpCacheSummary    string // 没有使用缓存时为空
+	warcSummary         string // 没有输出WARC时为空
+	dlPoolLen           uint32
+	dlPoolCap           uint32
+	analyzerPoolLen     uint32
+	analyzerPoolCap     uint32
+	itemPipelineSummary string
+	urlCount            uint64
+	urls                dedup.Iterable // 只有能遍历的去重器才能列出url, 在Detail时才遍历
+	stopSignSummary     string
+	rejectSummary       string
+}
+
+func newSchedSummary(sched *myScheduler, prefix string) SchedSummary {
+	if sched == nil {
+		return nil
+	}
+	summary := &mySchedSummary{
+		prefix:     prefix,
+		running:    sched.Running(),
+		crawlDepth: sched.crawlDepth,
+	}
+	if sched.chanman != nil {
+		summary.chanmanSummary = sched.chanman.Summary()
+	}
+	if sched.reqCache != nil {
+		summary.reqCacheSummary = sched.reqCache.summary()
+	}
+	if sched.politeness != nil {
+		summary.politenessSummary = sched.politeness.summary()
+	}
+	if sched.proxyPool != nil {
+		summary.proxySummary = sched.proxyPool.Summary()
+	}
+	if sched.httpCache != nil {
+		summary.httpCacheSummary = sched.httpCache.Summary()
+	}
+	if sched.warcWriter != nil {
+		summary.warcSummary = sched.warcWriter.Summary()
+	}
+	if sched.dlpool != nil {
+		summary.dlPoolLen = sched.dlpool.Used()
+		summary.dlPoolCap = sched.dlpool.Total()
+	}
+	if sched.analyzerPool != nil {
+		summary.analyzerPoolLen = sched.analyzerPool.Used()
+		summary.analyzerPoolCap = sched.analyzerPool.Total()
+	}
+	if sched.itemPipeLine != nil {
+		summary.itemPipelineSummary = sched.itemPipeLine.Summary()
+	}
+	if sched.rejects != nil {
+		summary.rejectSummary = sched.rejects.summary()
+	}
+	if sched.stopSign != nil {
+		summary.stopSignSummary = sched.stopSign.Summary()
+	}
+	if sched.dedup == nil {
+		return summary
+	}
+	summary.urlCount = sched.dedup.Len()
+	summary.urls, _ = sched.dedup.(dedup.Iterable)
+	return summary
+}
+
+func (s *mySchedSummary) String() string {
+	return s.getSummary(false)
+}
+func (s *mySchedSummary) Detail() string {
+	return s.getSummary(true)
+}
+func (s *mySchedSummary) Same(other SchedSummary) bool {
+	if other == nil {
+		return false
+	}
+	o, ok := other.(*mySchedSummary)
+	if !ok {
+		return false
+	}
+	return s.running == o.running &&
+		s.crawlDepth == o.crawlDepth &&
+		s.chanmanSummary == o.chanmanSummary &&
+		s.reqCacheSummary == o.reqCacheSummary &&
+		s.politenessSummary == o.politenessSummary &&
+		s.proxySummary == o.proxySummary &&
+		s.httpCacheSummary == o.httpCacheSummary &&
+		s.warcSummary == o.warcSummary &&
+		s.dlPoolLen == o.dlPoolLen &&
+		s.dlPoolCap == o.dlPoolCap &&
+		s.analyzerPoolLen == o.analyzerPoolLen &&
+		s.analyzerPoolCap == o.analyzerPoolCap &&
+		s.itemPipelineSummary == o.itemPipelineSummary &&
+		s.urlCount == o.urlCount &&
+		s.stopSignSummary == o.stopSignSummary &&
+		s.rejectSummary == o.rejectSummary
+}
+func (s *mySchedSummary) getSummary(detail bool) string {
+	prefix := s.prefix
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("%sRunning: %v\n", prefix, s.running))
+	buf.WriteString(fmt.Sprintf("%sCrawl depth: %d\n", prefix, s.crawlDepth))
+	buf.WriteString(fmt.Sprintf("%sChannels manager: %s\n", prefix, s.chanmanSummary))
+	buf.WriteString(fmt.Sprintf("%sRequest cache: %s\n", prefix, s.reqCacheSummary))
+	buf.WriteString(fmt.Sprintf("%sPoliteness: %s\n", prefix, s.politenessSummary))
+	if s.proxySummary != "" {
+		buf.WriteString(fmt.Sprintf("%sProxies: %s\n", prefix, s.proxySummary))
+	}
+	if s.httpCacheSummary != "" {
+		buf.WriteString(fmt.Sprintf("%sHttp cache: %s\n", prefix, s.httpCacheSummary))
+	}
+	if s.warcSummary != "" {
+		buf.WriteString(fmt.Sprintf("%sWarc: %s\n", prefix, s.warcSummary))
+	}
+	buf.WriteString(fmt.Sprintf("%sDownloader pool: %d/%d\n", prefix, s.dlPoolLen, s.dlPoolCap))
+	buf.WriteString(fmt.Sprintf("%sAnalyzer pool: %d/%d\n", prefix, s.analyzerPoolLen, s.analyzerPoolCap))
+	buf.WriteString(fmt.Sprintf("%sItem pipeline: %s\n", prefix, s.itemPipelineSummary))
+	buf.WriteString(fmt.Sprintf("%sUrls(%d): ", prefix, s.urlCount))
+	if detail {
+		buf.WriteString("\n")
+		buf.WriteString(s.urlDetail())
+	} else {
+		buf.WriteString("<concealed>\n")
+	}
+	buf.WriteString(fmt.Sprintf("%sRejected: %s\n", prefix, s.rejectSummary))
+	buf.WriteString(fmt.Sprintf("%sStop sign: %s\n", prefix, s.stopSignSummary))
+	return buf.String()
+}
+func (s *mySchedSummary) urlDetail() string {
+	if s.urls == nil {
+		return s.prefix + "  <not iterable>\n"
+	}
+	urls := make([]string, 0, s.urlCount)
+	s.urls.Range(func(url string) bool {
+		urls = append(urls, url)
+		return true
+	})
+	sort.Strings(urls)
+	var buf bytes.Buffer
+	for _, url := range urls {
+		buf.WriteString(s.prefix)
+		buf.WriteString("  ")
+		buf.WriteString(url)
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,45 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"webcrawler/warc"
+
+	"github.com/bugfan/logrus"
+)
+
+// WARC输出配置, Dir为空时不输出; 下载的响应在读完或关闭后写入, 调度器停止时关闭文件
+type WarcConfig struct {
+	Dir string `json:"dir" yaml:"dir" toml:"dir"`
+	// 文件名前缀, 为空时使用默认值
+	Prefix string `json:"prefix" yaml:"prefix" toml:"prefix"`
+	// 单个文件的最大字节数, 0表示使用默认值
+	MaxFileSize int64 `json:"max_file_size" yaml:"max_file_size" toml:"max_file_size"`
+	// 写进warcinfo记录的字段, 如operator description
+	Info map[string]string `json:"info" yaml:"info" toml:"info"`
+}
+
+func (s WarcConfig) check() []error {
+	errs := make([]error, 0)
+	if s.MaxFileSize < 0 {
+		errs = append(errs, errors.New(fmt.Sprintf("The warc max file size %d is invalid!", s.MaxFileSize)))
+	}
+	return errs
+}
+
+// 没有配置时返回nil
+func (s WarcConfig) newWriter() (warc.Writer, error) {
+	if s.Dir == "" {
+		return nil, nil
+	}
+	return warc.NewWriter(warc.Config{Dir: s.Dir, Prefix: s.Prefix, MaxFileSize: s.MaxFileSize, Info: s.Info})
+}
+
+func (s *myScheduler) closeWarc() {
+	if s.warcWriter == nil {
+		return
+	}
+	if err := s.warcWriter.Close(); err != nil {
+		logrus.Errorln("Occur error when close warc writer :", err)
+	}
+}
@@ -0,0 +1,179 @@
+package sitemap
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"webcrawler/base"
+)
+
+const (
+	// 解压后最多读取的字节数和条目数, 见 https://www.sitemaps.org/protocol.html
+	MaxSize    = 50 * 1024 * 1024
+	MaxEntries = 50000
+)
+
+// 写进base.Request的附加信息
+const (
+	META_SITEMAP    = "sitemap"            // 所在的站点地图, string
+	META_LASTMOD    = "sitemap.lastmod"    // time.Time
+	META_CHANGEFREQ = "sitemap.changefreq" // string
+	META_PRIORITY   = "sitemap.priority"   // float64
+)
+
+// 站点地图中的一项
+type Entry struct {
+	Loc         string
+	LastMod     time.Time // 没有时为零值
+	ChangeFreq  string
+	Priority    float64
+	HasPriority bool
+}
+
+// 解析结果, 站点地图索引只有Sitemaps
+type Sitemap struct {
+	URLs     []Entry
+	Sitemaps []Entry
+}
+
+type xmlEntry struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod"`
+	ChangeFreq string `xml:"changefreq"`
+	Priority   string `xml:"priority"`
+}
+type xmlDocument struct {
+	XMLName  xml.Name
+	URLs     []xmlEntry `xml:"url"`
+	Sitemaps []xmlEntry `xml:"sitemap"`
+}
+
+// 解析xml站点地图 站点地图索引 或每行一个url的文本站点地图, 支持gzip压缩
+func Parse(r io.Reader) (*Sitemap, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	data, err := io.ReadAll(io.LimitReader(br, MaxSize))
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	if bytes.HasPrefix(trimmed, []byte("<")) {
+		return parseXML(trimmed)
+	}
+	return parseText(trimmed), nil
+}
+
+func parseXML(data []byte) (*Sitemap, error) {
+	var doc xmlDocument
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	switch doc.XMLName.Local {
+	case "urlset", "sitemapindex":
+	default:
+		return nil, errors.New(fmt.Sprintf("The sitemap root element <%s> is invalid!", doc.XMLName.Local))
+	}
+	sitemap := &Sitemap{}
+	for _, e := range doc.URLs {
+		if entry, ok := newEntry(e); ok && len(sitemap.URLs) < MaxEntries {
+			sitemap.URLs = append(sitemap.URLs, entry)
+		}
+	}
+	for _, e := range doc.Sitemaps {
+		if entry, ok := newEntry(e); ok && len(sitemap.Sitemaps) < MaxEntries {
+			sitemap.Sitemaps = append(sitemap.Sitemaps, entry)
+		}
+	}
+	return sitemap, nil
+}
+
+func parseText(data []byte) *Sitemap {
+	sitemap := &Sitemap{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() && len(sitemap.URLs) < MaxEntries {
+		line := strings.TrimSpace(scanner.Text())
+		if u, err := url.Parse(line); err == nil && u.IsAbs() {
+			sitemap.URLs = append(sitemap.URLs, Entry{Loc: line})
+		}
+	}
+	return sitemap
+}
+
+func newEntry(e xmlEntry) (Entry, bool) {
+	entry := Entry{
+		Loc:        strings.TrimSpace(e.Loc),
+		ChangeFreq: strings.ToLower(strings.TrimSpace(e.ChangeFreq)),
+	}
+	if u, err := url.Parse(entry.Loc); err != nil || !u.IsAbs() {
+		return entry, false
+	}
+	entry.LastMod, _ = ParseTime(e.LastMod)
+	if priority, err := strconv.ParseFloat(strings.TrimSpace(e.Priority), 64); err == nil && priority >= 0 && priority <= 1 {
+		entry.Priority = priority
+		entry.HasPriority = true
+	}
+	return entry, true
+}
+
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// 解析W3C Datetime格式的时间
+func ParseTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New(fmt.Sprintf("The sitemap time %q is invalid!", value))
+}
+
+// 生成GET请求, 附加信息写进META_*
+func (s Entry) NewRequest(sitemapUrl string, depth uint32) (*base.Request, error) {
+	httpReq, err := http.NewRequest(http.MethodGet, s.Loc, nil)
+	if err != nil {
+		return nil, err
+	}
+	req := base.NewRequest(httpReq, depth)
+	req.SetMeta(META_SITEMAP, sitemapUrl)
+	if !s.LastMod.IsZero() {
+		req.SetMeta(META_LASTMOD, s.LastMod)
+	}
+	if s.ChangeFreq != "" {
+		req.SetMeta(META_CHANGEFREQ, s.ChangeFreq)
+	}
+	if s.HasPriority {
+		req.SetMeta(META_PRIORITY, s.Priority)
+	}
+	return req, nil
+}
+
+// 站点默认的站点地图地址, 如 https://example.com/sitemap.xml
+func DefaultURL(scheme string, host string) string {
+	return scheme + "://" + host + "/sitemap.xml"
+}
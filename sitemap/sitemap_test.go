@@ -0,0 +1,176 @@
+package sitemap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testUrlset = `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url>
+    <loc> https://example.com/a </loc>
+    <lastmod>2024-05-01T10:30:00+08:00</lastmod>
+    <changefreq>Daily</changefreq>
+    <priority>0.8</priority>
+  </url>
+  <url><loc>https://example.com/b</loc><priority>1.5</priority></url>
+  <url><loc>/relative</loc></url>
+  <url><loc>https://example.com/c?x=1&amp;y=2</loc><lastmod>bad</lastmod></url>
+</urlset>`
+
+const testIndex = `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>https://example.com/sitemap1.xml.gz</loc><lastmod>2024-05</lastmod></sitemap>
+  <sitemap><loc>https://example.com/sitemap2.xml</loc></sitemap>
+</sitemapindex>`
+
+func gzipped(s string) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(s))
+	gz.Close()
+	return buf.String()
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		urls     []string
+		sitemaps []string
+	}{
+		{"urlset", testUrlset, []string{"https://example.com/a", "https://example.com/b", "https://example.com/c?x=1&y=2"}, nil},
+		{"index", testIndex, nil, []string{"https://example.com/sitemap1.xml.gz", "https://example.com/sitemap2.xml"}},
+		{"gzip", gzipped(testIndex), nil, []string{"https://example.com/sitemap1.xml.gz", "https://example.com/sitemap2.xml"}},
+		{"bom", "\xef\xbb\xbf" + testIndex, nil, []string{"https://example.com/sitemap1.xml.gz", "https://example.com/sitemap2.xml"}},
+		{"text", "https://example.com/1\n\n  https://example.com/2  \nnot a url\n/relative\n", []string{"https://example.com/1", "https://example.com/2"}, nil},
+		{"gzip text", gzipped("https://example.com/1\r\n"), []string{"https://example.com/1"}, nil},
+		{"empty", "", nil, nil},
+	}
+	for _, c := range cases {
+		sm, err := Parse(strings.NewReader(c.data))
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if got := locs(sm.URLs); !equal(got, c.urls) {
+			t.Errorf("%s: urls = %v; want %v", c.name, got, c.urls)
+		}
+		if got := locs(sm.Sitemaps); !equal(got, c.sitemaps) {
+			t.Errorf("%s: sitemaps = %v; want %v", c.name, got, c.sitemaps)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	cases := []string{
+		`<html><body>not a sitemap</body></html>`,
+		`<urlset><url><loc>https://example.com/</loc>`,
+		"\x1f\x8b not really gzip",
+	}
+	for _, data := range cases {
+		if _, err := Parse(strings.NewReader(data)); err == nil {
+			t.Errorf("Parse(%q) should fail", data)
+		}
+	}
+}
+
+func TestEntryFields(t *testing.T) {
+	sm, err := Parse(strings.NewReader(testUrlset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := sm.URLs[0], sm.URLs[1], sm.URLs[2]
+	if want := time.Date(2024, 5, 1, 2, 30, 0, 0, time.UTC); !a.LastMod.Equal(want) {
+		t.Errorf("lastmod = %v; want %v", a.LastMod, want)
+	}
+	if a.ChangeFreq != "daily" || !a.HasPriority || a.Priority != 0.8 {
+		t.Errorf("entry a = %+v", a)
+	}
+	if b.HasPriority {
+		t.Errorf("priority 1.5 is out of range but was kept: %+v", b)
+	}
+	if !c.LastMod.IsZero() {
+		t.Errorf("an invalid lastmod should be ignored: %+v", c)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	cases := []struct {
+		value string
+		want  time.Time
+	}{
+		{"2024", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"2024-05", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"2024-05-06", time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)},
+		{" 2024-05-06T07:08Z ", time.Date(2024, 5, 6, 7, 8, 0, 0, time.UTC)},
+		{"2024-05-06T07:08:09+02:00", time.Date(2024, 5, 6, 5, 8, 9, 0, time.UTC)},
+		{"2024-05-06T07:08:09.5Z", time.Date(2024, 5, 6, 7, 8, 9, 5e8, time.UTC)},
+		{"2024-05-06T07:08:09", time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		got, err := ParseTime(c.value)
+		if err != nil || !got.Equal(c.want) {
+			t.Errorf("ParseTime(%q) = %v, %v; want %v", c.value, got, err, c.want)
+		}
+	}
+	for _, value := range []string{"", "yesterday", "2024-13-01", "05/06/2024"} {
+		if _, err := ParseTime(value); err == nil {
+			t.Errorf("ParseTime(%q) should fail", value)
+		}
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	entry := Entry{Loc: "https://example.com/a", LastMod: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), ChangeFreq: "daily", Priority: 0, HasPriority: true}
+	req, err := entry.NewRequest("https://example.com/sitemap.xml", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.HttpReq().URL.String() != entry.Loc || req.Depth() != 1 {
+		t.Errorf("request = %s depth %d", req.HttpReq().URL, req.Depth())
+	}
+	cases := []struct {
+		key  string
+		want interface{}
+	}{
+		{META_SITEMAP, "https://example.com/sitemap.xml"},
+		{META_LASTMOD, entry.LastMod},
+		{META_CHANGEFREQ, "daily"},
+		{META_PRIORITY, 0.0},
+	}
+	for _, c := range cases {
+		if value, ok := req.Meta(c.key); !ok || value != c.want {
+			t.Errorf("Meta(%s) = %v, %v; want %v", c.key, value, ok, c.want)
+		}
+	}
+	req, _ = Entry{Loc: "https://example.com/b"}.NewRequest("", 0)
+	for _, key := range []string{META_LASTMOD, META_CHANGEFREQ, META_PRIORITY} {
+		if _, ok := req.Meta(key); ok {
+			t.Errorf("Meta(%s) should not be set", key)
+		}
+	}
+}
+
+func locs(entries []Entry) []string {
+	result := make([]string, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, e.Loc)
+	}
+	return result
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,208 @@
+package warc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const WARC_VERSION = "WARC/1.1"
+
+// 记录类型
+const (
+	TYPE_WARCINFO = "warcinfo"
+	TYPE_REQUEST  = "request"
+	TYPE_RESPONSE = "response"
+	TYPE_METADATA = "metadata"
+)
+
+const (
+	CONTENT_TYPE_REQUEST  = "application/http;msgtype=request"
+	CONTENT_TYPE_RESPONSE = "application/http;msgtype=response"
+	CONTENT_TYPE_FIELDS   = "application/warc-fields"
+)
+
+// 一条WARC记录, WARC-Record-ID WARC-Date Content-Length和WARC-Block-Digest由写入器生成
+type Record struct {
+	Type        string
+	Id          string // 为空时由写入器生成
+	Date        time.Time
+	TargetURI   string
+	ContentType string
+	Fields      [][2]string // 其它头字段, 按顺序写入
+	Block       []byte
+	// 接在Block后面的块内容, 长度为TailSize, 如临时文件中的响应体; 为空时块只有Block
+	Tail     io.ReaderAt
+	TailSize int64
+}
+
+func (s *Record) field(name string) string {
+	for _, field := range s.Fields {
+		if field[0] == name {
+			return field[1]
+		}
+	}
+	return ""
+}
+
+// 生成<urn:uuid:...>格式的记录id
+func NewRecordId() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// sha1:加base32, 和其它WARC工具一致
+func Digest(data []byte) string {
+	sum := sha1.Sum(data)
+	return formatDigest(sum[:])
+}
+
+func formatDigest(sum []byte) string {
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum)
+}
+
+// WARC-Date使用UTC, 精确到微秒
+func formatDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000Z")
+}
+
+func (s *Record) tail() io.Reader {
+	if s.Tail == nil {
+		return bytes.NewReader(nil)
+	}
+	return io.NewSectionReader(s.Tail, 0, s.TailSize)
+}
+
+// 写入记录的头和块, 以两个CRLF结尾; 有Tail时先读一遍计算摘要, 不读入内存
+func (s *Record) writeTo(w io.Writer) error {
+	digest := sha1.New()
+	digest.Write(s.Block)
+	if _, err := io.Copy(digest, s.tail()); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(WARC_VERSION + "\r\n")
+	fields := [][2]string{
+		{"WARC-Type", s.Type},
+		{"WARC-Record-ID", s.Id},
+		{"WARC-Date", formatDate(s.Date)},
+	}
+	if s.TargetURI != "" {
+		fields = append(fields, [2]string{"WARC-Target-URI", s.TargetURI})
+	}
+	fields = append(fields, s.Fields...)
+	if s.ContentType != "" {
+		fields = append(fields, [2]string{"Content-Type", s.ContentType})
+	}
+	fields = append(fields,
+		[2]string{"WARC-Block-Digest", formatDigest(digest.Sum(nil))},
+		[2]string{"Content-Length", fmt.Sprint(int64(len(s.Block)) + s.TailSize)})
+	for _, field := range fields {
+		buf.WriteString(field[0] + ": " + field[1] + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(s.Block)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, s.tail()); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n\r\n")
+	return err
+}
+
+// application/warc-fields格式的块, 按名字排序
+func fieldsBlock(fields map[string]string) []byte {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(name + ": " + fields[name] + "\r\n")
+	}
+	return buf.Bytes()
+}
+
+// http请求的报文, 请求体只在可以重新获取(GetBody)时写入
+func requestBlock(req *http.Request) []byte {
+	var buf bytes.Buffer
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	buf.WriteString(fmt.Sprintf("%s %s HTTP/1.1\r\n", method, req.URL.RequestURI()))
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	buf.WriteString("Host: " + host + "\r\n")
+	req.Header.WriteSubset(&buf, map[string]bool{"Host": true})
+	buf.WriteString("\r\n")
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			buf.ReadFrom(body)
+			body.Close()
+		}
+	}
+	return buf.Bytes()
+}
+
+// http响应报文的头, 响应体另外写入; 传输层已经解码了分块和压缩, 所以去掉对应的头并按实际的响应体设置Content-Length
+func responseHeader(resp *http.Response, size int64) []byte {
+	var buf bytes.Buffer
+	proto := resp.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	status := resp.Status
+	if status == "" {
+		status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	buf.WriteString(proto + " " + status + "\r\n")
+	resp.Header.WriteSubset(&buf, map[string]bool{"Content-Length": true, "Transfer-Encoding": true})
+	buf.WriteString(fmt.Sprintf("Content-Length: %d\r\n\r\n", size))
+	return buf.Bytes()
+}
+
+// CDX使用的SURT形式的url: 主机名倒序, 去掉www和默认端口, 小写
+func SURT(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		return strings.ToLower(rawUrl)
+	}
+	host := strings.ToLower(u.Hostname())
+	host = strings.TrimPrefix(host, "www.")
+	parts := strings.Split(host, ".")
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	key := strings.Join(parts, ",")
+	if port := u.Port(); port != "" && !(u.Scheme == "http" && port == "80") && !(u.Scheme == "https" && port == "443") {
+		key += ":" + port
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	key += ")" + strings.ToLower(path)
+	if u.RawQuery != "" {
+		query := strings.Split(u.RawQuery, "&")
+		sort.Strings(query)
+		key += "?" + strings.ToLower(strings.Join(query, "&"))
+	}
+	return key
+}
@@ -0,0 +1,394 @@
+package warc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"webcrawler/base"
+	dl "webcrawler/downloader"
+)
+
+const (
+	DefaultPrefix      = "webcrawler"
+	DefaultMaxFileSize = 1 << 30
+	CDX_HEADER         = " CDX N b a m s k r M S V g"
+	// WARC-Truncated的值: 被响应限制截断, 没有读完就关闭
+	TRUNCATED_LENGTH      = "length"
+	TRUNCATED_UNSPECIFIED = "unspecified"
+	conformsTo            = "http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/"
+)
+
+type Config struct {
+	// 输出目录, 不存在时创建
+	Dir string
+	// 文件名前缀, 文件名为 前缀-时间-序号.warc.gz, 为空时使用DefaultPrefix
+	Prefix string
+	// 文件超过这个大小后换新文件, 0表示使用DefaultMaxFileSize
+	MaxFileSize int64
+	// 写进warcinfo记录的字段, 如operator description
+	Info map[string]string
+}
+
+// WARC 1.1写入器 (并发安全), 每条记录单独gzip压缩, 每个文件开头是warcinfo记录
+// 每个WARC文件旁边有同名的.cdx索引(CDX N b a m s k r M S V g), 在换文件或关闭时排序写入
+// 作为下载器中间件使用时, 响应体被读完或关闭后写入request response和metadata记录,
+// 响应体先写入临时文件; 被截断或没有读完的响应体带有WARC-Truncated
+// 应该放在http缓存之后, 从缓存返回的响应不会写入
+type Writer interface {
+	dl.DownloaderMiddleware
+	// 写入一组记录, 同一组总在同一个文件中; 记录id为空时生成
+	Write(records ...*Record) error
+	// 已经写入的文件
+	Files() []string
+	Summary() string
+	Close() error
+}
+
+type myWriter struct {
+	dir         string
+	prefix      string
+	maxFileSize int64
+	info        map[string]string
+	file        *os.File
+	name        string
+	size        int64
+	serial      int
+	infoId      string   // 当前文件的warcinfo记录id
+	cdx         []string // 当前文件的索引行
+	files       []string
+	records     uint64
+	errors      uint64
+	closed      bool
+	m           sync.Mutex
+}
+
+func NewWriter(cfg Config) (Writer, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("The warc directory is empty!")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, errors.New(fmt.Sprintf("Occur error when create warc directory %s :%s", cfg.Dir, err))
+	}
+	s := &myWriter{dir: cfg.Dir, prefix: cfg.Prefix, maxFileSize: cfg.MaxFileSize, info: cfg.Info}
+	if s.prefix == "" {
+		s.prefix = DefaultPrefix
+	}
+	if s.maxFileSize <= 0 {
+		s.maxFileSize = DefaultMaxFileSize
+	}
+	return s, nil
+}
+
+func (s *myWriter) Files() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]string{}, s.files...)
+}
+func (s *myWriter) Summary() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return fmt.Sprintf("dir:%s,files:%d,records:%d,errors:%d", s.dir, len(s.files), s.records, atomic.LoadUint64(&s.errors))
+}
+
+func (s *myWriter) Write(records ...*Record) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return errors.New("The warc writer is closed!")
+	}
+	if s.file != nil && s.size >= s.maxFileSize {
+		if err := s.closeFile(); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		if err := s.openFile(); err != nil {
+			return err
+		}
+	}
+	for _, record := range records {
+		if record.Id == "" {
+			record.Id = NewRecordId()
+		}
+		if record.field("WARC-Warcinfo-ID") == "" {
+			record.Fields = append(record.Fields, [2]string{"WARC-Warcinfo-ID", s.infoId})
+		}
+		offset, length, err := s.writeRecord(record)
+		if err != nil {
+			return err
+		}
+		if record.Type == TYPE_RESPONSE {
+			s.addCdx(record, offset, length)
+		}
+	}
+	return nil
+}
+
+// 每条记录是一个gzip成员, 直接压缩写入文件, 返回在文件中的偏移和压缩后的长度
+func (s *myWriter) writeRecord(record *Record) (int64, int64, error) {
+	offset := s.size
+	counter := &countingWriter{writer: s.file}
+	defer func() { s.size += counter.n }()
+	gz := gzip.NewWriter(counter)
+	if err := record.writeTo(gz); err != nil {
+		return 0, 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, 0, err
+	}
+	s.records++
+	return offset, counter.n, nil
+}
+
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
+
+func (s *countingWriter) Write(p []byte) (int, error) {
+	n, err := s.writer.Write(p)
+	s.n += int64(n)
+	return n, err
+}
+
+func (s *myWriter) openFile() error {
+	s.serial++
+	s.name = fmt.Sprintf("%s-%s-%05d.warc.gz", s.prefix, time.Now().UTC().Format("20060102150405"), s.serial)
+	file, err := os.OpenFile(filepath.Join(s.dir, s.name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.file, s.size, s.cdx = file, 0, nil
+	s.files = append(s.files, filepath.Join(s.dir, s.name))
+	fields := map[string]string{
+		"software":   "webcrawler",
+		"format":     "WARC File Format 1.1",
+		"conformsTo": conformsTo,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		fields["hostname"] = hostname
+	}
+	for name, value := range s.info {
+		fields[name] = value
+	}
+	info := &Record{
+		Type:        TYPE_WARCINFO,
+		Id:          NewRecordId(),
+		Date:        time.Now(),
+		ContentType: CONTENT_TYPE_FIELDS,
+		Fields:      [][2]string{{"WARC-Filename", s.name}},
+		Block:       fieldsBlock(fields),
+	}
+	s.infoId = info.Id
+	_, _, err = s.writeRecord(info)
+	return err
+}
+
+// 关闭当前文件并写入排序后的索引
+func (s *myWriter) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	sort.Strings(s.cdx)
+	lines := append([]string{CDX_HEADER}, s.cdx...)
+	cdxPath := filepath.Join(s.dir, strings.TrimSuffix(s.name, ".warc.gz")+".cdx")
+	if cdxErr := os.WriteFile(cdxPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err == nil {
+		err = cdxErr
+	}
+	s.cdx = nil
+	return err
+}
+
+// 索引行: SURT 时间 url MIME类型 状态码 负载摘要 重定向 元标签 压缩长度 偏移 文件名
+func (s *myWriter) addCdx(record *Record, offset int64, length int64) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(record.Block)), nil)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	mimeType := "-"
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+			mimeType = mediaType
+		}
+	}
+	redirect := "-"
+	if location := resp.Header.Get("Location"); location != "" {
+		redirect = strings.ReplaceAll(location, " ", "%20")
+	}
+	digest := strings.TrimPrefix(record.field("WARC-Payload-Digest"), "sha1:")
+	if digest == "" {
+		digest = "-"
+	}
+	s.cdx = append(s.cdx, fmt.Sprintf("%s %s %s %s %d %s %s - %d %d %s",
+		SURT(record.TargetURI), record.Date.UTC().Format("20060102150405"), strings.ReplaceAll(record.TargetURI, " ", "%20"),
+		mimeType, resp.StatusCode, digest, redirect, length, offset, s.name))
+}
+
+func (s *myWriter) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.closeFile()
+}
+
+func (s *myWriter) ProcessRequest(ctx context.Context, req *base.Request) (*base.Response, error) {
+	return nil, nil
+}
+func (s *myWriter) ProcessError(ctx context.Context, req *base.Request, err error) (*base.Response, error) {
+	return nil, err
+}
+
+// 被跳过的响应没有响应体, 不写入
+func (s *myWriter) ProcessResponse(ctx context.Context, req *base.Request, resp *base.Response) (*base.Response, error) {
+	if resp.Skipped() {
+		return resp, nil
+	}
+	httpResp := resp.HttpResp()
+	date := time.Now()
+	file, err := os.CreateTemp("", "webcrawler-warc-*")
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return resp, nil
+	}
+	httpResp.Body = &archivingBody{
+		body: httpResp.Body,
+		file: file,
+		hash: sha1.New(),
+		done: func(payload *payload) {
+			if resp.Truncated() {
+				payload.truncated = TRUNCATED_LENGTH
+			}
+			if err := s.Write(s.exchange(req, httpResp, payload, date)...); err != nil {
+				atomic.AddUint64(&s.errors, 1)
+			}
+		},
+	}
+	return resp, nil
+}
+
+// 一次下载对应的request response和metadata记录
+func (s *myWriter) exchange(req *base.Request, resp *http.Response, payload *payload, date time.Time) []*Record {
+	httpReq := req.HttpReq()
+	if resp.Request != nil {
+		httpReq = resp.Request
+	}
+	targetURI := httpReq.URL.String()
+	header := responseHeader(resp, payload.size)
+	response := &Record{
+		Type:        TYPE_RESPONSE,
+		Id:          NewRecordId(),
+		Date:        date,
+		TargetURI:   targetURI,
+		ContentType: CONTENT_TYPE_RESPONSE,
+		Fields:      [][2]string{{"WARC-Payload-Digest", payload.digest}},
+		Block:       header,
+		Tail:        payload.file,
+		TailSize:    payload.size,
+	}
+	if payload.truncated != "" {
+		response.Fields = append(response.Fields, [2]string{"WARC-Truncated", payload.truncated})
+	}
+	request := &Record{
+		Type:        TYPE_REQUEST,
+		Date:        date,
+		TargetURI:   targetURI,
+		ContentType: CONTENT_TYPE_REQUEST,
+		Fields:      [][2]string{{"WARC-Concurrent-To", response.Id}},
+		Block:       requestBlock(httpReq),
+	}
+	fields := map[string]string{
+		"depth":    fmt.Sprint(req.Depth()),
+		"attempts": fmt.Sprint(req.Attempts()),
+	}
+	if req.Seed() != "" {
+		fields["seed"] = req.Seed()
+	}
+	if httpReq.URL.String() != req.HttpReq().URL.String() {
+		fields["via"] = req.HttpReq().URL.String()
+	}
+	metadata := &Record{
+		Type:        TYPE_METADATA,
+		Date:        date,
+		TargetURI:   targetURI,
+		ContentType: CONTENT_TYPE_FIELDS,
+		Fields:      [][2]string{{"WARC-Concurrent-To", response.Id}},
+		Block:       fieldsBlock(fields),
+	}
+	return []*Record{request, response, metadata}
+}
+
+// 写入临时文件的响应体
+type payload struct {
+	file      *os.File
+	size      int64
+	digest    string
+	truncated string // WARC-Truncated的值, 完整时为空
+}
+
+// 读取响应体的同时写入临时文件, 读完或关闭时调用done, 之后删除临时文件
+// 没有读完就关闭时不读取剩余部分, 已读的部分按截断写入
+type archivingBody struct {
+	body   io.ReadCloser
+	file   *os.File
+	size   int64
+	hash   hash.Hash
+	failed bool // 读取或写临时文件出错时不写入
+	once   sync.Once
+	done   func(payload *payload)
+}
+
+func (s *archivingBody) Read(p []byte) (int, error) {
+	n, err := s.body.Read(p)
+	if n > 0 && !s.failed {
+		if _, werr := s.file.Write(p[:n]); werr != nil {
+			s.failed = true
+		}
+		s.hash.Write(p[:n])
+		s.size += int64(n)
+	}
+	if err == io.EOF {
+		s.finish("")
+	} else if err != nil {
+		s.failed = true
+	}
+	return n, err
+}
+
+func (s *archivingBody) finish(truncated string) {
+	s.once.Do(func() {
+		if !s.failed {
+			s.done(&payload{file: s.file, size: s.size, digest: formatDigest(s.hash.Sum(nil)), truncated: truncated})
+		}
+		s.file.Close()
+		os.Remove(s.file.Name())
+	})
+}
+
+// 多读一个字节, 只剩EOF时仍然是完整的
+func (s *archivingBody) Close() error {
+	var one [1]byte
+	s.Read(one[:])
+	s.finish(TRUNCATED_UNSPECIFIED)
+	return s.body.Close()
+}
@@ -0,0 +1,365 @@
+package warc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"webcrawler/base"
+	dl "webcrawler/downloader"
+)
+
+// 从文件中读出的一条记录
+type parsedRecord struct {
+	header textproto.MIMEHeader
+	block  []byte
+}
+
+// 解析一条未压缩的记录, 检查版本行 Content-Length WARC-Block-Digest和结尾的两个CRLF
+func parseRecord(t *testing.T, data []byte) parsedRecord {
+	t.Helper()
+	reader := bufio.NewReader(bytes.NewReader(data))
+	version, err := reader.ReadString('\n')
+	if err != nil || version != WARC_VERSION+"\r\n" {
+		t.Fatalf("version line %q, %v", version, err)
+	}
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		t.Fatalf("Content-Length %q: %v", header.Get("Content-Length"), err)
+	}
+	block := make([]byte, length)
+	if _, err := io.ReadFull(reader, block); err != nil {
+		t.Fatalf("%s record: %v", header.Get("WARC-Type"), err)
+	}
+	if rest, _ := io.ReadAll(reader); string(rest) != "\r\n\r\n" {
+		t.Errorf("%s record ends with %q; want two CRLF", header.Get("WARC-Type"), rest)
+	}
+	if digest := header.Get("WARC-Block-Digest"); digest != Digest(block) {
+		t.Errorf("%s record: WARC-Block-Digest %s; want %s", header.Get("WARC-Type"), digest, Digest(block))
+	}
+	return parsedRecord{header: header, block: block}
+}
+
+// 读出文件中的所有记录, 每条记录必须是单独的gzip成员
+func readRecords(t *testing.T, path string) []parsedRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := make([]parsedRecord, 0)
+	for {
+		gz.Multistream(false)
+		data, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, parseRecord(t, data))
+		if err := gz.Reset(reader); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return records
+}
+
+func recordTypes(records []parsedRecord) string {
+	types := make([]string, 0, len(records))
+	for _, record := range records {
+		types = append(types, record.header.Get("WARC-Type"))
+	}
+	return fmt.Sprint(types)
+}
+
+func TestRecordFraming(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(Config{Dir: dir, Prefix: "test", Info: map[string]string{"operator": "tester"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 5, 6, 7, 8, 9, 123456000, time.FixedZone("CST", 8*3600))
+	cases := []struct {
+		record *Record
+		block  string
+	}{
+		{&Record{Type: TYPE_METADATA, Date: date, TargetURI: "http://example.com/", ContentType: CONTENT_TYPE_FIELDS,
+			Block: []byte("a: 1\r\n")}, "a: 1\r\n"},
+		// 块由Block和Tail组成
+		{&Record{Type: "resource", Date: date, Block: []byte("head\r\n"),
+			Tail: strings.NewReader("tail\r\n\r\nwith blank lines"), TailSize: 24}, "head\r\ntail\r\n\r\nwith blank lines"},
+		{&Record{Type: TYPE_METADATA, Id: "<urn:uuid:fixed>", Date: date, Fields: [][2]string{{"X-Extra", "yes"}}}, ""},
+	}
+	for _, c := range cases {
+		if err := w.Write(c.record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(cases[0].record); err == nil {
+		t.Error("Write() after Close() should fail")
+	}
+	files := w.Files()
+	if len(files) != 1 || !strings.HasPrefix(filepath.Base(files[0]), "test-") || !strings.HasSuffix(files[0], "-00001.warc.gz") {
+		t.Fatalf("Files() = %v", files)
+	}
+	records := readRecords(t, files[0])
+	if types := recordTypes(records); types != "[warcinfo metadata resource metadata]" {
+		t.Fatalf("record types %s", types)
+	}
+	info := records[0]
+	if info.header.Get("WARC-Filename") != filepath.Base(files[0]) || info.header.Get("Content-Type") != CONTENT_TYPE_FIELDS ||
+		!bytes.Contains(info.block, []byte("operator: tester\r\n")) || !bytes.Contains(info.block, []byte("format: WARC File Format 1.1\r\n")) {
+		t.Errorf("warcinfo record %v\n%s", info.header, info.block)
+	}
+	for i, c := range cases {
+		record := records[i+1]
+		if string(record.block) != c.block {
+			t.Errorf("record %d block %q; want %q", i, record.block, c.block)
+		}
+		if record.header.Get("WARC-Warcinfo-ID") != info.header.Get("WARC-Record-ID") {
+			t.Errorf("record %d WARC-Warcinfo-ID %s; want %s", i, record.header.Get("WARC-Warcinfo-ID"), info.header.Get("WARC-Record-ID"))
+		}
+		if record.header.Get("WARC-Date") != "2024-05-05T23:08:09.123456Z" {
+			t.Errorf("record %d WARC-Date %s", i, record.header.Get("WARC-Date"))
+		}
+		if id := record.header.Get("WARC-Record-ID"); id != c.record.Id || !strings.HasPrefix(id, "<urn:uuid:") {
+			t.Errorf("record %d WARC-Record-ID %s; want %s", i, id, c.record.Id)
+		}
+	}
+	if records[3].header.Get("X-Extra") != "yes" || records[1].header.Get("WARC-Target-URI") != "http://example.com/" {
+		t.Errorf("record fields %v %v", records[1].header, records[3].header)
+	}
+}
+
+// 读完的响应体是完整的, 没有读完就关闭的带WARC-Truncated, 索引指向响应记录
+func TestMiddleware(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, "<html>page</html>")
+		case "/redirect":
+			http.Redirect(w, r, "/page", http.StatusFound)
+		case "/big":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write(bytes.Repeat([]byte("x"), 100000))
+		}
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	w, err := NewWriter(Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 不跟随重定向, 记录302响应
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	d := dl.NewPageDownloader(client, nil, nil, w)
+	cases := []struct {
+		path      string
+		read      int64 // 读取的字节数, -1表示读完
+		truncated string
+	}{
+		{"/page", -1, ""},
+		{"/redirect", -1, ""},
+		{"/big", 10, TRUNCATED_UNSPECIFIED},
+	}
+	bodies := make(map[string][]byte)
+	for _, c := range cases {
+		httpReq, _ := http.NewRequest(http.MethodGet, srv.URL+c.path, nil)
+		resp, err := d.Download(context.Background(), base.NewRequest(httpReq, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := resp.HttpResp().Body
+		var reader io.Reader = body
+		if c.read >= 0 {
+			reader = io.LimitReader(body, c.read)
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Close()
+		bodies[srv.URL+c.path] = data
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := w.Files()
+	if len(files) != 1 {
+		t.Fatalf("Files() = %v", files)
+	}
+	records := readRecords(t, files[0])
+	if types := recordTypes(records); types != "[warcinfo request response metadata request response metadata request response metadata]" {
+		t.Fatalf("record types %s", types)
+	}
+	for i, c := range cases {
+		request, response, metadata := records[1+3*i], records[2+3*i], records[3+3*i]
+		targetURI := srv.URL + c.path
+		for _, record := range []parsedRecord{request, response, metadata} {
+			if record.header.Get("WARC-Target-URI") != targetURI {
+				t.Errorf("%s: %s record WARC-Target-URI %s", c.path, record.header.Get("WARC-Type"), record.header.Get("WARC-Target-URI"))
+			}
+		}
+		if request.header.Get("WARC-Concurrent-To") != response.header.Get("WARC-Record-ID") ||
+			metadata.header.Get("WARC-Concurrent-To") != response.header.Get("WARC-Record-ID") {
+			t.Errorf("%s: the request and metadata records are not concurrent to the response", c.path)
+		}
+		if !bytes.HasPrefix(request.block, []byte("GET "+c.path+" HTTP/1.1\r\n")) {
+			t.Errorf("%s: request block %q", c.path, request.block)
+		}
+		if !bytes.Contains(metadata.block, []byte("depth: 1\r\n")) {
+			t.Errorf("%s: metadata block %q", c.path, metadata.block)
+		}
+		if response.header.Get("WARC-Truncated") != c.truncated {
+			t.Errorf("%s: WARC-Truncated %q; want %q", c.path, response.header.Get("WARC-Truncated"), c.truncated)
+		}
+		httpResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response.block)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 关闭时会多读一个字节判断是否只剩EOF, 截断的负载是响应体的前缀
+		payload, _ := io.ReadAll(httpResp.Body)
+		read := bodies[targetURI]
+		if c.truncated == "" && !bytes.Equal(payload, read) ||
+			c.truncated != "" && (!bytes.HasPrefix(payload, read) || len(payload) > len(read)+1) {
+			t.Errorf("%s: payload %d bytes; want the %d bytes read", c.path, len(payload), len(read))
+		}
+		if digest := response.header.Get("WARC-Payload-Digest"); digest != Digest(payload) {
+			t.Errorf("%s: WARC-Payload-Digest %s; want %s", c.path, digest, Digest(payload))
+		}
+	}
+
+	// 索引按SURT排序, 偏移和长度指向压缩后的响应记录
+	cdx, err := os.ReadFile(strings.TrimSuffix(files[0], ".warc.gz") + ".cdx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(cdx), "\n"), "\n")
+	if len(lines) != 1+len(cases) || lines[0] != CDX_HEADER {
+		t.Fatalf("cdx:\n%s", cdx)
+	}
+	warc, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][3]string{ // url -> MIME类型 状态码 重定向
+		srv.URL + "/big":      {"text/plain", "200", "-"},
+		srv.URL + "/page":     {"text/html", "200", "-"},
+		srv.URL + "/redirect": {"text/html", "302", "/page"},
+	}
+	urls := make([]string, 0)
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 11 {
+			t.Errorf("cdx line %q has %d fields; want 11", line, len(fields))
+			continue
+		}
+		rawUrl := fields[2]
+		urls = append(urls, rawUrl)
+		if fields[0] != SURT(rawUrl) || [3]string{fields[3], fields[4], fields[6]} != want[rawUrl] || fields[10] != filepath.Base(files[0]) {
+			t.Errorf("cdx line %q", line)
+		}
+		offset, _ := strconv.ParseInt(fields[9], 10, 64)
+		length, _ := strconv.ParseInt(fields[8], 10, 64)
+		if offset <= 0 || length <= 0 || offset+length > int64(len(warc)) {
+			t.Errorf("cdx line %q: offset or length out of the file", line)
+			continue
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(warc[offset : offset+length]))
+		if err != nil {
+			t.Fatalf("cdx line %q: %v", line, err)
+		}
+		gz.Multistream(false)
+		data, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("cdx line %q: %v", line, err)
+		}
+		record := parseRecord(t, data)
+		if record.header.Get("WARC-Type") != TYPE_RESPONSE || record.header.Get("WARC-Target-URI") != rawUrl ||
+			"sha1:"+fields[5] != record.header.Get("WARC-Payload-Digest") {
+			t.Errorf("cdx line %q points to %v", line, record.header)
+		}
+	}
+	if fmt.Sprint(urls) != fmt.Sprint([]string{srv.URL + "/big", srv.URL + "/page", srv.URL + "/redirect"}) {
+		t.Errorf("cdx urls %v are not sorted", urls)
+	}
+}
+
+// 文件超过大小后换新文件, 同一组记录在同一个文件中, 每个文件有自己的warcinfo和索引
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(Config{Dir: dir, MaxFileSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := func(path string) *Record {
+		return &Record{Type: TYPE_RESPONSE, Date: time.Now(), TargetURI: "http://example.com" + path, ContentType: CONTENT_TYPE_RESPONSE,
+			Block: []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")}
+	}
+	groups := [][]*Record{
+		{response("/a"), response("/b")},
+		{response("/c")},
+		{response("/d"), response("/e"), response("/f")},
+	}
+	for _, group := range groups {
+		if err := w.Write(group...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := w.Files()
+	if len(files) != len(groups) {
+		t.Fatalf("Files() = %v; want %d files", files, len(groups))
+	}
+	for i, file := range files {
+		if !strings.HasSuffix(file, fmt.Sprintf("-%05d.warc.gz", i+1)) {
+			t.Errorf("file %d is %s", i, file)
+		}
+		records := readRecords(t, file)
+		if len(records) != 1+len(groups[i]) || records[0].header.Get("WARC-Filename") != filepath.Base(file) {
+			t.Errorf("%s: record types %s, WARC-Filename %s", file, recordTypes(records), records[0].header.Get("WARC-Filename"))
+		}
+		for j, record := range records[1:] {
+			if record.header.Get("WARC-Target-URI") != groups[i][j].TargetURI ||
+				record.header.Get("WARC-Warcinfo-ID") != records[0].header.Get("WARC-Record-ID") {
+				t.Errorf("%s: record %d %v", file, j, record.header)
+			}
+		}
+		cdx, err := os.ReadFile(strings.TrimSuffix(file, ".warc.gz") + ".cdx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(cdx), "\n"); lines != 1+len(groups[i]) {
+			t.Errorf("%s: %d cdx lines; want %d", file, lines, 1+len(groups[i]))
+		}
+	}
+}